@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//The claims the API Gateway authorizer verified for the caller
+func authorizerClaims(event events.APIGatewayProxyRequest) map[string]interface{} {
+	claims, _ := event.RequestContext.Authorizer["claims"].(map[string]interface{})
+	return claims
+}
+
+//Whether the verified caller is the requested sub and a member of the admin group, ADMIN_GROUP (default admin)
+func isAdmin(event events.APIGatewayProxyRequest, sub string, adminGroup string) bool {
+	claims := authorizerClaims(event)
+	if claims == nil {
+		return false
+	}
+	if claimSub, _ := claims["sub"].(string); claimSub == "" || claimSub != sub {
+		return false
+	}
+	if adminGroup == "" {
+		adminGroup = "admin"
+	}
+	groups, _ := claims["cognito:groups"].(string)
+	//API Gateway passes the groups as either "a,b" or "[a b]"
+	for _, group := range strings.FieldsFunc(groups, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '[' || r == ']'
+	}) {
+		if group == adminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+//Verified admins may name any company to operate on.  Other users may only name a company when MEMBERSHIP_TABLE
+//is configured, their membership is checked once the user is loaded
+func (user *User) authorizeCompanyOverride(event events.APIGatewayProxyRequest) error {
+	if user.CompanyID == "" {
+		return nil
+	}
+	user.companyOverride = user.CompanyID
+	user.CompanyID = ""
+	if isAdmin(event, user.Sub, user.config.AdminGroup) {
+		user.admin = true
+		return nil
+	}
+	if user.config.MembershipTable == "" && !user.config.userKeyIncludesCompany() {
+		return fmt.Errorf("%w: company_id may only be set by admins", ErrForbidden)
+	}
+	return nil
+}
+
+//Check the user belongs to the company they asked to operate on, admins may operate on any company
+func (user *User) authorizeMembership(svc dynamodbiface.DynamoDBAPI) error {
+	if user.admin {
+		user.log.Println("Admin " + user.Sub + " operating on company " + user.companyOverride)
+		return nil
+	}
+	if user.config.userKeyIncludesCompany() { //The user record was found under the company
+		return nil
+	}
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(user.config.MembershipTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"sub": {
+				S: aws.String(user.Sub),
+			},
+			"company_id": {
+				S: aws.String(user.companyOverride),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("getting membership of %s in %s: %w", user.Sub, user.companyOverride, err)
+	}
+	if len(result.Item) == 0 {
+		return fmt.Errorf("%w: not a member of company %s", ErrForbidden, user.companyOverride)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+//An event whose authorizer verified the sub with the Cognito groups, no claims when sub is empty
+func claimsEvent(sub string, groups string) events.APIGatewayProxyRequest {
+	var event events.APIGatewayProxyRequest
+	if sub != "" {
+		event.RequestContext.Authorizer = map[string]interface{}{
+			"claims": map[string]interface{}{"sub": sub, "cognito:groups": groups},
+		}
+	}
+	return event
+}
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      events.APIGatewayProxyRequest
+		adminGroup string
+		want       bool
+	}{
+		{"no claims", claimsEvent("", ""), "", false},
+		{"not in a group", claimsEvent("sub-1", ""), "", false},
+		{"comma separated groups", claimsEvent("sub-1", "users,admin"), "", true},
+		{"bracketed groups", claimsEvent("sub-1", "[users admin]"), "", true},
+		{"another group", claimsEvent("sub-1", "users,administrators"), "", false},
+		{"configured group", claimsEvent("sub-1", "superusers"), "superusers", true},
+		{"admin claiming another sub", claimsEvent("sub-2", "admin"), "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isAdmin(test.event, "sub-1", test.adminGroup); got != test.want {
+				t.Errorf("isAdmin() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeCompanyOverride(t *testing.T) {
+	tests := []struct {
+		name       string
+		company    string
+		event      events.APIGatewayProxyRequest
+		membership string
+		wantErr    error
+		wantAdmin  bool
+	}{
+		{"no override", "", claimsEvent("sub-1", ""), "", nil, false},
+		{"admin", "globex", claimsEvent("sub-1", "admin"), "", nil, true},
+		{"non admin", "globex", claimsEvent("sub-1", "users"), "", ErrForbidden, false},
+		{"member checked later", "globex", claimsEvent("sub-1", "users"), "memberships", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.config.MembershipTable = test.membership
+			user.CompanyID = test.company
+			err := user.authorizeCompanyOverride(test.event)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("authorizeCompanyOverride() error = %v, want %v", err, test.wantErr)
+			}
+			if user.companyOverride != test.company || user.CompanyID != "" || user.admin != test.wantAdmin {
+				t.Errorf("override %q, company %q, admin %v, want override %q, no company until the record is loaded, admin %v",
+					user.companyOverride, user.CompanyID, user.admin, test.company, test.wantAdmin)
+			}
+		})
+	}
+}
+
+func TestAuthorizeMembership(t *testing.T) {
+	tests := []struct {
+		name      string
+		admin     bool
+		company   string
+		sortKey   string
+		wantErr   error
+		wantReads int
+	}{
+		{"member", false, "globex", "", nil, 1},
+		{"not a member", false, "initech", "", ErrForbidden, 1},
+		{"admin", true, "initech", "", nil, 0},
+		{"record keyed by company", false, "initech", "company_id", nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			captureLog(t)
+			db := newFakeDynamo()
+			db.put("memberships", map[string]string{"sub": "sub-1", "company_id": "globex"})
+			db.put("memberships", map[string]string{"sub": "sub-2", "company_id": "initech"})
+			user := newTestUser()
+			user.config.MembershipTable = "memberships"
+			user.config.SortKey = test.sortKey
+			user.companyOverride = test.company
+			user.admin = test.admin
+			err := user.authorizeMembership(db)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("authorizeMembership() error = %v, want %v", err, test.wantErr)
+			}
+			if db.gets != test.wantReads {
+				t.Errorf("read the membership table %d times, want %d", db.gets, test.wantReads)
+			}
+		})
+	}
+}
+
+func TestAuthorizeMembershipFailure(t *testing.T) {
+	db := newFakeDynamo()
+	db.getErr = errors.New("throttled")
+	user := newTestUser()
+	user.config.MembershipTable = "memberships"
+	user.companyOverride = "globex"
+	if err := user.authorizeMembership(db); err == nil || errors.Is(err, ErrForbidden) || statusCodeFor(err) != http.StatusInternalServerError {
+		t.Errorf("authorizeMembership() error = %v, want an unexpected lookup failure", err)
+	}
+}
+
+//A member's request runs against the company they named
+func TestHandleRequestMemberOverride(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	h.config.MembershipTable = "memberships"
+	clients.dynamo.(*fakeDynamo).put("memberships", map[string]string{"sub": "sub-1", "company_id": "globex"})
+	tests := []struct {
+		company    string
+		wantStatus int
+		wantURL    string
+	}{
+		{"globex", http.StatusOK, "https://bucket.s3.amazonaws.com/globex/file.txt?"},
+		{"initech", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.company, func(t *testing.T) {
+			response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download","company_id":"`+test.company+`"}`)
+			if response.StatusCode != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+			var signed URLSign
+			json.Unmarshal([]byte(response.Body), &signed)
+			if !strings.HasPrefix(signed.URL, test.wantURL) || (test.wantURL == "") != (signed.URL == "") {
+				t.Errorf("signed %q, want %q", signed.URL, test.wantURL)
+			}
+		})
+	}
+}
+
+//The override replaces the admin's stored company once their record is read
+func TestValidateUserCompanyOverride(t *testing.T) {
+	user := newTestUser()
+	user.CompanyID = ""
+	user.companyOverride = "globex"
+	user.admin = true
+	if valid, err := user.validateUser(withS3Storage(&awsClients{dynamo: newUserTable(1, true), lister: newFakeS3()})); !valid || err != nil {
+		t.Fatalf("validateUser() = %v, %v", valid, err)
+	}
+	if user.CompanyID != "globex" {
+		t.Errorf("company %q, want the override globex", user.CompanyID)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+//The signed URL rewritten to each regional CDN host in CDN_REGION_HOSTS, a comma separated list of region=host
+//pairs such as eu-west-1=eu.cdn.example.com.  The signature covers the canonical S3 host, so the CDN must
+//forward requests to S3 with that host rather than its own for the alternate URLs to be accepted
+func alternateURLs(signed string) map[string]string {
+	config := setting("CDN_REGION_HOSTS")
+	if config == "" {
+		return nil
+	}
+	canonical, err := url.Parse(signed)
+	if err != nil {
+		log.Println("Unable to parse signed URL for CDN rewriting: " + err.Error())
+		return nil
+	}
+	alternates := map[string]string{}
+	for _, pair := range strings.Split(config, ",") {
+		region, host, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || region == "" || !validHost(host) {
+			log.Println("Invalid entry in CDN_REGION_HOSTS, skipping: " + pair)
+			continue
+		}
+		rewritten := *canonical
+		rewritten.Host = host
+		alternates[region] = rewritten.String()
+	}
+	if len(alternates) == 0 {
+		return nil
+	}
+	return alternates
+}
+
+//Whether the host is a bare host name or host:port, without a scheme or path
+func validHost(host string) bool {
+	if host == "" || strings.ContainsAny(host, "/?#@ ") {
+		return false
+	}
+	parsed, err := url.Parse("https://" + host)
+	return err == nil && parsed.Host == host
+}
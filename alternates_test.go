@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlternateURLs(t *testing.T) {
+	signed := "https://bucket.s3.amazonaws.com/acme/file.txt?X-Amz-Signature=abc"
+	tests := []struct {
+		name  string
+		hosts string
+		want  map[string]string
+	}{
+		{"none configured", "", nil},
+		{"regions", "eu-west-1=eu.cdn.example.com, ap-south-1=ap.cdn.example.com:8443", map[string]string{
+			"eu-west-1":  "https://eu.cdn.example.com/acme/file.txt?X-Amz-Signature=abc",
+			"ap-south-1": "https://ap.cdn.example.com:8443/acme/file.txt?X-Amz-Signature=abc",
+		}},
+		{"invalid entries skipped", "eu-west-1=https://eu.cdn.example.com,=cdn.example.com,us-east-1,ap-south-1=ap.cdn.example.com",
+			map[string]string{"ap-south-1": "https://ap.cdn.example.com/acme/file.txt?X-Amz-Signature=abc"}},
+		{"every entry invalid", "eu-west-1=cdn.example.com/eu", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("CDN_REGION_HOSTS", test.hosts)
+			captureLog(t)
+			if got := alternateURLs(signed); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("alternateURLs() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"cdn.example.com", true},
+		{"cdn.example.com:8443", true},
+		{"", false},
+		{"https://cdn.example.com", false},
+		{"cdn.example.com/path", false},
+		{"user@cdn.example.com", false},
+		{"cdn.example.com?x=1", false},
+		{"cdn example.com", false},
+	}
+	for _, test := range tests {
+		if got := validHost(test.host); got != test.want {
+			t.Errorf("validHost(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+//S3 signed URLs are returned with the regional alternates
+func TestAlternateURLsSigned(t *testing.T) {
+	t.Setenv("CDN_REGION_HOSTS", "eu-west-1=eu.cdn.example.com")
+	signed, _ := presignQuery(t, newTestUser())
+	want := strings.Replace(signed.URL, "bucket.s3.amazonaws.com", "eu.cdn.example.com", 1)
+	if got := signed.AlternateURLs["eu-west-1"]; got != want {
+		t.Errorf("alternate_urls[eu-west-1] = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+//HandleEvent an API Gateway REST API (v1) or HTTP API (v2) event, detected by the payload's version.  Both are
+//handled by HandleRequest, with v2 events translated to and from the v1 shapes
+func (h *handler) HandleEvent(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var format struct {
+		Version string `json:"version"`
+	}
+	err := json.Unmarshal(payload, &format)
+	if err != nil {
+		return nil, fmt.Errorf("decoding event: %w", err)
+	}
+	if format.Version != "2.0" {
+		var event events.APIGatewayProxyRequest
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return nil, fmt.Errorf("decoding REST API event: %w", err)
+		}
+		return h.HandleRequest(ctx, event)
+	}
+	var event events.APIGatewayV2HTTPRequest
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return nil, fmt.Errorf("decoding HTTP API event: %w", err)
+	}
+	response, err := h.HandleRequest(ctx, proxyRequestFromV2(event))
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: response.StatusCode,
+		Headers:    response.Headers,
+		Body:       response.Body,
+	}, err
+}
+
+//Translate the parts of an HTTP API event the handler reads into a REST API event.  JWT authorizer claims are
+//placed where a Cognito user pool authorizer puts them.  A body that isn't valid base64 is passed on as is to be
+//rejected as malformed
+func proxyRequestFromV2(event events.APIGatewayV2HTTPRequest) events.APIGatewayProxyRequest {
+	body := event.Body
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err == nil {
+			body = string(decoded)
+		}
+	}
+	proxyEvent := events.APIGatewayProxyRequest{
+		HTTPMethod:            event.RequestContext.HTTP.Method,
+		Path:                  event.RawPath,
+		Headers:               event.Headers,
+		QueryStringParameters: event.QueryStringParameters,
+		Body:                  body,
+	}
+	proxyEvent.RequestContext.Identity.SourceIP = event.RequestContext.HTTP.SourceIP
+	if event.RequestContext.Authorizer != nil && event.RequestContext.Authorizer.JWT != nil {
+		claims := map[string]interface{}{}
+		for name, value := range event.RequestContext.Authorizer.JWT.Claims {
+			claims[name] = value
+		}
+		proxyEvent.RequestContext.Authorizer = map[string]interface{}{"claims": claims}
+	}
+	return proxyEvent
+}
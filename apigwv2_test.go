@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const downloadBody = `{"sub":"sub-1","file_request":"file.txt","operation":"download"}`
+
+func TestHandleEventVersions(t *testing.T) {
+	v2 := events.APIGatewayV2HTTPRequest{Version: "2.0", Body: downloadBody}
+	v2.RequestContext.HTTP.Method = "POST"
+	encoded := v2
+	encoded.Body = base64.StdEncoding.EncodeToString([]byte(downloadBody))
+	encoded.IsBase64Encoded = true
+	tests := []struct {
+		name  string
+		event interface{}
+	}{
+		{"REST API", events.APIGatewayProxyRequest{HTTPMethod: "POST", Body: downloadBody}},
+		{"HTTP API", v2},
+		{"HTTP API base64 body", encoded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, 1)
+			payload, err := json.Marshal(test.event)
+			if err != nil {
+				t.Fatalf("marshaling event: %v", err)
+			}
+			result, err := h.HandleEvent(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("HandleEvent() error = %v", err)
+			}
+			var status int
+			var body string
+			switch response := result.(type) {
+			case events.APIGatewayProxyResponse:
+				_, v2Event := test.event.(events.APIGatewayV2HTTPRequest)
+				if v2Event {
+					t.Errorf("HandleEvent() = %T, want an HTTP API response for an HTTP API event", result)
+				}
+				status, body = response.StatusCode, response.Body
+			case events.APIGatewayV2HTTPResponse:
+				if _, v1Event := test.event.(events.APIGatewayProxyRequest); v1Event {
+					t.Errorf("HandleEvent() = %T, want a REST API response for a REST API event", result)
+				}
+				status, body = response.StatusCode, response.Body
+			default:
+				t.Fatalf("HandleEvent() = %T, want an API Gateway response", result)
+			}
+			if status != http.StatusOK {
+				t.Errorf("status = %d, want 200: %s", status, body)
+			}
+		})
+	}
+}
+
+func TestHandleEventMalformed(t *testing.T) {
+	h := &handler{config: &Config{}}
+	if _, err := h.HandleEvent(context.Background(), json.RawMessage(`[`)); err == nil {
+		t.Error("HandleEvent() of a malformed payload error = nil, want an error")
+	}
+}
+
+func TestProxyRequestFromV2(t *testing.T) {
+	var event events.APIGatewayV2HTTPRequest
+	event.RequestContext.HTTP.Method = "POST"
+	event.RequestContext.HTTP.SourceIP = "192.0.2.1"
+	event.RawPath = "/sign"
+	event.Headers = map[string]string{"accept": "text/html"}
+	event.Body = "not base64!"
+	event.IsBase64Encoded = true
+	event.RequestContext.Authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+		JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+			Claims: map[string]string{"sub": "sub-1", "cognito:groups": "[admin]"},
+		},
+	}
+	proxy := proxyRequestFromV2(event)
+	if proxy.HTTPMethod != "POST" || proxy.Path != "/sign" || proxy.Headers["accept"] != "text/html" {
+		t.Errorf("request %s %s with headers %v, want POST /sign with the headers", proxy.HTTPMethod, proxy.Path, proxy.Headers)
+	}
+	if proxy.Body != "not base64!" {
+		t.Errorf("body = %q, want a body that isn't base64 passed on as is", proxy.Body)
+	}
+	if proxy.RequestContext.Identity.SourceIP != "192.0.2.1" {
+		t.Errorf("source IP = %q, want 192.0.2.1", proxy.RequestContext.Identity.SourceIP)
+	}
+	if !isAdmin(proxy, "sub-1", "") {
+		t.Errorf("authorizer %v, want the JWT claims where isAdmin reads them", proxy.RequestContext.Authorizer)
+	}
+}
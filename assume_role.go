@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//The prefixes of the settings each role is assumed with
+const (
+	signingRoleSettings = "SIGNING_ROLE"
+	listingRoleSettings = "LISTING_ROLE"
+)
+
+//assumedRole a role and the options it is assumed with, the same role assumed with other options has its own
+//credentials
+type assumedRole struct {
+	roleARN     string
+	externalID  string
+	sessionName string
+}
+
+var (
+	assumeRoleMu    sync.Mutex
+	assumeRoleCreds = map[assumedRole]*credentials.Credentials{}
+)
+
+//Credentials for a cross account role assumed with the options of the settings, nil when the role is empty and
+//the default credentials are used.  The credentials are shared across invocations of a warm container and
+//refreshed by the SDK before they expire
+func assumedRoleCredentials(sess *session.Session, roleARN string, settings string) *credentials.Credentials {
+	if roleARN == "" {
+		return nil
+	}
+	role := assumedRole{roleARN: roleARN}
+	role.externalID, role.sessionName = assumeRoleOptions(settings)
+	assumeRoleMu.Lock()
+	defer assumeRoleMu.Unlock()
+	if creds, ok := assumeRoleCreds[role]; ok {
+		return creds
+	}
+	creds := stscreds.NewCredentials(sess, roleARN, role.apply)
+	assumeRoleCreds[role] = creds
+	return creds
+}
+
+//The external ID and session name a role is assumed with, e.g. LISTING_ROLE_EXTERNAL_ID and
+//LISTING_ROLE_SESSION_NAME, each falling back to the signing role's when unset
+func assumeRoleOptions(settings string) (string, string) {
+	option := func(name string) string {
+		if value := os.Getenv(settings + name); value != "" {
+			return value
+		}
+		return os.Getenv(signingRoleSettings + name)
+	}
+	return option("_EXTERNAL_ID"), option("_SESSION_NAME")
+}
+
+//Apply the role's external ID and session name to the role session
+func (role assumedRole) apply(provider *stscreds.AssumeRoleProvider) {
+	if role.externalID != "" {
+		provider.ExternalID = &role.externalID
+	}
+	if role.sessionName != "" {
+		provider.RoleSessionName = role.sessionName
+	}
+}
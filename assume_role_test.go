@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+//A newTestSession whose STS calls never reach AWS, each AssumeRole is recorded and answered with ASIAROLE credentials
+func stsSession(assumed *[]*sts.AssumeRoleInput) *session.Session {
+	sess := newTestSession()
+	sess.Handlers.Send.Clear()
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		//The STS client adds its protocol's handlers after the session's, so they are removed per request
+		r.Handlers.UnmarshalMeta.Clear()
+		r.Handlers.Unmarshal.Clear()
+		r.Handlers.ValidateResponse.Clear()
+		*assumed = append(*assumed, r.Params.(*sts.AssumeRoleInput))
+		r.Data.(*sts.AssumeRoleOutput).Credentials = &sts.Credentials{AccessKeyId: aws.String("ASIAROLE"),
+			SecretAccessKey: aws.String("role-secret"), SessionToken: aws.String("role-token"), Expiration: aws.Time(time.Now().Add(time.Hour))}
+	})
+	return sess
+}
+
+//Uploads are signed with the role's credentials, which are assumed once with the configured options
+func TestAssumedRoleSigning(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		externalID     string
+		sessionName    string
+		wantCredential string
+	}{
+		{"default credentials", "", "", "", "AKIDEXAMPLE"},
+		{"role", "arn:aws:iam::123456789012:role/signer", "", "", "ASIAROLE"},
+		{"role with options", "arn:aws:iam::123456789012:role/signer", "tenant-42", "sign-s3-url", "ASIAROLE"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SIGNING_ROLE_EXTERNAL_ID", test.externalID)
+			t.Setenv("SIGNING_ROLE_SESSION_NAME", test.sessionName)
+			resetAssumedRoles(t)
+			var assumed []*sts.AssumeRoleInput
+			sess := stsSession(&assumed)
+			user := newTestUser()
+			user.config.SigningRoleARN = test.role
+			for i := 0; i < 2; i++ {
+				signed, err := user.signURLForUser(withS3Storage(&awsClients{presigner: newS3Client(sess, "", test.role, signingRoleSettings)}))
+				if err != nil {
+					t.Fatalf("signURLForUser() error = %v", err)
+				}
+				if !strings.Contains(signed.URL, "X-Amz-Credential="+test.wantCredential+"%2F") {
+					t.Errorf("URL %s, want it signed by %s", signed.URL, test.wantCredential)
+				}
+			}
+			if test.role == "" {
+				if len(assumed) != 0 {
+					t.Errorf("assumed %d roles, want none", len(assumed))
+				}
+				return
+			}
+			if len(assumed) != 1 {
+				t.Fatalf("assumed the role %d times, want once", len(assumed))
+			}
+			input := assumed[0]
+			if aws.StringValue(input.RoleArn) != test.role || aws.StringValue(input.ExternalId) != test.externalID {
+				t.Errorf("assumed %s with external ID %q, want %s with %q", aws.StringValue(input.RoleArn),
+					aws.StringValue(input.ExternalId), test.role, test.externalID)
+			}
+			if test.sessionName != "" && aws.StringValue(input.RoleSessionName) != test.sessionName {
+				t.Errorf("session name %q, want %q", aws.StringValue(input.RoleSessionName), test.sessionName)
+			}
+		})
+	}
+}
+
+//Forget the roles assumed by earlier tests, and those assumed by this one once it finishes
+func resetAssumedRoles(t *testing.T) {
+	assumeRoleCreds = map[assumedRole]*credentials.Credentials{}
+	t.Cleanup(func() { assumeRoleCreds = map[assumedRole]*credentials.Credentials{} })
+}
+
+//Each role's credentials are created once and shared by every client using the role
+func TestAssumedRoleCredentialsPerRole(t *testing.T) {
+	resetAssumedRoles(t)
+	var assumed []*sts.AssumeRoleInput
+	sess := stsSession(&assumed)
+	signer := assumedRoleCredentials(sess, "arn:aws:iam::123456789012:role/signer", signingRoleSettings)
+	lister := assumedRoleCredentials(sess, "arn:aws:iam::123456789012:role/lister", listingRoleSettings)
+	if signer == nil || lister == nil || signer == lister {
+		t.Fatalf("credentials %p and %p, want separate credentials for each role", signer, lister)
+	}
+	if again := assumedRoleCredentials(sess, "arn:aws:iam::123456789012:role/signer", signingRoleSettings); again != signer {
+		t.Error("the signing role's credentials were created again, want them shared")
+	}
+	if creds := assumedRoleCredentials(sess, "", signingRoleSettings); creds != nil {
+		t.Errorf("credentials %p without a role, want the default credentials used", creds)
+	}
+}
+
+//The lister assumes LISTING_ROLE_ARN, falling back to the signing role, while the presigner always signs with
+//SIGNING_ROLE_ARN
+func TestNewAWSClientsRoles(t *testing.T) {
+	const signingRole, listingRole = "arn:aws:iam::123456789012:role/signer", "arn:aws:iam::123456789012:role/lister"
+	tests := []struct {
+		name        string
+		listingRole string
+		wantLister  string
+	}{
+		{"shared role", "", signingRole},
+		{"least privilege listing role", listingRole, listingRole},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetAssumedRoles(t)
+			t.Setenv("AWS_REGION", "us-east-1")
+			t.Setenv("PLATFORM", "lambda")
+			t.Setenv("DYNAMO_TABLE", "users")
+			t.Setenv("SIGNING_ROLE_ARN", signingRole)
+			t.Setenv("LISTING_ROLE_ARN", test.listingRole)
+			for _, name := range []string{"SIGNING_ROLE_EXTERNAL_ID", "SIGNING_ROLE_SESSION_NAME", "LISTING_ROLE_EXTERNAL_ID", "LISTING_ROLE_SESSION_NAME"} {
+				t.Setenv(name, "")
+			}
+			loaded, err := LoadConfig()
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			clients, err := newAWSClients(loaded)
+			if err != nil {
+				t.Fatalf("newAWSClients() error = %v", err)
+			}
+			signer := assumeRoleCreds[assumedRole{roleARN: signingRole}]
+			if got := clients.presigner.(*s3.S3).Config.Credentials; got != signer || got != clients.s3Credentials {
+				t.Errorf("presigner credentials %p, want the signing role's %p", got, signer)
+			}
+			lister := assumeRoleCreds[assumedRole{roleARN: test.wantLister}]
+			if got := clients.lister.(*s3.S3).Config.Credentials; got != lister {
+				t.Errorf("lister credentials %p, want %s's %p", got, test.wantLister, lister)
+			}
+		})
+	}
+}
+
+//The listing role is assumed with LISTING_ROLE_EXTERNAL_ID and LISTING_ROLE_SESSION_NAME, each falling back to the
+//signing role's, and a role shared by both gets its own credentials when the options differ
+func TestListingRoleOptions(t *testing.T) {
+	const role = "arn:aws:iam::123456789012:role/shared"
+	tests := []struct {
+		name            string
+		env             map[string]string
+		wantExternalID  string
+		wantSessionName string
+		wantShared      bool
+	}{
+		{"signing role's options", map[string]string{"SIGNING_ROLE_EXTERNAL_ID": "tenant-42", "SIGNING_ROLE_SESSION_NAME": "signer"},
+			"tenant-42", "signer", true},
+		{"own options", map[string]string{"SIGNING_ROLE_EXTERNAL_ID": "tenant-42", "SIGNING_ROLE_SESSION_NAME": "signer",
+			"LISTING_ROLE_EXTERNAL_ID": "lister-7", "LISTING_ROLE_SESSION_NAME": "lister"}, "lister-7", "lister", false},
+		{"own session name only", map[string]string{"SIGNING_ROLE_EXTERNAL_ID": "tenant-42", "LISTING_ROLE_SESSION_NAME": "lister"},
+			"tenant-42", "lister", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"SIGNING_ROLE_EXTERNAL_ID", "SIGNING_ROLE_SESSION_NAME", "LISTING_ROLE_EXTERNAL_ID", "LISTING_ROLE_SESSION_NAME"} {
+				t.Setenv(name, test.env[name])
+			}
+			resetAssumedRoles(t)
+			var assumed []*sts.AssumeRoleInput
+			sess := stsSession(&assumed)
+			signer := assumedRoleCredentials(sess, role, signingRoleSettings)
+			lister := assumedRoleCredentials(sess, role, listingRoleSettings)
+			if shared := signer == lister; shared != test.wantShared {
+				t.Errorf("credentials shared %v, want %v", shared, test.wantShared)
+			}
+			if _, err := lister.Get(); err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			input := assumed[0]
+			if aws.StringValue(input.ExternalId) != test.wantExternalID || aws.StringValue(input.RoleSessionName) != test.wantSessionName {
+				t.Errorf("listing role assumed with external ID %q and session %q, want %q and %q", aws.StringValue(input.ExternalId),
+					aws.StringValue(input.RoleSessionName), test.wantExternalID, test.wantSessionName)
+			}
+		})
+	}
+}
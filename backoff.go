@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//adaptiveReads slows the DynamoDB reads of an invocation once one is throttled, so an under provisioned table
+//isn't hit again at full rate after the SDK's own retries give up.  Each throttle doubles the delay before the
+//next read from DYNAMO_THROTTLE_BACKOFF (default 50ms) up to DYNAMO_THROTTLE_MAX_BACKOFF (default 1s), and each
+//unthrottled read halves it
+type adaptiveReads struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu    sync.Mutex
+	delay time.Duration
+	sleep func(time.Duration) //time.Sleep, replaceable so the delays can be observed
+}
+
+//Wrap the client with adaptive backoff, the clients are created per request so the delay is per invocation
+func newAdaptiveReads(svc dynamodbiface.DynamoDBAPI) *adaptiveReads {
+	return &adaptiveReads{DynamoDBAPI: svc, sleep: time.Sleep}
+}
+
+//GetItem after waiting out the current delay
+func (reads *adaptiveReads) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	reads.wait()
+	output, err := reads.DynamoDBAPI.GetItem(input)
+	reads.record(throttled(err))
+	return output, err
+}
+
+//BatchGetItem after waiting out the current delay, unprocessed keys count as a throttle
+func (reads *adaptiveReads) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	reads.wait()
+	output, err := reads.DynamoDBAPI.BatchGetItem(input)
+	reads.record(throttled(err) || err == nil && len(output.UnprocessedKeys) > 0)
+	return output, err
+}
+
+//Sleep for the current delay before a read
+func (reads *adaptiveReads) wait() {
+	reads.mu.Lock()
+	delay := reads.delay
+	reads.mu.Unlock()
+	if delay > 0 {
+		reads.sleep(delay)
+	}
+}
+
+//Grow the delay after a throttle and shrink it after a read that wasn't
+func (reads *adaptiveReads) record(wasThrottled bool) {
+	reads.mu.Lock()
+	defer reads.mu.Unlock()
+	if !wasThrottled {
+		reads.delay /= 2
+		return
+	}
+	if reads.delay == 0 {
+		reads.delay = envDuration("DYNAMO_THROTTLE_BACKOFF", time.Millisecond*50)
+	} else {
+		reads.delay *= 2
+	}
+	if maxDelay := envDuration("DYNAMO_THROTTLE_MAX_BACKOFF", time.Second); reads.delay > maxDelay {
+		reads.delay = maxDelay
+	}
+}
+
+//Whether DynamoDB rejected the request for exceeding the table's capacity
+func throttled(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == dynamodb.ErrCodeProvisionedThroughputExceededException ||
+		aerr.Code() == dynamodb.ErrCodeRequestLimitExceeded || request.IsErrorThrottle(err)
+}
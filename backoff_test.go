@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//scriptedReads answers each read with the next of its errors, a nil error answers with an empty item
+type scriptedReads struct {
+	dynamodbiface.DynamoDBAPI
+	errs        []error
+	unprocessed bool //Whether BatchGetItem leaves keys unprocessed
+}
+
+func (db *scriptedReads) next() error {
+	err := db.errs[0]
+	db.errs = db.errs[1:]
+	return err
+}
+
+func (db *scriptedReads) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if err := db.next(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (db *scriptedReads) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	if err := db.next(); err != nil {
+		return nil, err
+	}
+	output := &dynamodb.BatchGetItemOutput{}
+	if db.unprocessed {
+		output.UnprocessedKeys = map[string]*dynamodb.KeysAndAttributes{"users": {}}
+	}
+	return output, nil
+}
+
+//Reads wrapping db whose sleeps are recorded instead of waited out
+func newRecordedReads(db dynamodbiface.DynamoDBAPI) (*adaptiveReads, *[]time.Duration) {
+	slept := new([]time.Duration)
+	reads := newAdaptiveReads(db)
+	reads.sleep = func(delay time.Duration) {
+		*slept = append(*slept, delay)
+	}
+	return reads, slept
+}
+
+func TestAdaptiveReadsBackoff(t *testing.T) {
+	throttle := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	missing := awserr.New(dynamodb.ErrCodeResourceNotFoundException, "missing", nil)
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		errs []error
+		want []time.Duration
+	}{
+		{"no throttles", []error{nil, nil, nil}, nil},
+		{"doubles to the cap", []error{throttle, throttle, throttle, throttle, nil}, []time.Duration{10 * ms, 20 * ms, 40 * ms, 40 * ms}},
+		{"halves once unthrottled", []error{throttle, throttle, nil, nil, nil}, []time.Duration{10 * ms, 20 * ms, 10 * ms, 5 * ms}},
+		{"other errors aren't throttles", []error{missing, missing, nil}, nil},
+		{"request limit", []error{awserr.New(dynamodb.ErrCodeRequestLimitExceeded, "limit", nil), nil}, []time.Duration{10 * ms}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DYNAMO_THROTTLE_BACKOFF", "10ms")
+			t.Setenv("DYNAMO_THROTTLE_MAX_BACKOFF", "40ms")
+			reads, slept := newRecordedReads(&scriptedReads{errs: test.errs})
+			for range test.errs {
+				reads.GetItem(&dynamodb.GetItemInput{})
+			}
+			if !reflect.DeepEqual(*slept, test.want) {
+				t.Errorf("slept %v, want %v", *slept, test.want)
+			}
+		})
+	}
+}
+
+//Keys a batch read leaves unprocessed were throttled, so slow the reads that follow
+func TestAdaptiveReadsUnprocessedKeys(t *testing.T) {
+	t.Setenv("DYNAMO_THROTTLE_BACKOFF", "")
+	t.Setenv("DYNAMO_THROTTLE_MAX_BACKOFF", "")
+	reads, slept := newRecordedReads(&scriptedReads{errs: []error{nil, nil}, unprocessed: true})
+	reads.BatchGetItem(&dynamodb.BatchGetItemInput{})
+	reads.BatchGetItem(&dynamodb.BatchGetItemInput{})
+	if want := []time.Duration{50 * time.Millisecond}; !reflect.DeepEqual(*slept, want) {
+		t.Errorf("slept %v, want the default backoff %v", *slept, want)
+	}
+}
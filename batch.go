@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	batchGetLimit    = 100 //Most keys BatchGetItem accepts in one call
+	batchGetAttempts = 5
+)
+
+//UserValidation json object with the result of validating one sub for admin tooling
+type UserValidation struct {
+	Sub         string `json:"sub"`
+	Found       bool   `json:"found"`
+	CompanyID   string `json:"company_id,omitempty"`
+	ServiceTier int    `json:"service_tier"`
+	Payed       bool   `json:"payed"`
+}
+
+//Look up many users with BatchGetItem rather than a GetItem each, returning a result for every requested sub.
+//Each record found is loaded as validateUser loads it, decrypted and with its company's billing
+func validateUsers(clients *awsClients, subs []string) ([]UserValidation, error) {
+	if clients.config.userKeyIncludesCompany() {
+		return nil, fmt.Errorf("%w: validating users needs a table keyed by sub", ErrInvalidRequest)
+	}
+	found := map[string]map[string]*dynamodb.AttributeValue{}
+	for start := 0; start < len(subs); start += batchGetLimit {
+		end := start + batchGetLimit
+		if end > len(subs) {
+			end = len(subs)
+		}
+		err := batchGetUsers(clients.dynamo, clients.config.DynamoTable, subs[start:end], found)
+		if err != nil {
+			return nil, err
+		}
+	}
+	validated := map[string]UserValidation{}
+	results := make([]UserValidation, 0, len(subs))
+	for _, sub := range subs {
+		result, ok := validated[sub]
+		if !ok { //Records are decrypted in place so a sub requested twice is only loaded once
+			var err error
+			result, err = validateItem(clients, sub, found[sub])
+			if err != nil {
+				return nil, err
+			}
+			validated[sub] = result
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+//The result for the sub from its record, not found when it has none
+func validateItem(clients *awsClients, sub string, item map[string]*dynamodb.AttributeValue) (UserValidation, error) {
+	if item == nil {
+		return UserValidation{Sub: sub}, nil
+	}
+	user := User{Sub: sub, config: clients.config, log: clients.log}
+	err := user.loadRecord(clients, item)
+	if err != nil {
+		return UserValidation{}, err
+	}
+	return UserValidation{
+		Sub:         sub,
+		Found:       true,
+		CompanyID:   user.CompanyID,
+		ServiceTier: user.ServiceTier,
+		Payed:       user.isPaid(time.Now()),
+	}, nil
+}
+
+//Get one batch of user records into found by sub, retrying the keys DynamoDB leaves unprocessed when throttled
+//with exponential backoff
+func batchGetUsers(svc dynamodbiface.DynamoDBAPI, table string, subs []string, found map[string]map[string]*dynamodb.AttributeValue) error {
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(subs))
+	seen := map[string]bool{}
+	for _, sub := range subs {
+		if seen[sub] { //BatchGetItem rejects duplicate keys
+			continue
+		}
+		seen[sub] = true
+		keys = append(keys, map[string]*dynamodb.AttributeValue{"sub": {S: aws.String(sub)}})
+	}
+	request := map[string]*dynamodb.KeysAndAttributes{table: {Keys: keys}}
+	backoff := time.Millisecond * 50
+	for attempt := 1; ; attempt++ {
+		result, err := svc.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: request})
+		if err != nil {
+			return fmt.Errorf("batch getting users: %w", err)
+		}
+		for _, item := range result.Responses[table] {
+			if sub := item["sub"]; sub != nil && sub.S != nil {
+				found[*sub.S] = item
+			}
+		}
+		if len(result.UnprocessedKeys) == 0 {
+			return nil
+		}
+		if attempt == batchGetAttempts {
+			return fmt.Errorf("batch getting users: %d keys still unprocessed after %d attempts", len(result.UnprocessedKeys[table].Keys), attempt)
+		}
+		request = result.UnprocessedKeys
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
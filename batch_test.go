@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//Clients reading the users table from db
+func userTableClients(db *fakeDynamo) *awsClients {
+	return &awsClients{dynamo: db, config: &Config{DynamoTable: "users"}, log: discardLog}
+}
+
+func TestValidateUsers(t *testing.T) {
+	db := newFakeDynamo()
+	db.put("users", User{Sub: "sub-1", CompanyID: "acme", ServiceTier: 1, Payed: true})
+	db.put("users", User{Sub: "sub-2", CompanyID: "globex"})
+	results, err := validateUsers(userTableClients(db), []string{"sub-1", "missing", "sub-2", "sub-1"})
+	if err != nil {
+		t.Fatalf("validateUsers() error = %v", err)
+	}
+	want := []UserValidation{
+		{Sub: "sub-1", Found: true, CompanyID: "acme", ServiceTier: 1, Payed: true},
+		{Sub: "missing"},
+		{Sub: "sub-2", Found: true, CompanyID: "globex"},
+		{Sub: "sub-1", Found: true, CompanyID: "acme", ServiceTier: 1, Payed: true},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("validateUsers() = %+v, want %+v", results, want)
+	}
+	if !reflect.DeepEqual(db.batches, []int{3}) {
+		t.Errorf("batches of %v keys, want one batch without the duplicate", db.batches)
+	}
+}
+
+//BatchGetItem takes at most 100 keys so larger requests are split
+func TestValidateUsersBatches(t *testing.T) {
+	subs := make([]string, 250)
+	for i := range subs {
+		subs[i] = fmt.Sprintf("sub-%d", i)
+	}
+	db := newFakeDynamo()
+	results, err := validateUsers(userTableClients(db), subs)
+	if err != nil || len(results) != len(subs) {
+		t.Fatalf("validateUsers() = %d results, %v, want one per sub", len(results), err)
+	}
+	if !reflect.DeepEqual(db.batches, []int{100, 100, 50}) {
+		t.Errorf("batches of %v keys, want 100, 100 and 50", db.batches)
+	}
+}
+
+//Keys left unprocessed by throttling are retried, giving up after the attempts run out
+func TestValidateUsersUnprocessedKeys(t *testing.T) {
+	db := newFakeDynamo()
+	db.put("users", User{Sub: "sub-1", CompanyID: "acme"})
+	db.unprocess = 2
+	results, err := validateUsers(userTableClients(db), []string{"sub-1"})
+	if err != nil || !results[0].Found || len(db.batches) != 3 {
+		t.Errorf("validateUsers() = %+v, %v after %d calls, want sub-1 found on the third", results, err, len(db.batches))
+	}
+	db.unprocess = batchGetAttempts
+	if _, err := validateUsers(userTableClients(db), []string{"sub-1"}); err == nil || !strings.Contains(err.Error(), "still unprocessed") {
+		t.Errorf("validateUsers() error = %v, want the keys reported unprocessed", err)
+	}
+}
+
+func TestValidateUsersCompositeKey(t *testing.T) {
+	clients := userTableClients(newFakeDynamo())
+	clients.config.PartitionKey, clients.config.SortKey = "company_id", "sub"
+	if _, err := validateUsers(clients, []string{"sub-1"}); statusCodeFor(err) != http.StatusBadRequest {
+		t.Errorf("validateUsers() error = %v, want a 400 for a table not keyed by sub", err)
+	}
+}
+
+//Only admins may look up other users
+func TestHandleRequestValidateUsers(t *testing.T) {
+	h, _ := newTestHandler(t, 1)
+	tests := []struct {
+		name       string
+		groups     string
+		wantStatus int
+	}{
+		{"admin", "admin", http.StatusOK},
+		{"not an admin", "users", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := claimsEvent("sub-1", test.groups)
+			event.HTTPMethod = "POST"
+			event.Body = `{"sub":"sub-1","operation":"validate_users","subs":["sub-1","missing"]}`
+			response := handle(t, h, event)
+			if response.StatusCode != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+			if test.wantStatus == http.StatusOK && !strings.Contains(response.Body, `"sub":"sub-1","found":true,"company_id":"acme"`) {
+				t.Errorf("body %s, want sub-1 found in acme", response.Body)
+			}
+		})
+	}
+}
+
+//Users whose company_id is encrypted, of a company on the enterprise tier in COMPANY_TABLE
+func newBatchClients(t *testing.T) *awsClients {
+	t.Helper()
+	db := newFakeDynamo()
+	for _, sub := range []string{"sub-1", "sub-2"} {
+		db.tables["users"] = append(db.tables["users"], map[string]*dynamodb.AttributeValue{
+			"sub":          {S: aws.String(sub)},
+			"company_id":   {S: aws.String(base64.StdEncoding.EncodeToString([]byte("encrypted:acme")))},
+			"service_tier": {N: aws.String("0")},
+		})
+	}
+	db.put("companies", Company{CompanyID: "acme", ServiceTier: 2, Payed: true})
+	return &awsClients{dynamo: db, kms: fakeKMS{}, log: discardLog,
+		config: &Config{DynamoTable: "users", CompanyTable: "companies", EncryptedAttributes: []string{"company_id"}}}
+}
+
+//Batch lookups load records as validateUser does, decrypting them and applying the company's billing
+func TestValidateUsersLoadsRecords(t *testing.T) {
+	clients := newBatchClients(t)
+	results, err := validateUsers(clients, []string{"sub-1", "missing", "sub-2", "sub-1"})
+	if err != nil {
+		t.Fatalf("validateUsers() error = %v", err)
+	}
+	found := UserValidation{Sub: "sub-1", Found: true, CompanyID: "acme", ServiceTier: 2, Payed: true}
+	want := []UserValidation{found, {Sub: "missing"}, found, found}
+	want[2].Sub = "sub-2"
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("validateUsers() = %+v, want %+v", results, want)
+	}
+
+	user := &User{Sub: "sub-1", Operation: operationList, config: clients.config, log: clients.log}
+	if _, err := user.validateUser(clients); err != nil {
+		t.Fatalf("validateUser() error = %v", err)
+	}
+	if user.CompanyID != found.CompanyID || user.ServiceTier != found.ServiceTier || user.Payed != found.Payed {
+		t.Errorf("validateUser() loaded %s on tier %d paid %v, want the batch result %+v", user.CompanyID,
+			user.ServiceTier, user.Payed, found)
+	}
+}
+
+func TestValidateUsersDecryptFailure(t *testing.T) {
+	clients := newBatchClients(t)
+	clients.dynamo.(*fakeDynamo).tables["users"][0]["company_id"] = &dynamodb.AttributeValue{S: aws.String("bm90IGVuY3J5cHRlZA==")}
+	if _, err := validateUsers(clients, []string{"sub-1"}); err == nil {
+		t.Error("validateUsers() error = nil, want the decrypt failure")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+//Names web servers treat as configuration, an upload could change how the bucket's files are served
+var blockedNames = []string{".htaccess", ".htpasswd", "web.config"}
+
+//Extensions of files that run when opened
+var blockedExtensions = []string{".exe", ".bat", ".cmd", ".com", ".scr", ".msi", ".ps1", ".vbs", ".jar"}
+
+//The rule the file breaks, empty when it may be uploaded.  Names and extensions are checked case insensitively
+//against the file name unless BLOCK_DEFAULT_FILENAMES is false, and BLOCKED_FILENAME_PATTERNS holds whitespace
+//separated regular expressions matched against the whole file_request
+func blockedFileRule(file string) string {
+	if envBool("BLOCK_DEFAULT_FILENAMES", true) {
+		name := strings.ToLower(path.Base(file))
+		for _, blocked := range blockedNames {
+			if name == blocked {
+				return "reserved name " + blocked
+			}
+		}
+		extension := path.Ext(name)
+		for _, blocked := range blockedExtensions {
+			if extension == blocked {
+				return "executable extension " + blocked
+			}
+		}
+	}
+	for _, pattern := range strings.Fields(setting("BLOCKED_FILENAME_PATTERNS")) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Println("Invalid pattern in BLOCKED_FILENAME_PATTERNS, skipping: " + err.Error())
+			continue
+		}
+		if re.MatchString(file) {
+			return "blocked pattern " + pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBlockedFileRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		defaults string
+		patterns string
+		want     string
+	}{
+		{"allowed", "docs/report.pdf", "", "", ""},
+		{"reserved name", "site/.htaccess", "", "", "reserved name .htaccess"},
+		{"reserved name in any case", "Web.Config", "", "", "reserved name web.config"},
+		{"executable", "setup.EXE", "", "", "executable extension .exe"},
+		{"extension only at the end", "archive.exe.txt", "", "", ""},
+		{"defaults off", "setup.exe", "false", "", ""},
+		{"pattern", "tmp/cache.bin", "", `^tmp/ \.bak$`, `blocked pattern ^tmp/`},
+		{"second pattern", "notes.bak", "", `^tmp/ \.bak$`, `blocked pattern \.bak$`},
+		{"invalid pattern skipped", "notes.bak", "", `( \.bak$`, `blocked pattern \.bak$`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BLOCK_DEFAULT_FILENAMES", test.defaults)
+			t.Setenv("BLOCKED_FILENAME_PATTERNS", test.patterns)
+			captureLog(t)
+			if got := blockedFileRule(test.file); got != test.want {
+				t.Errorf("blockedFileRule(%q) = %q, want %q", test.file, got, test.want)
+			}
+		})
+	}
+}
+
+//Blocked names can't be uploaded, but a file already stored under one can still be downloaded or deleted
+func TestValidateBlockedFile(t *testing.T) {
+	for _, operation := range []string{operationUpload, operationDownload, operationDelete} {
+		t.Run(operation, func(t *testing.T) {
+			user := newTestUser()
+			user.Operation = operation
+			user.FileRequest = "setup.exe"
+			err := user.Validate()
+			if blocked := errors.Is(err, ErrInvalidFilename); blocked != (operation == operationUpload) {
+				t.Errorf("Validate() error = %v, want blocked only for uploads", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//bucketUsage the listed size of each bucket, cached per warm container as listing a whole bucket is expensive.  A
+//failed listing is cached too so a bucket too large to list isn't listed again by every upload
+type bucketUsage struct {
+	mu        sync.Mutex
+	sizes     map[string]int64
+	errs      map[string]error
+	fetchedAt map[string]time.Time
+}
+
+var bucketSizes = newBucketUsage()
+
+func newBucketUsage() *bucketUsage {
+	return &bucketUsage{sizes: map[string]int64{}, errs: map[string]error{}, fetchedAt: map[string]time.Time{}}
+}
+
+//Refuse uploads that would take the bucket past BUCKET_CAPACITY_PERCENT (default 95) of BUCKET_CAPACITY_BYTES,
+//for capacity constrained storage such as self hosted MinIO.  This applies to every company regardless of its
+//quota, and is skipped when BUCKET_CAPACITY_BYTES is unset
+func (user *User) checkBucketCapacity(storage StorageBackend) error {
+	capacity := int64(envInt("BUCKET_CAPACITY_BYTES", 0))
+	if capacity <= 0 {
+		return nil
+	}
+	used, err := bucketSizes.get(storage, user.bucket())
+	if err != nil {
+		return err
+	}
+	limit := capacity * int64(envInt("BUCKET_CAPACITY_PERCENT", 95)) / 100
+	total, err := addSizes(used, int64(user.FileSize))
+	if err != nil {
+		return err
+	}
+	if total > limit {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrBucketFull, used, capacity)
+	}
+	return nil
+}
+
+//The bucket's listed size, or the error listing it, refreshed after BUCKET_CAPACITY_CACHE_TTL (default 5m).  The
+//whole bucket is listed so it is bounded by BUCKET_CAPACITY_MAX_LIST_PAGES rather than the per company
+//MAX_LIST_PAGES, unbounded when unset
+func (usage *bucketUsage) get(storage StorageBackend, bucket string) (int64, error) {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	if fetchedAt, ok := usage.fetchedAt[bucket]; ok && time.Since(fetchedAt) < envDuration("BUCKET_CAPACITY_CACHE_TTL", time.Minute*5) {
+		return usage.sizes[bucket], usage.errs[bucket]
+	}
+	size, err := storage.Sum(bucket, []string{""}, "bucket "+bucket, envInt("BUCKET_CAPACITY_MAX_LIST_PAGES", 0), nil)
+	usage.sizes[bucket] = size
+	usage.errs[bucket] = err
+	usage.fetchedAt[bucket] = time.Now()
+	return size, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Empty the cached bucket sizes so each test lists the bucket afresh
+func resetBucketSizes(t *testing.T) {
+	t.Helper()
+	bucketSizes = newBucketUsage()
+	t.Cleanup(func() {
+		bucketSizes = newBucketUsage()
+	})
+}
+
+func TestCheckBucketCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity string
+		percent  string
+		size     int
+		wantErr  error
+	}{
+		{"no capacity configured", "", "", 1 << 30, nil},
+		{"under the cap", "2000", "", 800, nil},
+		{"at the default 95 percent", "2000", "", 900, nil},
+		{"over the default 95 percent", "2000", "", 901, ErrBucketFull},
+		{"at a configured percent", "2000", "50", 0, nil},
+		{"over a configured percent", "2000", "50", 1, ErrBucketFull},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetBucketSizes(t)
+			t.Setenv("BUCKET_CAPACITY_BYTES", test.capacity)
+			t.Setenv("BUCKET_CAPACITY_PERCENT", test.percent)
+			captureLog(t)
+			svc := newFakeS3()
+			svc.pages = [][]*s3.Object{{s3Object("acme/file.txt", 600), s3Object("globex/file.txt", 400)}}
+			user := newTestUser()
+			user.FileSize = test.size
+			if err := user.checkBucketCapacity(newS3TestStorage(svc)); !errors.Is(err, test.wantErr) {
+				t.Errorf("checkBucketCapacity() error = %v, want %v", err, test.wantErr)
+			}
+			if test.capacity != "" && (len(svc.listed) != 1 || svc.listed[0] != "") {
+				t.Errorf("listed %q, want the whole bucket", svc.listed)
+			}
+		})
+	}
+}
+
+//The bucket is listed once per BUCKET_CAPACITY_CACHE_TTL, not once per upload
+func TestCheckBucketCapacityCached(t *testing.T) {
+	resetBucketSizes(t)
+	t.Setenv("BUCKET_CAPACITY_BYTES", "2000")
+	t.Setenv("BUCKET_CAPACITY_CACHE_TTL", "1h")
+	captureLog(t)
+	svc := newFakeS3()
+	for i := 0; i < 3; i++ {
+		if err := newTestUser().checkBucketCapacity(newS3TestStorage(svc)); err != nil {
+			t.Fatalf("checkBucketCapacity() error = %v", err)
+		}
+	}
+	if len(svc.listed) != 1 {
+		t.Errorf("bucket listed %d times, want once within the TTL", len(svc.listed))
+	}
+}
+
+//The whole bucket is listed past the per company MAX_LIST_PAGES, bounded only by BUCKET_CAPACITY_MAX_LIST_PAGES
+func TestCheckBucketCapacityPageLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPages string
+		wantErr  error
+	}{
+		{"company page limit ignored", "", ErrBucketFull},
+		{"within the capacity page limit", "2", ErrBucketFull},
+		{"past the capacity page limit", "1", ErrListingLimitExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetBucketSizes(t)
+			t.Setenv("MAX_LIST_PAGES", "1")
+			t.Setenv("BUCKET_CAPACITY_MAX_LIST_PAGES", test.maxPages)
+			t.Setenv("BUCKET_CAPACITY_BYTES", "2000")
+			t.Setenv("BUCKET_CAPACITY_PERCENT", "")
+			svc := newFakeS3()
+			svc.pages = [][]*s3.Object{{s3Object("acme/file.txt", 1000)}, {s3Object("globex/file.txt", 900)}}
+			user := newTestUser()
+			user.FileSize = 100
+			if err := user.checkBucketCapacity(newS3TestStorage(svc)); !errors.Is(err, test.wantErr) {
+				t.Errorf("checkBucketCapacity() error = %v, want %v counting both pages", err, test.wantErr)
+			}
+		})
+	}
+}
+
+//A failed listing is cached for BUCKET_CAPACITY_CACHE_TTL like a size, so a bucket too large to list isn't
+//listed again by every upload
+func TestCheckBucketCapacityFailureCached(t *testing.T) {
+	resetBucketSizes(t)
+	t.Setenv("BUCKET_CAPACITY_BYTES", "2000")
+	t.Setenv("BUCKET_CAPACITY_MAX_LIST_PAGES", "1")
+	t.Setenv("BUCKET_CAPACITY_CACHE_TTL", "1h")
+	svc := newFakeS3()
+	svc.pages = [][]*s3.Object{{s3Object("acme/file.txt", 10)}, {s3Object("globex/file.txt", 10)}}
+	for i := 0; i < 3; i++ {
+		if err := newTestUser().checkBucketCapacity(newS3TestStorage(svc)); !errors.Is(err, ErrListingLimitExceeded) {
+			t.Fatalf("checkBucketCapacity() error = %v, want %v", err, ErrListingLimitExceeded)
+		}
+	}
+	if len(svc.listed) != 1 {
+		t.Errorf("bucket listed %d times, want the failure cached within the TTL", len(svc.listed))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Digest sizes in bytes of the additional checksum algorithms S3 supports
+var checksumSizes = map[string]int{
+	s3.ChecksumAlgorithmCrc32:  4,
+	s3.ChecksumAlgorithmCrc32c: 4,
+	s3.ChecksumAlgorithmSha1:   20,
+	s3.ChecksumAlgorithmSha256: 32,
+}
+
+//Rules for the upload checksum.  S3 rejects unsigned x-amz headers so the client's base64 checksum must be
+//known up front to be signed, S3 then validates the uploaded bytes against it
+func (user *User) validateChecksum() []string {
+	if user.ChecksumAlgorithm == "" && user.Checksum == "" {
+		return nil
+	}
+	size, ok := checksumSizes[user.ChecksumAlgorithm]
+	if !ok {
+		return []string{"checksum_algorithm must be one of CRC32, CRC32C, SHA1 or SHA256"}
+	}
+	digest, err := base64.StdEncoding.DecodeString(user.Checksum)
+	if err != nil || len(digest) != size {
+		return []string{"checksum must be the base64 encoded " + user.ChecksumAlgorithm + " digest of the file"}
+	}
+	return nil
+}
+
+//Sign the checksum algorithm and the matching x-amz-checksum header into the upload
+func (user *User) applyChecksum(input *s3.PutObjectInput) {
+	if user.ChecksumAlgorithm == "" {
+		return
+	}
+	input.ChecksumAlgorithm = aws.String(user.ChecksumAlgorithm)
+	switch user.ChecksumAlgorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		input.ChecksumCRC32 = aws.String(user.Checksum)
+	case s3.ChecksumAlgorithmCrc32c:
+		input.ChecksumCRC32C = aws.String(user.Checksum)
+	case s3.ChecksumAlgorithmSha1:
+		input.ChecksumSHA1 = aws.String(user.Checksum)
+	case s3.ChecksumAlgorithmSha256:
+		input.ChecksumSHA256 = aws.String(user.Checksum)
+	}
+}
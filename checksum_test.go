@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestValidateChecksum(t *testing.T) {
+	digest := func(size int) string { return base64.StdEncoding.EncodeToString(make([]byte, size)) }
+	tests := []struct {
+		name      string
+		algorithm string
+		checksum  string
+		valid     bool
+	}{
+		{"none", "", "", true},
+		{"CRC32", "CRC32", digest(4), true},
+		{"CRC32C", "CRC32C", digest(4), true},
+		{"SHA1", "SHA1", digest(20), true},
+		{"SHA256", "SHA256", digest(32), true},
+		{"unknown algorithm", "MD5", digest(16), false},
+		{"lowercase algorithm", "sha256", digest(32), false},
+		{"checksum without algorithm", "", digest(32), false},
+		{"algorithm without checksum", "SHA256", "", false},
+		{"wrong digest size", "SHA256", digest(20), false},
+		{"not base64", "CRC32", "not base64!", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.ChecksumAlgorithm = test.algorithm
+			user.Checksum = test.checksum
+			if problems := user.validateChecksum(); (len(problems) == 0) != test.valid {
+				t.Errorf("validateChecksum() = %q, want valid %v", problems, test.valid)
+			}
+		})
+	}
+}
+
+//The checksum is signed, hoisted into the query by the SDK, so S3 rejects an upload whose bytes don't match it
+func TestChecksumSigned(t *testing.T) {
+	checksum := base64.StdEncoding.EncodeToString(make([]byte, 4))
+	tests := []struct {
+		algorithm string
+		parameter string
+	}{
+		{"CRC32", "X-Amz-Checksum-Crc32"},
+		{"CRC32C", "X-Amz-Checksum-Crc32c"},
+		{"SHA1", "X-Amz-Checksum-Sha1"},
+		{"SHA256", "X-Amz-Checksum-Sha256"},
+	}
+	for _, test := range tests {
+		t.Run(test.algorithm, func(t *testing.T) {
+			user := newTestUser()
+			user.ChecksumAlgorithm = test.algorithm
+			user.Checksum = checksum
+			signed, query := presignQuery(t, user)
+			if query.Get(test.parameter) != checksum || query.Get("X-Amz-Sdk-Checksum-Algorithm") != test.algorithm {
+				t.Errorf("URL %s, want %s=%s signed with the %s algorithm", signed.URL, test.parameter, checksum, test.algorithm)
+			}
+		})
+	}
+}
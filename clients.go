@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//awsClients the AWS services used to handle a request, behind the SDK interfaces so fakes can stand in.
+//Listing and signing use separate S3 clients so they can run with least privilege credentials: the lister only
+//needs s3:ListBucket while a presigned URL carries the presigner's s3:PutObject, s3:GetObject and s3:DeleteObject
+type awsClients struct {
+	dynamo    dynamodbiface.DynamoDBAPI
+	lister    s3iface.S3API
+	presigner s3iface.S3API
+	kms       kmsiface.KMSAPI
+	events    eventbridgeiface.EventBridgeAPI
+	cdnSigner urlSigner      //Signs downloads through CloudFront, nil when downloads are signed by S3
+	storage   StorageBackend //Where files are signed and measured
+
+	restrictedPresigner func(sourceIP string) (s3iface.S3API, *credentials.Credentials, error) //Signs URLs only usable from the address
+
+	s3Credentials *credentials.Credentials //The credentials presigned URLs are signed with
+
+	config *Config     //The configuration the clients were created with
+	log    *requestLog //Logs the request the clients serve, set by the handler
+}
+
+//Create the clients for a request.  A variable so the AWS services can be replaced with fakes
+var newAWSClients = func(config *Config) (*awsClients, error) {
+	sess, err := session.NewSession(config.awsConfig())
+	if err != nil {
+		return nil, err
+	}
+	presigner := newS3Client(sess, config.S3Endpoint, config.SigningRoleARN, signingRoleSettings)
+	clients := &awsClients{
+		dynamo:    newAdaptiveReads(dynamodb.New(sess)),
+		lister:    newS3Client(sess, config.S3Endpoint, config.ListingRoleARN, listingRoleSettings),
+		presigner: presigner,
+		kms:       kms.New(sess),
+		events:    eventbridge.New(sess),
+		cdnSigner: newCloudFrontSigner(config),
+
+		restrictedPresigner: newSourceRestrictedPresigner(sess, config.S3Endpoint, config.SigningRoleARN),
+		s3Credentials:       presigner.Config.Credentials,
+		config:              config,
+	}
+	clients.storage = newStorageBackend(clients)
+	return clients, nil
+}
+
+//Create the S3 client, using the role's credentials assumed with the options of the settings when a role is given
+func newS3Client(sess *session.Session, endpoint string, roleARN string, settings string) *s3.S3 {
+	return newS3ClientWithCredentials(sess, endpoint, assumedRoleCredentials(sess, roleARN, settings))
+}
+
+//Create the S3 client, forcing path style URLs (s3.amazonaws.com/bucket/key) when S3_FORCE_PATH_STYLE is set
+//for clients and proxies that can't handle virtual hosted style.  The endpoint, S3_ENDPOINT, points the client at
+//a custom endpoint such as MinIO.  The session's credentials are used when creds is nil
+func newS3ClientWithCredentials(sess *session.Session, endpoint string, creds *credentials.Credentials) *s3.S3 {
+	config := aws.NewConfig().WithS3ForcePathStyle(envBool("S3_FORCE_PATH_STYLE", false))
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	if creds != nil {
+		config = config.WithCredentials(creds)
+	}
+	return s3.New(sess, config)
+}
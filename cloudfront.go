@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+//urlSigner signs CloudFront URLs, satisfied by the SDK's sign.URLSigner
+type urlSigner interface {
+	Sign(url string, expires time.Time) (string, error)
+	SignWithPolicy(url string, policy *sign.Policy) (string, error)
+}
+
+//Create the CloudFront signer when CLOUDFRONT_DOMAIN is set, downloads are then served through the distribution.
+//The key pair is CLOUDFRONT_KEY_PAIR_ID with the private key LoadConfig parsed from CLOUDFRONT_PRIVATE_KEY
+func newCloudFrontSigner(config *Config) urlSigner {
+	if config.CloudFrontDomain == "" || config.CloudFrontKey == nil {
+		return nil
+	}
+	return sign.NewURLSigner(config.CloudFrontKeyPairID, config.CloudFrontKey)
+}
+
+//Sign a CloudFront URL for downloading the requested file.  The download options are passed as query parameters
+//for the distribution to forward to the S3 origin
+func (user *User) cloudFrontURL(signer urlSigner, expiry time.Duration) (*URLSign, error) {
+	domain := strings.TrimSuffix(user.config.CloudFrontDomain, "/")
+	if !strings.Contains(domain, "://") {
+		domain = "https://" + domain
+	}
+	query := url.Values{}
+	if user.DownloadFilename != "" {
+		query.Set("response-content-disposition", contentDisposition(user.DownloadFilename))
+	}
+	if user.DownloadContentType != "" {
+		query.Set("response-content-type", user.DownloadContentType)
+	}
+	if user.VersionID != "" {
+		query.Set("versionId", user.VersionID)
+	}
+	query = user.withQueryParameters(query)
+	resource := domain + (&url.URL{Path: "/" + user.objectKey()}).EscapedPath()
+	if len(query) > 0 {
+		resource += "?" + query.Encode()
+	}
+	signedAt := time.Now()
+	expires := signedAt.Add(expiry)
+	var signed string
+	var err error
+	if user.sourceIP != "" {
+		var policy *sign.Policy
+		policy, err = user.cloudFrontPolicy(resource, expires)
+		if err == nil {
+			signed, err = signer.SignWithPolicy(resource, policy)
+		}
+	} else {
+		signed, err = signer.Sign(resource, expires)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing CloudFront URL for %s: %w", user.objectKey(), err)
+	}
+	cdnSigned := &URLSign{URL: signed, Method: "GET"}
+	cdnSigned.setExpiry(signedAt, expiry)
+	return cdnSigned, nil
+}
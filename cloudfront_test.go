@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+//recordingSigner keeps what it was asked to sign and returns the resource unsigned
+type recordingSigner struct {
+	resource string
+	expires  time.Time
+	policy   *sign.Policy
+}
+
+func (signer *recordingSigner) Sign(resource string, expires time.Time) (string, error) {
+	signer.resource, signer.expires = resource, expires
+	return resource, nil
+}
+
+func (signer *recordingSigner) SignWithPolicy(resource string, policy *sign.Policy) (string, error) {
+	signer.resource, signer.policy = resource, policy
+	return resource, nil
+}
+
+func TestCloudFrontURLResource(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		change func(user *User)
+		want   string
+	}{
+		{"domain", "cdn.example.com", func(user *User) {}, "https://cdn.example.com/acme/file.txt"},
+		{"domain with scheme", "https://cdn.example.com/", func(user *User) {}, "https://cdn.example.com/acme/file.txt"},
+		{"escaped key", "cdn.example.com", func(user *User) { user.FileRequest = "my report#1.pdf" },
+			"https://cdn.example.com/acme/my%20report%231.pdf"},
+		{"download options", "cdn.example.com", func(user *User) {
+			user.DownloadFilename = "report.pdf"
+			user.DownloadContentType = "application/pdf"
+			user.VersionID = "v2"
+		}, "https://cdn.example.com/acme/file.txt?response-content-disposition=attachment%3B+filename%3Dreport.pdf" +
+			"&response-content-type=application%2Fpdf&versionId=v2"},
+		{"query parameters", "cdn.example.com", func(user *User) { user.QueryParameters = map[string]string{"x-id": "abc"} },
+			"https://cdn.example.com/acme/file.txt?x-id=abc"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.config.CloudFrontDomain = test.domain
+			user.Operation = operationDownload
+			test.change(user)
+			signer := &recordingSigner{}
+			signed, err := user.cloudFrontURL(signer, time.Hour)
+			if err != nil {
+				t.Fatalf("cloudFrontURL() error = %v", err)
+			}
+			if signer.resource != test.want || signed.URL != test.want || signed.Method != "GET" {
+				t.Errorf("signed %s %s, want GET %s", signed.Method, signer.resource, test.want)
+			}
+			if lifetime := signer.expires.Sub(time.Now()); lifetime < 59*time.Minute || lifetime > time.Hour {
+				t.Errorf("signed until %s, want an hour from now", signer.expires)
+			}
+			if signed.ExpiresAt == nil || signed.ExpiresAt.After(signer.expires) || signed.ExpiresIn != 3600 {
+				t.Errorf("reported expiry %v in %d, want no later than the signed %s in 3600", signed.ExpiresAt, signed.ExpiresIn, signer.expires)
+			}
+		})
+	}
+}
+
+//Downloads are signed through the distribution when a CloudFront signer is configured, other operations by S3
+func TestSignURLForUserCloudFront(t *testing.T) {
+	for _, operation := range []string{operationDownload, operationUpload} {
+		t.Run(operation, func(t *testing.T) {
+			clients := withS3Storage(&awsClients{presigner: newS3Client(newTestSession(), "", "", signingRoleSettings)})
+			clients.cdnSigner = &recordingSigner{}
+			user := newTestUser()
+			user.config.CloudFrontDomain = "cdn.example.com"
+			user.Operation = operation
+			signed, err := user.signURLForUser(clients)
+			if err != nil {
+				t.Fatalf("signURLForUser() error = %v", err)
+			}
+			parsed, _ := url.Parse(signed.URL)
+			if cdn := parsed.Host == "cdn.example.com"; cdn != (operation == operationDownload) {
+				t.Errorf("signed %s, want CloudFront only for downloads", signed.URL)
+			}
+		})
+	}
+}
+
+//A PEM encoded RSA private key for signing CloudFront URLs
+func testCloudFrontKey(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+//The signer uses the key LoadConfig parsed, and there is none without CLOUDFRONT_DOMAIN
+func TestNewCloudFrontSigner(t *testing.T) {
+	if signer := newCloudFrontSigner(&Config{}); signer != nil {
+		t.Errorf("newCloudFrontSigner() without a domain = %v, want none", signer)
+	}
+	setConfigEnv(t, map[string]string{
+		"PLATFORM":               "lambda",
+		"DYNAMO_TABLE":           "users",
+		"CLOUDFRONT_DOMAIN":      "cdn.example.com",
+		"CLOUDFRONT_KEY_PAIR_ID": "K2JCJMDEHXQW5F",
+		"CLOUDFRONT_PRIVATE_KEY": testCloudFrontKey(t),
+	})
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	signer := newCloudFrontSigner(config)
+	if signer == nil {
+		t.Fatal("newCloudFrontSigner() = nil, want a signer for the distribution")
+	}
+	user := newTestUser()
+	user.config = config
+	signed, err := user.cloudFrontURL(signer, time.Hour)
+	if err != nil {
+		t.Fatalf("cloudFrontURL() error = %v", err)
+	}
+	parsed, err := url.Parse(signed.URL)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", signed.URL, err)
+	}
+	query := parsed.Query()
+	if parsed.Host != "cdn.example.com" || query.Get("Key-Pair-Id") != "K2JCJMDEHXQW5F" || query.Get("Signature") == "" || query.Get("Expires") == "" {
+		t.Errorf("URL %s, want a canned policy signature for the key pair", signed.URL)
+	}
+}
+
+//Downloads restricted to the caller's address are signed with a custom policy naming it
+func TestCloudFrontURLSourceIP(t *testing.T) {
+	user := newTestUser()
+	user.config.CloudFrontDomain = "cdn.example.com"
+	user.Operation = operationDownload
+	user.sourceIP = "192.0.2.1"
+	signer := &recordingSigner{}
+	if _, err := user.cloudFrontURL(signer, time.Hour); err != nil {
+		t.Fatalf("cloudFrontURL() error = %v", err)
+	}
+	if signer.policy == nil {
+		t.Fatal("signed with a canned policy, want a custom policy restricting the address")
+	}
+	statement := signer.policy.Statements[0]
+	if statement.Resource != "https://cdn.example.com/acme/file.txt" || statement.Condition.IPAddress == nil ||
+		statement.Condition.IPAddress.SourceIP != "192.0.2.1/32" {
+		t.Errorf("policy statement %+v, want the file restricted to 192.0.2.1/32", statement)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+//Config the deployment's infrastructure settings, loaded from the environment once at startup.  Tunables such
+//as quotas and expiries are still read per request through setting so SSM changes apply to warm containers
+type Config struct {
+	Platform string //lambda or http
+	Port     string //Port the http platform listens on
+	Region   string //Region the AWS clients use, its partition (aws, aws-us-gov or aws-cn) choosing the endpoints
+
+	DynamoTable         string   //User records
+	PartitionKey        string   //Partition key attribute of DynamoTable, sub when empty
+	SortKey             string   //Optional sort key attribute of DynamoTable
+	EncryptedAttributes []string //User attributes stored as KMS ciphertext
+	CompanyTable        string   //Optional company billing records
+	MembershipTable     string   //Optional company memberships
+	UsageTable          string   //Optional used_bytes counters
+	AdminGroup          string   //Cognito group whose members may operate on any company, admin when empty
+
+	Bucket         string   //Default bucket files are stored in
+	BucketOwner    string   //Optional account ID the buckets must belong to
+	AllowedBuckets []string //Optional buckets URLs may be signed for, any bucket when empty
+	S3Endpoint     string   //Optional custom S3 endpoint such as MinIO
+	SSEKMSKeyID    string   //Optional KMS key uploads are encrypted with
+	SigningRoleARN string   //Optional role presigned URLs are signed with
+	ListingRoleARN string   //Optional role objects are listed with, the signing role when unset
+	EventBusName   string   //Optional EventBridge bus signings are published to
+
+	RestrictSourceIP bool //Whether signed URLs are only usable from the requesting client's address
+
+	CloudFrontDomain    string          //Optional distribution downloads are signed for
+	CloudFrontKeyPairID string          //Key pair ID of the CloudFront signing key
+	CloudFrontKey       *rsa.PrivateKey //The parsed CLOUDFRONT_PRIVATE_KEY, nil without CLOUDFRONT_DOMAIN
+}
+
+//An AWS account ID
+var accountID = regexp.MustCompile(`^[0-9]{12}$`)
+
+//LoadConfig read and validate the configuration from the environment, every problem is reported in the error
+func LoadConfig() (*Config, error) {
+	config := &Config{
+		Platform:        os.Getenv("PLATFORM"),
+		Port:            os.Getenv("PORT"),
+		Region:          os.Getenv("AWS_REGION"),
+		DynamoTable:     os.Getenv("DYNAMO_TABLE"),
+		PartitionKey:    os.Getenv("DYNAMO_PARTITION_KEY"),
+		SortKey:         os.Getenv("DYNAMO_SORT_KEY"),
+		CompanyTable:    os.Getenv("COMPANY_TABLE"),
+		MembershipTable: os.Getenv("MEMBERSHIP_TABLE"),
+		UsageTable:      os.Getenv("USAGE_TABLE"),
+		AdminGroup:      os.Getenv("ADMIN_GROUP"),
+		Bucket:          os.Getenv("BUCKET"),
+		BucketOwner:     os.Getenv("EXPECTED_BUCKET_OWNER"),
+		S3Endpoint:      os.Getenv("S3_ENDPOINT"),
+		SSEKMSKeyID:     os.Getenv("SSE_KMS_KEY_ID"),
+		SigningRoleARN:  os.Getenv("SIGNING_ROLE_ARN"),
+		ListingRoleARN:  os.Getenv("LISTING_ROLE_ARN"),
+		EventBusName:    os.Getenv("EVENT_BUS_NAME"),
+
+		CloudFrontDomain:    os.Getenv("CLOUDFRONT_DOMAIN"),
+		CloudFrontKeyPairID: os.Getenv("CLOUDFRONT_KEY_PAIR_ID"),
+	}
+	if config.Region == "" {
+		config.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	config.AllowedBuckets = splitList(os.Getenv("ALLOWED_BUCKETS"))
+	config.EncryptedAttributes = splitList(os.Getenv("ENCRYPTED_ATTRIBUTES"))
+	if config.Port == "" {
+		config.Port = "8080"
+	}
+	if config.Bucket == "" {
+		config.Bucket = defaultBucket
+	}
+	if config.ListingRoleARN == "" {
+		config.ListingRoleARN = config.SigningRoleARN
+	}
+	var problems []string
+	if restrict := os.Getenv("RESTRICT_SOURCE_IP"); restrict != "" {
+		var err error
+		config.RestrictSourceIP, err = strconv.ParseBool(restrict)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("RESTRICT_SOURCE_IP must be true or false, got %q", restrict))
+		}
+	}
+	switch config.Platform {
+	case "lambda", "http":
+	default:
+		problems = append(problems, fmt.Sprintf("PLATFORM must be lambda or http, got %q", config.Platform))
+	}
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT must be a port number, got %q", config.Port))
+	}
+	if config.BucketOwner != "" && !accountID.MatchString(config.BucketOwner) {
+		problems = append(problems, fmt.Sprintf("EXPECTED_BUCKET_OWNER must be a 12 digit account ID, got %q", config.BucketOwner))
+	}
+	if config.DynamoTable == "" {
+		problems = append(problems, "DYNAMO_TABLE is required")
+	}
+	if config.RestrictSourceIP && config.SigningRoleARN == "" {
+		problems = append(problems, "RESTRICT_SOURCE_IP requires SIGNING_ROLE_ARN")
+	}
+	problems = append(problems, config.userTableProblems()...)
+	problems = append(problems, config.s3Problems()...)
+	problems = append(problems, config.partitionProblems()...)
+	problems = append(problems, config.loadCloudFrontKey()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+//Check the user table's key attributes are ones a request supplies and that none of them is encrypted, the key is
+//looked up with the plaintext values
+func (config *Config) userTableProblems() []string {
+	var problems []string
+	if config.PartitionKey != "" && !userKeyAttribute(config.PartitionKey) {
+		problems = append(problems, fmt.Sprintf("DYNAMO_PARTITION_KEY must be sub or company_id, got %q", config.PartitionKey))
+	}
+	if config.SortKey != "" && !userKeyAttribute(config.SortKey) {
+		problems = append(problems, fmt.Sprintf("DYNAMO_SORT_KEY must be sub or company_id, got %q", config.SortKey))
+	}
+	attributes := config.userKeyAttributes()
+	if len(attributes) == 2 && attributes[0] == attributes[1] {
+		problems = append(problems, fmt.Sprintf("DYNAMO_SORT_KEY must differ from the partition key %s", attributes[0]))
+	}
+	for _, encrypted := range config.EncryptedAttributes {
+		for _, attribute := range attributes {
+			if encrypted == attribute {
+				problems = append(problems, fmt.Sprintf("ENCRYPTED_ATTRIBUTES can't include the key attribute %s", attribute))
+			}
+		}
+	}
+	if strings.ContainsAny(config.AdminGroup, ", []") {
+		problems = append(problems, fmt.Sprintf("ADMIN_GROUP must be a single Cognito group name, got %q", config.AdminGroup))
+	}
+	return problems
+}
+
+//An SSE-KMS key ID, alias or ARN
+var kmsKeyID = regexp.MustCompile(`^(arn:[a-z-]+:kms:[a-z0-9-]+:[0-9]{12}:(key|alias)/.+|alias/.+|[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}|mrk-[0-9a-f]{32})$`)
+
+//Check the custom endpoint is a URL and the encryption key is one S3 accepts.  Whether an http endpoint may be
+//signed for is left to requireHTTPS, ALLOW_INSECURE_ENDPOINT is read per request
+func (config *Config) s3Problems() []string {
+	var problems []string
+	if config.S3Endpoint != "" {
+		parsed, err := url.Parse(config.S3Endpoint)
+		if err != nil || parsed.Host == "" || parsed.Scheme != "https" && parsed.Scheme != "http" {
+			problems = append(problems, fmt.Sprintf("S3_ENDPOINT must be an http:// or https:// URL, got %q", config.S3Endpoint))
+		}
+	}
+	if config.SSEKMSKeyID != "" && !kmsKeyID.MatchString(config.SSEKMSKeyID) {
+		problems = append(problems, fmt.Sprintf("SSE_KMS_KEY_ID must be a KMS key ID, alias or ARN, got %q", config.SSEKMSKeyID))
+	}
+	return problems
+}
+
+//Split a comma separated list, dropping blank entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+//Check the region belongs to a known partition and the roles are in the same partition, a GovCloud or China
+//deployment can't assume a role from the commercial partition and the endpoints would silently be wrong
+func (config *Config) partitionProblems() []string {
+	if config.Region == "" {
+		return nil
+	}
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), config.Region)
+	if !ok {
+		return []string{fmt.Sprintf("AWS_REGION %q is not in a known partition", config.Region)}
+	}
+	var problems []string
+	roles := []struct{ name, arn string }{
+		{"SIGNING_ROLE_ARN", config.SigningRoleARN},
+		{"LISTING_ROLE_ARN", config.ListingRoleARN},
+	}
+	for _, role := range roles {
+		if role.arn == "" {
+			continue
+		}
+		parsed, err := arn.Parse(role.arn)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be an ARN, got %q", role.name, role.arn))
+			continue
+		}
+		if parsed.Partition != partition.ID() {
+			problems = append(problems, fmt.Sprintf("%s is in the %s partition but AWS_REGION %s is in %s",
+				role.name, parsed.Partition, config.Region, partition.ID()))
+		}
+	}
+	return problems
+}
+
+//Parse the CloudFront signing key when CLOUDFRONT_DOMAIN is set, so a malformed key fails at startup rather than
+//every download
+func (config *Config) loadCloudFrontKey() []string {
+	if config.CloudFrontDomain == "" {
+		return nil
+	}
+	var problems []string
+	key, err := sign.LoadPEMPrivKey(strings.NewReader(os.Getenv("CLOUDFRONT_PRIVATE_KEY")))
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("CLOUDFRONT_PRIVATE_KEY must be a PEM encoded RSA private key: %v", err))
+	}
+	config.CloudFrontKey = key
+	if config.CloudFrontKeyPairID == "" {
+		problems = append(problems, "CLOUDFRONT_KEY_PAIR_ID is required with CLOUDFRONT_DOMAIN")
+	}
+	return problems
+}
+
+//The AWS config sessions are created with, pinning the configured region so every client resolves its endpoints
+//in the region's partition, s3.us-gov-west-1.amazonaws.com or s3.cn-north-1.amazonaws.com.cn for example
+func (config *Config) awsConfig() *aws.Config {
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig = awsConfig.WithRegion(config.Region)
+	}
+	return awsConfig
+}
+
+//Whether URLs may be signed for the bucket, every bucket is allowed when ALLOWED_BUCKETS is unset
+func (config *Config) bucketAllowed(bucket string) bool {
+	if len(config.AllowedBuckets) == 0 {
+		return true
+	}
+	for _, allowed := range config.AllowedBuckets {
+		if allowed == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+//The account ID S3 checks owns the bucket when EXPECTED_BUCKET_OWNER is set, rejecting the request with a 403 if
+//the bucket has changed hands.  Presigned URLs sign the x-amz-expected-bucket-owner header so clients must send it
+func (config *Config) expectedBucketOwner() *string {
+	if config.BucketOwner != "" {
+		return aws.String(config.BucketOwner)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//The environment variables LoadConfig reads
+var configVariables = []string{
+	"PLATFORM", "PORT", "AWS_REGION", "AWS_DEFAULT_REGION", "DYNAMO_TABLE", "DYNAMO_PARTITION_KEY", "DYNAMO_SORT_KEY",
+	"ENCRYPTED_ATTRIBUTES", "COMPANY_TABLE", "MEMBERSHIP_TABLE", "USAGE_TABLE", "ADMIN_GROUP", "BUCKET", "EXPECTED_BUCKET_OWNER",
+	"ALLOWED_BUCKETS", "S3_ENDPOINT", "SSE_KMS_KEY_ID", "SIGNING_ROLE_ARN", "LISTING_ROLE_ARN", "EVENT_BUS_NAME",
+	"RESTRICT_SOURCE_IP", "CLOUDFRONT_DOMAIN", "CLOUDFRONT_KEY_PAIR_ID", "CLOUDFRONT_PRIVATE_KEY",
+}
+
+//Set the configuration environment to env, clearing every other variable LoadConfig reads
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range configVariables {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestLoadConfigComplete(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"PLATFORM":              "http",
+		"PORT":                  "9000",
+		"AWS_REGION":            "us-gov-west-1",
+		"DYNAMO_TABLE":          "users",
+		"DYNAMO_PARTITION_KEY":  "company_id",
+		"DYNAMO_SORT_KEY":       "sub",
+		"ENCRYPTED_ATTRIBUTES":  "email, name",
+		"COMPANY_TABLE":         "companies",
+		"MEMBERSHIP_TABLE":      "memberships",
+		"USAGE_TABLE":           "usage",
+		"ADMIN_GROUP":           "superusers",
+		"BUCKET":                "files",
+		"EXPECTED_BUCKET_OWNER": "123456789012",
+		"ALLOWED_BUCKETS":       " files, archive ,,",
+		"S3_ENDPOINT":           "https://minio.example.com",
+		"SSE_KMS_KEY_ID":        "alias/uploads",
+		"SIGNING_ROLE_ARN":      "arn:aws-us-gov:iam::123456789012:role/signer",
+		"LISTING_ROLE_ARN":      "arn:aws-us-gov:iam::123456789012:role/lister",
+		"EVENT_BUS_NAME":        "uploads",
+		"RESTRICT_SOURCE_IP":    "true",
+	})
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := &Config{
+		Platform:            "http",
+		Port:                "9000",
+		Region:              "us-gov-west-1",
+		DynamoTable:         "users",
+		PartitionKey:        "company_id",
+		SortKey:             "sub",
+		EncryptedAttributes: []string{"email", "name"},
+		CompanyTable:        "companies",
+		MembershipTable:     "memberships",
+		UsageTable:          "usage",
+		AdminGroup:          "superusers",
+		Bucket:              "files",
+		BucketOwner:         "123456789012",
+		AllowedBuckets:      []string{"files", "archive"},
+		S3Endpoint:          "https://minio.example.com",
+		SSEKMSKeyID:         "alias/uploads",
+		SigningRoleARN:      "arn:aws-us-gov:iam::123456789012:role/signer",
+		ListingRoleARN:      "arn:aws-us-gov:iam::123456789012:role/lister",
+		EventBusName:        "uploads",
+		RestrictSourceIP:    true,
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("LoadConfig() = %+v, want %+v", config, want)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"PLATFORM":           "lambda",
+		"AWS_DEFAULT_REGION": "eu-west-1",
+		"DYNAMO_TABLE":       "users",
+		"SIGNING_ROLE_ARN":   "arn:aws:iam::123456789012:role/signer",
+	})
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Port != "8080" {
+		t.Errorf("Port = %q, want 8080", config.Port)
+	}
+	if config.Bucket != defaultBucket {
+		t.Errorf("Bucket = %q, want %q", config.Bucket, defaultBucket)
+	}
+	if config.Region != "eu-west-1" {
+		t.Errorf("Region = %q, want the AWS_DEFAULT_REGION eu-west-1", config.Region)
+	}
+	if config.AllowedBuckets != nil {
+		t.Errorf("AllowedBuckets = %v, want none", config.AllowedBuckets)
+	}
+	if config.ListingRoleARN != config.SigningRoleARN {
+		t.Errorf("ListingRoleARN = %q, want the signing role %q", config.ListingRoleARN, config.SigningRoleARN)
+	}
+}
+
+func TestLoadConfigProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "missing environment",
+			env:  map[string]string{},
+			want: []string{`PLATFORM must be lambda or http, got ""`, "DYNAMO_TABLE is required"},
+		},
+		{
+			name: "unknown platform",
+			env:  map[string]string{"PLATFORM": "k8s", "DYNAMO_TABLE": "users"},
+			want: []string{`PLATFORM must be lambda or http, got "k8s"`},
+		},
+		{
+			name: "port out of range",
+			env:  map[string]string{"PLATFORM": "http", "PORT": "70000", "DYNAMO_TABLE": "users"},
+			want: []string{`PORT must be a port number, got "70000"`},
+		},
+		{
+			name: "bucket owner not an account ID",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "EXPECTED_BUCKET_OWNER": "acme"},
+			want: []string{`EXPECTED_BUCKET_OWNER must be a 12 digit account ID, got "acme"`},
+		},
+		{
+			name: "unknown region",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "AWS_REGION": "mars-east-1"},
+			want: []string{`AWS_REGION "mars-east-1" is not in a known partition`},
+		},
+		{
+			name: "role in another partition",
+			env: map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "AWS_REGION": "cn-north-1",
+				"SIGNING_ROLE_ARN": "arn:aws:iam::123456789012:role/signer"},
+			want: []string{
+				"SIGNING_ROLE_ARN is in the aws partition but AWS_REGION cn-north-1 is in aws-cn",
+				"LISTING_ROLE_ARN is in the aws partition but AWS_REGION cn-north-1 is in aws-cn",
+			},
+		},
+		{
+			name: "role not an ARN",
+			env: map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "AWS_REGION": "us-east-1",
+				"SIGNING_ROLE_ARN": "arn:aws:iam::123456789012:role/signer", "LISTING_ROLE_ARN": "lister"},
+			want: []string{`LISTING_ROLE_ARN must be an ARN, got "lister"`},
+		},
+		{
+			name: "malformed CloudFront key",
+			env: map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "CLOUDFRONT_DOMAIN": "cdn.example.com",
+				"CLOUDFRONT_KEY_PAIR_ID": "K2JCJMDEHXQW5F", "CLOUDFRONT_PRIVATE_KEY": "not a key"},
+			want: []string{"CLOUDFRONT_PRIVATE_KEY must be a PEM encoded RSA private key"},
+		},
+		{
+			name: "CloudFront without a key",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "CLOUDFRONT_DOMAIN": "cdn.example.com"},
+			want: []string{"CLOUDFRONT_PRIVATE_KEY must be a PEM encoded RSA private key", "CLOUDFRONT_KEY_PAIR_ID is required with CLOUDFRONT_DOMAIN"},
+		},
+		{
+			name: "user key attributes a request can't supply",
+			env: map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "DYNAMO_PARTITION_KEY": "email",
+				"DYNAMO_SORT_KEY": "created"},
+			want: []string{`DYNAMO_PARTITION_KEY must be sub or company_id, got "email"`, `DYNAMO_SORT_KEY must be sub or company_id, got "created"`},
+		},
+		{
+			name: "sort key repeating the partition key",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "DYNAMO_SORT_KEY": "sub"},
+			want: []string{"DYNAMO_SORT_KEY must differ from the partition key sub"},
+		},
+		{
+			name: "encrypted key attribute",
+			env: map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "DYNAMO_PARTITION_KEY": "company_id",
+				"DYNAMO_SORT_KEY": "sub", "ENCRYPTED_ATTRIBUTES": "email,company_id"},
+			want: []string{"ENCRYPTED_ATTRIBUTES can't include the key attribute company_id"},
+		},
+		{
+			name: "admin group list",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "ADMIN_GROUP": "admin,superusers"},
+			want: []string{`ADMIN_GROUP must be a single Cognito group name, got "admin,superusers"`},
+		},
+		{
+			name: "endpoint not a URL",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "S3_ENDPOINT": "minio.example.com:9000"},
+			want: []string{`S3_ENDPOINT must be an http:// or https:// URL, got "minio.example.com:9000"`},
+		},
+		{
+			name: "KMS key not an ID",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "SSE_KMS_KEY_ID": "uploads"},
+			want: []string{`SSE_KMS_KEY_ID must be a KMS key ID, alias or ARN, got "uploads"`},
+		},
+		{
+			name: "source IP restriction not a bool",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "RESTRICT_SOURCE_IP": "yes"},
+			want: []string{`RESTRICT_SOURCE_IP must be true or false, got "yes"`},
+		},
+		{
+			name: "source IP restriction without a signing role",
+			env:  map[string]string{"PLATFORM": "lambda", "DYNAMO_TABLE": "users", "RESTRICT_SOURCE_IP": "true"},
+			want: []string{"RESTRICT_SOURCE_IP requires SIGNING_ROLE_ARN"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setConfigEnv(t, test.env)
+			config, err := LoadConfig()
+			if err == nil {
+				t.Fatalf("LoadConfig() = %+v, want an error", config)
+			}
+			for _, problem := range test.want {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("LoadConfig() error = %q, want it to report %q", err, problem)
+				}
+			}
+			if problems := strings.Count(err.Error(), "; ") + 1; problems != len(test.want) {
+				t.Errorf("LoadConfig() reported %d problems, want %d: %v", problems, len(test.want), err)
+			}
+		})
+	}
+}
+
+func TestExpectedBucketOwner(t *testing.T) {
+	if owner := (&Config{}).expectedBucketOwner(); owner != nil {
+		t.Errorf("expectedBucketOwner() = %q, want nil without EXPECTED_BUCKET_OWNER", aws.StringValue(owner))
+	}
+	owner := (&Config{BucketOwner: "123456789012"}).expectedBucketOwner()
+	if aws.StringValue(owner) != "123456789012" {
+		t.Errorf("expectedBucketOwner() = %q, want 123456789012", aws.StringValue(owner))
+	}
+}
+
+func TestAWSConfigRegion(t *testing.T) {
+	if region := (&Config{}).awsConfig().Region; region != nil {
+		t.Errorf("awsConfig().Region = %q, want the SDK default", aws.StringValue(region))
+	}
+	if region := (&Config{Region: "cn-north-1"}).awsConfig().Region; aws.StringValue(region) != "cn-north-1" {
+		t.Errorf("awsConfig().Region = %q, want cn-north-1", aws.StringValue(region))
+	}
+}
+
+//URLs signed in GovCloud and China target the partition's endpoints with the region in the credential scope
+func TestPresignPartitionEndpoints(t *testing.T) {
+	tests := []struct {
+		region   string
+		wantHost string
+	}{
+		{"us-east-1", "bucket.s3.amazonaws.com"},
+		{"us-gov-west-1", "bucket.s3.us-gov-west-1.amazonaws.com"},
+		{"cn-north-1", "bucket.s3.cn-north-1.amazonaws.com.cn"},
+	}
+	for _, test := range tests {
+		t.Run(test.region, func(t *testing.T) {
+			t.Setenv("S3_FORCE_PATH_STYLE", "")
+			config := (&Config{Region: test.region}).awsConfig().
+				WithCredentials(credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", ""))
+			presigner := newS3Client(session.Must(session.NewSession(config)), "", "", signingRoleSettings)
+			signed, err := newTestUser().signURLForUser(withS3Storage(&awsClients{presigner: presigner}))
+			if err != nil {
+				t.Fatalf("signURLForUser() error = %v", err)
+			}
+			parsed, err := url.Parse(signed.URL)
+			if err != nil {
+				t.Fatalf("parsing %s: %v", signed.URL, err)
+			}
+			if parsed.Host != test.wantHost {
+				t.Errorf("URL %s, want host %s", signed.URL, test.wantHost)
+			}
+			if scope := parsed.Query().Get("X-Amz-Credential"); !strings.Contains(scope, "/"+test.region+"/s3/") {
+				t.Errorf("credential scope %q, want region %s", scope, test.region)
+			}
+		})
+	}
+}
+
+//URLs are signed for the configured S3_ENDPOINT, path style when S3_FORCE_PATH_STYLE is set
+func TestPresignCustomEndpoint(t *testing.T) {
+	tests := []struct {
+		pathStyle string
+		want      string
+	}{
+		{"", "https://bucket.minio.example.com/acme/file.txt?"},
+		{"true", "https://minio.example.com/bucket/acme/file.txt?"},
+	}
+	for _, test := range tests {
+		t.Run("path style "+test.pathStyle, func(t *testing.T) {
+			t.Setenv("S3_FORCE_PATH_STYLE", test.pathStyle)
+			user := newTestUser()
+			user.config.S3Endpoint = "https://minio.example.com"
+			signed, _ := presignQuery(t, user)
+			if !strings.HasPrefix(signed.URL, test.want) {
+				t.Errorf("signed %s, want %s", signed.URL, test.want)
+			}
+		})
+	}
+}
+
+func TestBucketAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		bucket  string
+		want    bool
+	}{
+		{"no allowlist", nil, "anything", true},
+		{"listed", []string{"files", "archive"}, "archive", true},
+		{"not listed", []string{"files", "archive"}, "other", false},
+		{"prefix of a listed bucket", []string{"files"}, "file", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{AllowedBuckets: test.allowed}
+			if got := config.bucketAllowed(test.bucket); got != test.want {
+				t.Errorf("bucketAllowed(%q) = %v, want %v", test.bucket, got, test.want)
+			}
+		})
+	}
+}
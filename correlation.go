@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const correlationHeader = "X-Request-ID"
+
+//The correlation ID for the request, taken from the X-Request-ID header or generated when absent
+func correlationID(event events.APIGatewayProxyRequest) string {
+	for name, value := range event.Headers {
+		if strings.EqualFold(name, correlationHeader) && value != "" {
+			return value
+		}
+	}
+	return newUUID()
+}
+
+//Generate a random version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
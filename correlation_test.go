@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestCorrelationID(t *testing.T) {
+	event := events.APIGatewayProxyRequest{Headers: map[string]string{"x-request-id": "abc-123"}}
+	if got := correlationID(event); got != "abc-123" {
+		t.Errorf("correlationID() = %q, want the header matched case insensitively", got)
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := correlationID(events.APIGatewayProxyRequest{}), correlationID(events.APIGatewayProxyRequest{})
+	if !uuid.MatchString(first) || first == second {
+		t.Errorf("generated %q and %q, want distinct version 4 UUIDs", first, second)
+	}
+}
+
+//The caller's ID is echoed in the response and prefixes the request's log lines
+func TestHandleRequestCorrelation(t *testing.T) {
+	h, _ := newTestHandler(t, 1)
+	buf := captureLog(t)
+	response, err := h.HandleRequest(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    map[string]string{"X-Request-ID": "abc-123"},
+		Body:       `{"sub":"missing","file_request":"f","file_size":1}`,
+	})
+	if err != nil {
+		t.Fatalf("HandleRequest() error = %v", err)
+	}
+	if response.Headers[correlationHeader] != "abc-123" {
+		t.Errorf("X-Request-ID = %q, want abc-123", response.Headers[correlationHeader])
+	}
+	logged := strings.TrimSpace(buf.String())
+	if logged == "" {
+		t.Fatal("nothing logged for the failed request")
+	}
+	for _, line := range strings.Split(logged, "\n") {
+		if !strings.HasPrefix(line, "[abc-123] ") {
+			t.Errorf("line %q logged without the correlation ID", line)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+//The largest request body accepted, MAX_BODY_BYTES or 64KB
+func maxBodyBytes() int {
+	return envInt("MAX_BODY_BYTES", 64*1024)
+}
+
+//Decode the request body, rejecting bodies larger than MAX_BODY_BYTES (default 64KB) or nested deeper than
+//MAX_BODY_DEPTH (default 5) before parsing, and fields the request doesn't have
+func decodeBody(body string, out interface{}) error {
+	maxBytes := maxBodyBytes()
+	if len(body) > maxBytes {
+		return fmt.Errorf("%w: body is larger than %d bytes", ErrInvalidRequest, maxBytes)
+	}
+	maxDepth := envInt("MAX_BODY_DEPTH", 5)
+	if jsonDepth(body) > maxDepth {
+		return fmt.Errorf("%w: body is nested deeper than %d levels", ErrInvalidRequest, maxDepth)
+	}
+	err := checkJSONObject(body)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(io.LimitReader(strings.NewReader(body), int64(maxBytes)))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(out)
+	if err != nil {
+		if field, ok := unknownField(err); ok {
+			return fmt.Errorf("%w: body doesn't match the request schema: %s", ErrInvalidRequest, unknownFieldMessage(field, out))
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%w: body doesn't match the request schema: %s must be %s, got %s",
+				ErrInvalidRequest, typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return fmt.Errorf("%w: body doesn't match the request schema: %v", ErrInvalidRequest, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: body must be a single JSON object", ErrInvalidRequest)
+	}
+	return nil
+}
+
+//Check the body is a JSON object before decoding it, telling a body that isn't JSON at all, as from a
+//misconfigured integration passing form data or a JSON string, apart from one that doesn't match the schema
+func checkJSONObject(body string) error {
+	trimmed := strings.TrimSpace(body)
+	if trimmed == "" {
+		return fmt.Errorf("%w: body is empty, expected a JSON object", ErrInvalidRequest)
+	}
+	if !json.Valid([]byte(trimmed)) {
+		return fmt.Errorf("%w: body is not valid JSON", ErrInvalidRequest)
+	}
+	switch trimmed[0] {
+	case '{':
+		return nil
+	case '"':
+		return fmt.Errorf("%w: body is a JSON string, expected a JSON object, is it encoded twice?", ErrInvalidRequest)
+	case '[':
+		return fmt.Errorf("%w: body is a JSON array, expected a JSON object", ErrInvalidRequest)
+	default:
+		return fmt.Errorf("%w: body is a JSON %s, expected a JSON object", ErrInvalidRequest, jsonKind(trimmed))
+	}
+}
+
+//The kind of a JSON scalar
+func jsonKind(value string) string {
+	switch value {
+	case "null":
+		return "null"
+	case "true", "false":
+		return "boolean"
+	default:
+		return "number"
+	}
+}
+
+//The deepest nesting of objects and arrays in a JSON document, without parsing it
+func jsonDepth(body string) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, r := range body {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && r == '\\':
+			escaped = true
+		case r == '"':
+			inString = !inString
+		case inString:
+		case r == '{' || r == '[':
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case r == '}' || r == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+//The field named by the decoder's unknown field error, which has no error type of its own
+func unknownField(err error) (string, bool) {
+	const prefix = "json: unknown field "
+	if !strings.HasPrefix(err.Error(), prefix) {
+		return "", false
+	}
+	return strings.Trim(strings.TrimPrefix(err.Error(), prefix), `"`), true
+}
+
+//Describe an unknown field, suggesting the known field it is likely a typo of such as filesize for file_size
+func unknownFieldMessage(field string, out interface{}) string {
+	message := fmt.Sprintf("unknown field %q", field)
+	normalize := func(name string) string {
+		return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+	}
+	t := reflect.TypeOf(out).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" && normalize(name) == normalize(field) {
+			return message + fmt.Sprintf(", did you mean %q?", name)
+		}
+	}
+	return message
+}
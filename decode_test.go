@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	t.Setenv("MAX_BODY_BYTES", "64")
+	t.Setenv("MAX_BODY_DEPTH", "2")
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"valid", `{"sub":"sub-1","file_size":10}`, ""},
+		{"at the size limit", `{"sub":"` + strings.Repeat("a", 64-len(`{"sub":""}`)) + `"}`, ""},
+		{"oversized", `{"sub":"` + strings.Repeat("a", 64) + `"}`, "larger than 64 bytes"},
+		{"too deep", `{"tags":{"a":{"b":"c"}}}`, "nested deeper than 2 levels"},
+		{"unknown field", `{"sub":"sub-1","filesize":10}`, `doesn't match the request schema: unknown field "filesize", did you mean "file_size"?`},
+		{"unknown field without a match", `{"sub":"sub-1","colour":"red"}`, `unknown field "colour"`},
+		{"wrong type", `{"file_size":"10"}`, "doesn't match the request schema: file_size must be int"},
+		{"trailing data", `{"sub":"sub-1"}{"sub":"sub-2"}`, "not valid JSON"},
+		{"empty", ` `, "body is empty"},
+		{"not JSON", `sub=sub-1`, "not valid JSON"},
+		{"truncated", `{"sub":"sub-1"`, "not valid JSON"},
+		{"string", `"{}"`, "encoded twice"},
+		{"array", `[{}]`, "JSON array"},
+		{"number", `10`, "JSON number"},
+		{"null", `null`, "JSON null"},
+		{"boolean", `true`, "JSON boolean"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var user User
+			err := decodeBody(test.body, &user)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("decodeBody() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("decodeBody() error = %v, want an invalid request reporting %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONDepth(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{``, 0},
+		{`{}`, 1},
+		{`{"a":[1,{"b":2}]}`, 3},
+		{`{"a":"{[{[{"}`, 1},
+		{`{"a":"\"{{"}`, 1},
+		{`[[]][[[]]]`, 3},
+	}
+	for _, test := range tests {
+		if got := jsonDepth(test.body); got != test.want {
+			t.Errorf("jsonDepth(%s) = %d, want %d", test.body, got, test.want)
+		}
+	}
+}
+
+//A misspelled field is rejected rather than silently ignored
+func TestHandleRequestUnknownField(t *testing.T) {
+	h, _ := newTestHandler(t, 1)
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","filesize":100}`)
+	if body := errorOf(t, response); response.StatusCode != http.StatusBadRequest || !strings.Contains(body.Message, `unknown field "filesize", did you mean "file_size"?`) {
+		t.Errorf("response %d %s, want a 400 suggesting file_size", response.StatusCode, response.Body)
+	}
+}
+
+func TestUnknownFieldMessage(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"filesize", `unknown field "filesize", did you mean "file_size"?`},
+		{"FileRequest", `unknown field "FileRequest", did you mean "file_request"?`},
+		{"content-type", `unknown field "content-type", did you mean "content_type"?`},
+		{"colour", `unknown field "colour"`},
+	}
+	for _, test := range tests {
+		if got := unknownFieldMessage(test.field, &User{}); got != test.want {
+			t.Errorf("unknownFieldMessage(%q) = %s, want %s", test.field, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+//Decrypt the attributes of an item stored as KMS ciphertext, ENCRYPTED_ATTRIBUTES, in place so they unmarshal as
+//plain strings.  Ciphertext may be stored as a binary attribute or a base64 encoded string
+func decryptItem(svc kmsiface.KMSAPI, item map[string]*dynamodb.AttributeValue, attributes []string) error {
+	for _, name := range attributes {
+		value, ok := item[name]
+		if !ok {
+			continue
+		}
+		ciphertext := value.B
+		if ciphertext == nil && value.S != nil {
+			decoded, err := base64.StdEncoding.DecodeString(*value.S)
+			if err != nil {
+				return fmt.Errorf("decoding encrypted attribute %s: %w", name, err)
+			}
+			ciphertext = decoded
+		}
+		if ciphertext == nil {
+			return fmt.Errorf("encrypted attribute %s is not binary or a string", name)
+		}
+		result, err := svc.Decrypt(&kms.DecryptInput{CiphertextBlob: ciphertext})
+		if err != nil {
+			return fmt.Errorf("decrypting attribute %s: %w", name, err)
+		}
+		item[name] = &dynamodb.AttributeValue{S: aws.String(string(result.Plaintext))}
+	}
+	return nil
+}
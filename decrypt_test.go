@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDecryptItem(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("encrypted:acme"))
+	tests := []struct {
+		name       string
+		attributes []string
+		value      *dynamodb.AttributeValue
+		want       string
+		wantErr    string
+	}{
+		{"not configured", nil, &dynamodb.AttributeValue{S: aws.String("acme")}, "acme", ""},
+		{"binary", []string{"company_id"}, &dynamodb.AttributeValue{B: []byte("encrypted:acme")}, "acme", ""},
+		{"base64 string", []string{"company_id"}, &dynamodb.AttributeValue{S: aws.String(encoded)}, "acme", ""},
+		{"not base64", []string{"company_id"}, &dynamodb.AttributeValue{S: aws.String("acme!")}, "", "decoding encrypted attribute company_id"},
+		{"not a string", []string{"company_id"}, &dynamodb.AttributeValue{N: aws.String("1")}, "", "is not binary or a string"},
+		{"not ciphertext", []string{"company_id"}, &dynamodb.AttributeValue{B: []byte("acme")}, "", "decrypting attribute company_id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := map[string]*dynamodb.AttributeValue{"sub": {S: aws.String("sub-1")}, "company_id": test.value}
+			err := decryptItem(fakeKMS{}, item, test.attributes)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("decryptItem() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decryptItem() error = %v", err)
+			}
+			if got := aws.StringValue(item["company_id"].S); got != test.want {
+				t.Errorf("company_id = %q, want %q", got, test.want)
+			}
+			if aws.StringValue(item["sub"].S) != "sub-1" {
+				t.Errorf("sub = %v, want it left as stored", item["sub"])
+			}
+		})
+	}
+}
+
+//Configured attributes missing from the item are skipped rather than failing the lookup
+func TestDecryptItemMissingAttribute(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{"company_id": {B: []byte("encrypted:acme")}}
+	if err := decryptItem(fakeKMS{}, item, []string{"email", "company_id"}); err != nil || aws.StringValue(item["company_id"].S) != "acme" {
+		t.Errorf("decryptItem() = %v, %v, want company_id decrypted", item, err)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Sign SSE-KMS encryption with the SSE_KMS_KEY_ID key into the upload, the bucket's default encryption applies
+//when unset.  SSE_BUCKET_KEY_ENABLED has S3 use a bucket key for the object, cutting the KMS requests made
+func applyEncryption(input *s3.PutObjectInput, keyID string) {
+	if keyID == "" {
+		return
+	}
+	input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+	input.SSEKMSKeyId = aws.String(keyID)
+	if envBool("SSE_BUCKET_KEY_ENABLED", false) {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestUploadEncryptionSigned(t *testing.T) {
+	tests := []struct {
+		name          string
+		keyID         string
+		bucketKey     string
+		wantSSE       string
+		wantBucketKey string
+	}{
+		{"bucket default encryption", "", "true", "", ""},
+		{"SSE-KMS", "alias/uploads", "", "aws:kms", ""},
+		{"SSE-KMS with a bucket key", "alias/uploads", "true", "aws:kms", "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SSE_BUCKET_KEY_ENABLED", test.bucketKey)
+			user := newTestUser()
+			user.config.SSEKMSKeyID = test.keyID
+			signed, query := presignQuery(t, user)
+			headers := signed.RequiredHeaders
+			if headers["x-amz-server-side-encryption"] != test.wantSSE ||
+				headers["x-amz-server-side-encryption-aws-kms-key-id"] != test.keyID {
+				t.Errorf("required headers %v, want encryption %q with key %q", headers, test.wantSSE, test.keyID)
+			}
+			//Not a header S3 requires signed, so the SDK hoists it into the signed query
+			if got := query.Get("X-Amz-Server-Side-Encryption-Bucket-Key-Enabled"); got != test.wantBucketKey {
+				t.Errorf("bucket key query parameter = %q, want %q", got, test.wantBucketKey)
+			}
+		})
+	}
+}
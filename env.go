@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+//Read an integer from the environment or SSM, returning the default when unset or invalid
+func envInt(name string, def int) int {
+	value := setting(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Println("Invalid value for " + name + ", using default: " + err.Error())
+		return def
+	}
+	return i
+}
+
+//Read a boolean from the environment or SSM, returning the default when unset or invalid
+func envBool(name string, def bool) bool {
+	value := setting(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Println("Invalid value for " + name + ", using default: " + err.Error())
+		return def
+	}
+	return b
+}
+
+//Read a duration such as "72h" from the environment or SSM, returning the default when unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	value := setting(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println("Invalid value for " + name + ", using default: " + err.Error())
+		return def
+	}
+	return d
+}
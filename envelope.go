@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+//Header clients request a response format version with, it is echoed on every response
+const versionHeader = "X-Response-Version"
+
+const latestResponseVersion = 2
+
+//Envelope json object wrapping every version 2 response, new top level fields are added here rather than to
+//the bodies version 1 clients parse
+type Envelope struct {
+	V     int             `json:"v"`
+	Data  json.RawMessage `json:"data,omitempty"`  //The version 1 body of a successful response
+	Error json.RawMessage `json:"error,omitempty"` //The version 1 error body of a failed response
+}
+
+//The response version the client asked for in the X-Response-Version header, version 1 when absent
+func responseVersion(event events.APIGatewayProxyRequest) (int, error) {
+	for name, value := range event.Headers {
+		if !strings.EqualFold(name, versionHeader) || value == "" {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(value), "v"))
+		if err != nil || version < 1 || version > latestResponseVersion {
+			return 1, fmt.Errorf("%w: %s must be between 1 and %d", ErrInvalidRequest, versionHeader, latestResponseVersion)
+		}
+		return version, nil
+	}
+	return 1, nil
+}
+
+//Shape the response for the version.  Version 1 bodies are returned as they are, version 2 bodies are wrapped in
+//an Envelope.  Bodies that aren't JSON, such as an empty redirect, are left alone
+func versionResponse(response events.APIGatewayProxyResponse, version int) events.APIGatewayProxyResponse {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers[versionHeader] = strconv.Itoa(version)
+	if version < 2 || !json.Valid([]byte(response.Body)) {
+		return response
+	}
+	envelope := Envelope{V: version}
+	if response.StatusCode >= http.StatusBadRequest {
+		envelope.Error = json.RawMessage(response.Body)
+	} else {
+		envelope.Data = json.RawMessage(response.Body)
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return response
+	}
+	response.Body = string(data)
+	return response
+}
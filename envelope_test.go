@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestResponseVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"no header", nil, 1, false},
+		{"empty header", map[string]string{"X-Response-Version": ""}, 1, false},
+		{"version 1", map[string]string{"X-Response-Version": "1"}, 1, false},
+		{"version 2 any case", map[string]string{"x-response-version": "V2"}, 2, false},
+		{"unknown version", map[string]string{"X-Response-Version": "3"}, 1, true},
+		{"not a version", map[string]string{"X-Response-Version": "latest"}, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := responseVersion(events.APIGatewayProxyRequest{Headers: test.headers})
+			if version != test.want || test.wantErr != errors.Is(err, ErrInvalidRequest) {
+				t.Errorf("responseVersion() = %d, %v, want %d with an error %v", version, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleRequestResponseVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     string
+		body        string
+		wantStatus  int
+		wantVersion string
+		wantField   string //The top level field of the body
+	}{
+		{"version 1 success", "", `{"sub":"sub-1","file_request":"file.txt","file_size":100}`, http.StatusOK, "1", "url"},
+		{"version 1 error", "1", `{"file_request":"file.txt"}`, http.StatusBadRequest, "1", "code"},
+		{"version 2 success", "2", `{"sub":"sub-1","file_request":"file.txt","file_size":100}`, http.StatusOK, "2", "data"},
+		{"version 2 error", "2", `{"file_request":"file.txt"}`, http.StatusBadRequest, "2", "error"},
+		{"unknown version", "9", `{"sub":"sub-1","file_request":"file.txt","file_size":100}`, http.StatusBadRequest, "1", "code"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, 1)
+			response, err := h.HandleRequest(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod: http.MethodPost,
+				Headers:    map[string]string{versionHeader: test.version},
+				Body:       test.body,
+			})
+			if err != nil {
+				t.Fatalf("HandleRequest() error = %v", err)
+			}
+			if response.StatusCode != test.wantStatus || response.Headers[versionHeader] != test.wantVersion {
+				t.Errorf("response %d version %q, want %d version %s: %s", response.StatusCode,
+					response.Headers[versionHeader], test.wantStatus, test.wantVersion, response.Body)
+			}
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+				t.Fatalf("body %s is not JSON: %v", response.Body, err)
+			}
+			if _, ok := body[test.wantField]; !ok {
+				t.Errorf("body %s, want a %s field", response.Body, test.wantField)
+			}
+			if v, ok := body["v"]; ok != (test.wantVersion == "2") || (ok && string(v) != "2") {
+				t.Errorf("body %s, want v only on version 2", response.Body)
+			}
+		})
+	}
+}
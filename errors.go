@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+var (
+	//ErrUserNotFound no user record exists for the requested sub
+	ErrUserNotFound = errors.New("User not found")
+	//ErrQuotaExceeded the upload would take the company over its service tier limit
+	ErrQuotaExceeded = errors.New("Maximum amount of stored data exceeded")
+	//ErrNotPaid the user or company is not paid up
+	ErrNotPaid = errors.New("Account is not paid")
+	//ErrFileTooLarge the declared file size is larger than any service tier allows
+	ErrFileTooLarge = errors.New("File is larger than any service tier allows")
+	//ErrListingLimitExceeded calculating the stored data needed more than MAX_LIST_PAGES pages
+	ErrListingLimitExceeded = errors.New("Too many objects to calculate stored data")
+	//ErrForbidden the caller is not allowed to make the request
+	ErrForbidden = errors.New("Forbidden")
+	//ErrInsecureEndpoint the signed URL is not HTTPS
+	ErrInsecureEndpoint = errors.New("Refusing to sign a URL for a non HTTPS endpoint")
+	//ErrBucketNotAllowed the resolved bucket isn't in ALLOWED_BUCKETS, a misconfiguration rather than a bad request
+	ErrBucketNotAllowed = errors.New("Refusing to sign for a bucket that isn't allowed")
+	//ErrMalformedRecord a DynamoDB record could not be read into its struct
+	ErrMalformedRecord = errors.New("Malformed record")
+	//ErrBucketFull the bucket is at its configured capacity
+	ErrBucketFull = errors.New("Storage is full")
+	//ErrReadOnly READ_ONLY is set for maintenance so files can't be changed
+	ErrReadOnly = errors.New("Read only for maintenance")
+	//ErrRateLimited the container has signed more URLs than MAX_SIGNS_PER_WINDOW allows
+	ErrRateLimited = errors.New("Too many signed URLs, try again later")
+	//ErrInvalidRequest the request body failed validation
+	ErrInvalidRequest = errors.New("Invalid request")
+	//ErrInvalidFilename the requested file name escapes the company prefix or is blocked
+	ErrInvalidFilename = errors.New("Invalid file name")
+)
+
+//Machine readable error codes returned with every error so clients can branch without parsing the message.
+//These are part of the API and must not change
+const (
+	codeInvalidRequest      = "INVALID_REQUEST"
+	codeInvalidFilename     = "INVALID_FILENAME"
+	codeUserNotFound        = "USER_NOT_FOUND"
+	codeUnpaid              = "UNPAID"
+	codeQuotaExceeded       = "QUOTA_EXCEEDED"
+	codeForbidden           = "FORBIDDEN"
+	codeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	codeFileTooLarge        = "FILE_TOO_LARGE"
+	codeRateLimited         = "RATE_LIMITED"
+	codeBucketFull          = "BUCKET_FULL"
+	codeListingLimitReached = "LISTING_LIMIT_EXCEEDED"
+	codeReadOnly            = "READ_ONLY"
+	codeInternal            = "INTERNAL_ERROR"
+)
+
+//ErrorBody json object returned with an error status
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//Map an error to the status code returned to the client, AWS and other unexpected failures are a 500
+func statusCodeFor(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrInvalidFilename):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotPaid):
+		return http.StatusPaymentRequired
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrBucketFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrListingLimitExceeded), errors.Is(err, ErrReadOnly):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+//Map an error to the code returned to the client
+func errorCodeFor(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidFilename):
+		return codeInvalidFilename
+	case errors.Is(err, ErrInvalidRequest):
+		return codeInvalidRequest
+	case errors.Is(err, ErrUserNotFound):
+		return codeUserNotFound
+	case errors.Is(err, ErrNotPaid):
+		return codeUnpaid
+	case errors.Is(err, ErrQuotaExceeded):
+		return codeQuotaExceeded
+	case errors.Is(err, ErrForbidden):
+		return codeForbidden
+	case errors.Is(err, ErrFileTooLarge):
+		return codeFileTooLarge
+	case errors.Is(err, ErrRateLimited):
+		return codeRateLimited
+	case errors.Is(err, ErrBucketFull):
+		return codeBucketFull
+	case errors.Is(err, ErrListingLimitExceeded):
+		return codeListingLimitReached
+	case errors.Is(err, ErrReadOnly):
+		return codeReadOnly
+	default:
+		return codeInternal
+	}
+}
+
+//The JSON error body for the code and message
+func errorBody(code, message string) string {
+	data, err := json.Marshal(ErrorBody{Code: code, Message: message})
+	if err != nil {
+		return message
+	}
+	return string(data)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestStatusCodeFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrInvalidRequest, http.StatusBadRequest},
+		{ErrInvalidFilename, http.StatusBadRequest},
+		{ErrUserNotFound, http.StatusNotFound},
+		{ErrNotPaid, http.StatusPaymentRequired},
+		{ErrQuotaExceeded, http.StatusForbidden},
+		{ErrForbidden, http.StatusForbidden},
+		{ErrFileTooLarge, http.StatusRequestEntityTooLarge},
+		{ErrRateLimited, http.StatusTooManyRequests},
+		{ErrBucketFull, http.StatusInsufficientStorage},
+		{ErrBucketNotAllowed, http.StatusInternalServerError},
+		{ErrReadOnly, http.StatusServiceUnavailable},
+		{ErrListingLimitExceeded, http.StatusServiceUnavailable},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			wrapped := fmt.Errorf("handling request: %w", fmt.Errorf("%w: detail", test.err))
+			if got := statusCodeFor(wrapped); got != test.want {
+				t.Errorf("statusCodeFor(%q) = %d, want %d", wrapped, got, test.want)
+			}
+		})
+	}
+}
+
+//AWS failures are wrapped with context but stay internal errors, they aren't the client's fault
+func TestStatusCodeForAWSError(t *testing.T) {
+	err := fmt.Errorf("getting user sub-1: %w", awserr.New("AccessDeniedException", "denied", nil))
+	if got := statusCodeFor(err); got != http.StatusInternalServerError {
+		t.Errorf("statusCodeFor(%q) = %d, want 500", err, got)
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != "AccessDeniedException" {
+		t.Errorf("wrapped error %q lost the AWS error", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+//Choose the company's oldest files to delete so needed bytes are freed, for tiers with EvictOldest.  The whole plan
+//is made before anything is deleted so an upload that can't be made to fit within MAX_EVICTIONS (default 100) files
+//deletes nothing and is rejected as over quota.  Only files under the company prefix are candidates, never the
+//additional prefixes which may be shared, and never the file being uploaded
+func (user *User) planEvictions(storage StorageBackend, needed int64) ([]StoredObject, error) {
+	objects, err := listObjects(storage, user.bucket(), user.companyPrefix())
+	if err != nil {
+		return nil, err
+	}
+	evict, ok := planEviction(objects, needed, envInt("MAX_EVICTIONS", 100), user.objectKey())
+	if !ok {
+		return nil, ErrQuotaExceeded
+	}
+	return evict, nil
+}
+
+//Delete the files planned for eviction, only once every other check of the upload has passed and its usage is
+//reserved, immediately before the URL is signed.  Every deletion is logged and counted
+func (user *User) evict(storage StorageBackend, evict []StoredObject) error {
+	for _, object := range evict {
+		err := storage.Delete(user.bucket(), object.Key)
+		if err != nil {
+			return fmt.Errorf("evicting %s for %s: %w", object.Key, user.CompanyID, err)
+		}
+		user.log.Printf("EVICTED %s (%d bytes, last modified %s) for %s in company %s\n", object.Key,
+			object.Size, object.LastModified, user.Sub, user.CompanyID)
+		emitMetric("FilesEvicted", 1)
+	}
+	return nil
+}
+
+//Choose the oldest objects by LastModified whose sizes add up to at least needed, skipping the key and taking at
+//most max objects.  Folder markers free nothing so are never chosen.  Reports false when they can't free enough
+func planEviction(objects []StoredObject, needed int64, max int, skip string) ([]StoredObject, bool) {
+	candidates := make([]StoredObject, 0, len(objects))
+	for _, object := range objects {
+		if object.Key != skip && !object.isFolderMarker() {
+			candidates = append(candidates, object)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LastModified.Before(candidates[j].LastModified)
+	})
+	var freed int64
+	for i, object := range candidates {
+		if freed >= needed {
+			return candidates[:i], true
+		}
+		if i >= max {
+			return nil, false
+		}
+		freed += object.Size
+	}
+	if freed >= needed {
+		return candidates, true
+	}
+	return nil, false
+}
+
+//Every object in the bucket under the prefix with its size and last modified time, bounded by MAX_LIST_PAGES.
+//All of them are needed to find the oldest so unlike the quota sum they are buffered
+func listObjects(storage StorageBackend, bucket string, prefix string) ([]StoredObject, error) {
+	var objects []StoredObject
+	err := storage.Each(bucket, []string{prefix}, maxListPages(), func(object StoredObject) bool {
+		objects = append(objects, object)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//An S3 listing entry last modified at the time
+func datedObject(key string, size int64, modified time.Time) *s3.Object {
+	return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+}
+
+func TestPlanEviction(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	objects := []StoredObject{
+		{Key: "acme/c", Size: 30, LastModified: base.Add(3 * time.Hour)},
+		{Key: "acme/a", Size: 10, LastModified: base.Add(1 * time.Hour)},
+		{Key: "acme/folder/", Size: 0, LastModified: base},
+		{Key: "acme/b", Size: 20, LastModified: base.Add(2 * time.Hour)},
+	}
+	tests := []struct {
+		name   string
+		needed int64
+		max    int
+		skip   string
+		want   []string
+		wantOK bool
+	}{
+		{"nothing needed", 0, 100, "", []string{}, true},
+		{"oldest first", 10, 100, "", []string{"acme/a"}, true},
+		{"until enough is freed", 25, 100, "", []string{"acme/a", "acme/b"}, true},
+		{"everything", 60, 100, "", []string{"acme/a", "acme/b", "acme/c"}, true},
+		{"skips the upload's key", 25, 100, "acme/a", []string{"acme/b", "acme/c"}, true},
+		{"more than stored", 61, 100, "", nil, false},
+		{"more than max files", 25, 1, "", nil, false},
+		{"exactly max files", 25, 2, "", []string{"acme/a", "acme/b"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evict, ok := planEviction(objects, test.needed, test.max, test.skip)
+			if ok != test.wantOK {
+				t.Fatalf("planEviction() ok = %v, want %v", ok, test.wantOK)
+			}
+			var keys []string
+			if evict != nil {
+				keys = []string{}
+			}
+			for _, object := range evict {
+				keys = append(keys, object.Key)
+			}
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Errorf("planEviction() = %v, want %v", keys, test.want)
+			}
+		})
+	}
+}
+
+//A pro tier user of the acme company whose 40GB quota is filled by two old files, with eviction enabled
+func newEvictionUser(t *testing.T) (*User, *memStorage, *fakeDynamo) {
+	t.Helper()
+	t.Setenv("TIER_1_EVICT_OLDEST", "true")
+	storage := newMemStorage()
+	storage.put("bucket", "acme/old", 20000000000, time.Now().Add(-48*time.Hour))
+	storage.put("bucket", "acme/older", 20000000000, time.Now().Add(-72*time.Hour))
+	db := newUserTable(1, true)
+	user := newUsageUser("file.txt", 100)
+	return user, storage, db
+}
+
+//Nothing is evicted while the upload is checked, only once its usage is reserved immediately before signing
+func TestEvictionWaitsForReservation(t *testing.T) {
+	user, storage, db := newEvictionUser(t)
+	clients := &awsClients{dynamo: db, storage: storage}
+	if _, err := user.validateUser(clients); err != nil {
+		t.Fatalf("validateUser() error = %v", err)
+	}
+	if len(storage.deleted) > 0 {
+		t.Fatalf("evicted %v while validating, want nothing until reserved", storage.deleted)
+	}
+	reserved, err := user.reserveUpload(clients)
+	if err != nil {
+		t.Fatalf("reserveUpload() error = %v", err)
+	}
+	if reserved == nil {
+		t.Fatal("reserveUpload() = nil, want a reservation")
+	}
+	if want := []string{"acme/older"}; !reflect.DeepEqual(storage.deleted, want) {
+		t.Errorf("evicted %v, want %v", storage.deleted, want)
+	}
+	if want := []string{"acme/old"}; !reflect.DeepEqual(storage.keys("bucket"), want) {
+		t.Errorf("stored %v, want %v", storage.keys("bucket"), want)
+	}
+}
+
+//An upload rejected when reserving, here because another upload was reserved in the meantime, evicts nothing
+func TestEvictionSkippedWhenReservationFails(t *testing.T) {
+	user, storage, db := newEvictionUser(t)
+	clients := &awsClients{dynamo: db, storage: storage}
+	if _, err := user.validateUser(clients); err != nil {
+		t.Fatalf("validateUser() error = %v", err)
+	}
+	now := time.Now()
+	db.put("usage", usageRecord{CompanyID: "acme", Version: 1, Pending: map[string]pendingUpload{
+		"acme/other": {Token: "other", Size: 20000000000, SignedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+	}})
+	_, err := user.reserveUpload(clients)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("reserveUpload() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if len(storage.deleted) > 0 {
+		t.Errorf("evicted %v for a rejected upload", storage.deleted)
+	}
+}
+
+//An upload that can't be made to fit is rejected without deleting anything
+func TestEvictionInsufficient(t *testing.T) {
+	user, storage, db := newEvictionUser(t)
+	t.Setenv("MAX_EVICTIONS", "0")
+	_, err := user.validateUser(&awsClients{dynamo: db, storage: storage})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("validateUser() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if len(storage.deleted) > 0 {
+		t.Errorf("evicted %v for a rejected upload", storage.deleted)
+	}
+}
+
+//A pro tier upload into a 40GB quota filled by two old files is signed once the oldest is evicted
+func TestHandleRequestEvictOldest(t *testing.T) {
+	t.Setenv("TRACK_OVERWRITES", "")
+	t.Setenv("TIER_1_EVICT_OLDEST", "true")
+	tests := []struct {
+		name         string
+		maxEvictions string
+		wantStatus   int
+		wantDeleted  []string
+	}{
+		{"evicts the oldest", "", http.StatusOK, []string{"acme/older"}},
+		{"not enough evictions allowed", "0", http.StatusForbidden, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_EVICTIONS", test.maxEvictions)
+			h, clients := newTestHandler(t, 1)
+			svc := clients.presigner.(*fakeS3)
+			svc.pages = [][]*s3.Object{{
+				datedObject("acme/old", 20000000000, time.Now().Add(-48*time.Hour)),
+				datedObject("acme/older", 20000000000, time.Now().Add(-72*time.Hour)),
+			}}
+			response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+			if !reflect.DeepEqual(svc.deleted, test.wantDeleted) {
+				t.Errorf("evicted %v, want %v", svc.deleted, test.wantDeleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+//SigV4 presigned URLs can't be valid for longer than 7 days
+const maxPresignExpiry = time.Hour * 24 * 7
+
+//How long the signed URL for the request is valid, the smallest of the configured expiry, the 7 day maximum and the
+//signing credentials' remaining lifetime.  A presigned URL stops working when the credentials that signed it
+//expire, so the expiry is capped at the credential expiry to keep the lifetime accurate
+func (user *User) presignExpiry(creds *credentials.Credentials) time.Duration {
+	expiry := clampExpiry(user.log, user.urlExpiry())
+	remaining, ok := credentialLifetime(creds)
+	if ok && remaining < expiry {
+		user.log.Printf("WARNING: signing credentials expire in %s, capping URL expiry of %s\n", remaining, expiry)
+		return remaining
+	}
+	return expiry
+}
+
+//Report when the URL signed at signedAt stops working.  Signatures carry whole seconds so the signing time is
+//truncated, never reporting the URL as valid for longer than it is
+func (signed *URLSign) setExpiry(signedAt time.Time, expiry time.Duration) {
+	expiresAt := signedAt.Truncate(time.Second).Add(expiry).UTC()
+	signed.ExpiresAt = &expiresAt
+	signed.ExpiresIn = int(expiry / time.Second)
+}
+
+//When the presigned URL was signed, from its X-Amz-Date.  PresignRequest signs a copy of the request so the
+//request's LastSignedAt is never set.  Falls back to now for a URL without a date
+func presignedAt(signed string) time.Time {
+	parsed, err := url.Parse(signed)
+	if err == nil {
+		signedAt, err := time.Parse("20060102T150405Z", parsed.Query().Get("X-Amz-Date"))
+		if err == nil {
+			return signedAt
+		}
+	}
+	return time.Now()
+}
+
+//How long signed URLs for the user are valid before clamping.  A url_expiry_seconds negotiated on the company or
+//user record overrides the tier's expiry
+func (user *User) urlExpiry() time.Duration {
+	if user.URLExpirySeconds > 0 {
+		return time.Duration(user.URLExpirySeconds) * time.Second
+	}
+	return tierFor(user.ServiceTier).urlExpiry()
+}
+
+//How long until the credentials expire, false when they don't expire or the provider doesn't report it
+func credentialLifetime(creds *credentials.Credentials) (time.Duration, bool) {
+	if creds == nil {
+		return 0, false
+	}
+	_, err := creds.Get() //Expiry is only known once the credentials are retrieved
+	if err != nil {
+		return 0, false
+	}
+	expiresAt, err := creds.ExpiresAt()
+	if err != nil || expiresAt.IsZero() {
+		return 0, false
+	}
+	return time.Until(expiresAt), true
+}
+
+//Clamp a configured expiry to the SigV4 maximum, a longer one would fail to presign.  The clamping is warned of in
+//the request's log
+func clampExpiry(logger *requestLog, expiry time.Duration) time.Duration {
+	if expiry > maxPresignExpiry {
+		logger.Printf("WARNING: configured URL expiry of %s exceeds the %s maximum, clamping\n", expiry, maxPresignExpiry)
+		return maxPresignExpiry
+	}
+	return expiry
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestSetExpiry(t *testing.T) {
+	signed := &URLSign{}
+	signed.setExpiry(time.Date(2024, 5, 1, 12, 0, 0, 900, time.FixedZone("CEST", 2*60*60)), time.Minute*90)
+	want := time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC)
+	if !signed.ExpiresAt.Equal(want) || signed.ExpiresAt.Location() != time.UTC || signed.ExpiresIn != 5400 {
+		t.Errorf("expires at %s in %d, want %s in 5400", signed.ExpiresAt, signed.ExpiresIn, want)
+	}
+}
+
+//A signed URL reports when it stops working, from when it was signed
+func TestPresignS3ExpiresAt(t *testing.T) {
+	t.Setenv("URL_EXPIRY", "1h")
+	user := newTestUser()
+	user.ServiceTier = 1
+	before := time.Now().Truncate(time.Second)
+	signed, _ := presignQuery(t, user)
+	after := time.Now()
+	if signed.ExpiresAt == nil || signed.ExpiresAt.Before(before.Add(time.Hour)) || signed.ExpiresAt.After(after.Add(time.Hour)) {
+		t.Errorf("ExpiresAt = %v, want an hour after signing between %s and %s", signed.ExpiresAt, before, after)
+	}
+	if signed.ExpiresIn != 3600 {
+		t.Errorf("ExpiresIn = %d, want 3600", signed.ExpiresIn)
+	}
+}
+
+func TestPresignedAt(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if got := presignedAt("https://bucket.s3.amazonaws.com/key?X-Amz-Date=20240501T120000Z"); !got.Equal(want) {
+		t.Errorf("presignedAt() = %s, want %s", got, want)
+	}
+	if got := presignedAt("https://bucket.s3.amazonaws.com/key"); time.Since(got) > time.Minute {
+		t.Errorf("presignedAt() = %s, want now for a URL without a date", got)
+	}
+}
+
+//expiringProvider credentials expiring at a fixed time
+type expiringProvider struct {
+	credentials.Expiry
+}
+
+func (provider *expiringProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, nil
+}
+
+//Clamping is warned of in the request's log so the warning carries the correlation ID
+func TestClampExpiry(t *testing.T) {
+	tests := []struct {
+		expiry, want time.Duration
+		wantWarning  bool
+	}{
+		{time.Hour, time.Hour, false},
+		{maxPresignExpiry, maxPresignExpiry, false},
+		{maxPresignExpiry + time.Second, maxPresignExpiry, true},
+	}
+	for _, test := range tests {
+		buf := &syncBuffer{}
+		if got := clampExpiry(testLog(buf, "req-1", true), test.expiry); got != test.want {
+			t.Errorf("clampExpiry(%s) = %s, want %s", test.expiry, got, test.want)
+		}
+		if warned := strings.Contains(buf.String(), "[req-1] WARNING:"); warned != test.wantWarning {
+			t.Errorf("clampExpiry(%s) logged %q, want a warning in the request's log %v", test.expiry, buf, test.wantWarning)
+		}
+	}
+}
+
+//A URL never outlives the credentials that signed it, the configured expiry or the 7 day maximum, whichever
+//comes first
+func TestPresignExpiryCappedByCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		urlExpiry   string
+		credentials time.Duration //Remaining lifetime of the signing credentials, 0 when they don't expire
+		want        time.Duration
+	}{
+		{"configured expiry", "6h", 0, time.Hour * 6},
+		{"configured expiry before the credentials", "6h", time.Hour * 12, time.Hour * 6},
+		{"credentials before the configured expiry", "6h", time.Hour, time.Hour},
+		{"maximum", "720h", 0, maxPresignExpiry},
+		{"maximum before the credentials", "720h", maxPresignExpiry * 2, maxPresignExpiry},
+		{"credentials before the maximum", "720h", time.Hour, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			captureLog(t)
+			t.Setenv("URL_EXPIRY", test.urlExpiry)
+			creds := credentials.NewStaticCredentials("AKID", "secret", "")
+			if test.credentials > 0 {
+				provider := &expiringProvider{}
+				provider.SetExpiration(time.Now().Add(test.credentials), 0)
+				creds = credentials.NewCredentials(provider)
+			}
+			user := newTestUser()
+			user.ServiceTier = 1 //Uses URL_EXPIRY
+			if got := user.presignExpiry(creds); got > test.want || got < test.want-time.Minute {
+				t.Errorf("presignExpiry() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+//Without signing credentials to inspect the tier's expiry is used as is
+func TestPresignExpiryWithoutCredentials(t *testing.T) {
+	t.Setenv("URL_EXPIRY", "6h")
+	user := newTestUser()
+	user.ServiceTier = 1
+	if got := user.presignExpiry(nil); got != time.Hour*6 {
+		t.Errorf("presignExpiry(nil) = %s, want 6h", got)
+	}
+}
+
+//A negotiated url_expiry_seconds overrides URL_EXPIRY in the signed URL, clamped to the 7 day maximum
+func TestPresignS3NegotiatedExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		seconds int
+		want    string
+	}{
+		{"global default", 0, "3600"},
+		{"negotiated", 600, "600"},
+		{"past the maximum", 30 * 24 * 60 * 60, "604800"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("URL_EXPIRY", "1h")
+			captureLog(t)
+			user := newTestUser()
+			user.ServiceTier = 1
+			user.URLExpirySeconds = test.seconds
+			signed, query := presignQuery(t, user)
+			if got := query.Get("X-Amz-Expires"); got != test.want {
+				t.Errorf("URL %s expires in %s seconds, want %s", signed.URL, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//A request log discarding everything, every line is still formatted as though sampled
+var discardLog = &requestLog{Logger: log.New(io.Discard, "", 0), sampled: true}
+
+//A valid upload request from sub-1 in the acme company
+func newTestUser() *User {
+	return &User{
+		Sub:         "sub-1",
+		CompanyID:   "acme",
+		FileRequest: "file.txt",
+		FileSize:    100,
+		config:      &Config{Bucket: "bucket", DynamoTable: "users"},
+		log:         discardLog,
+	}
+}
+
+//A session with static credentials in us-east-1, presigning with it makes no network calls
+func newTestSession() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", ""),
+	}))
+}
+
+//The clients with files stored in S3 through them, as newAWSClients creates them
+func withS3Storage(clients *awsClients) *awsClients {
+	if clients.config == nil {
+		clients.config = &Config{}
+	}
+	if clients.log == nil {
+		clients.log = discardLog
+	}
+	clients.storage = &s3Storage{clients: clients}
+	return clients
+}
+
+//Presign the user's request with a real S3 client, returning the signed URL and its query
+func presignQuery(t *testing.T, user *User) (*URLSign, url.Values) {
+	t.Helper()
+	signed, err := user.signURLForUser(withS3Storage(&awsClients{presigner: newS3Client(newTestSession(), user.config.S3Endpoint, "", signingRoleSettings)}))
+	if err != nil {
+		t.Fatalf("signURLForUser() error = %v", err)
+	}
+	parsed, err := url.Parse(signed.URL)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", signed.URL, err)
+	}
+	return signed, parsed.Query()
+}
+
+//Have the handler use the clients for the rest of the test instead of AWS
+func stubAWSClients(t *testing.T, clients *awsClients) {
+	t.Helper()
+	previous := newAWSClients
+	newAWSClients = func(config *Config) (*awsClients, error) {
+		clients.config = config
+		return clients, nil
+	}
+	t.Cleanup(func() { newAWSClients = previous })
+}
+
+//memStorage an in memory StorageBackend for tests, keyed by bucket and key
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string]StoredObject
+	deleted []string //Keys deleted, in order
+	eachErr error    //Returned by Each and Sum when set
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string]StoredObject{}}
+}
+
+//Store an object of size at the key, last modified at the time
+func (storage *memStorage) put(bucket string, key string, size int64, modified time.Time) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.objects[bucket+"/"+key] = StoredObject{Key: key, Size: size, LastModified: modified, ETag: "etag-" + key}
+}
+
+//The keys stored in the bucket, sorted
+func (storage *memStorage) keys(bucket string) []string {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	var keys []string
+	for name, object := range storage.objects {
+		if strings.HasPrefix(name, bucket+"/") {
+			keys = append(keys, object.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (storage *memStorage) Presign(user *User) (*URLSign, error) {
+	method := http.MethodPut
+	switch user.operation() {
+	case operationDownload:
+		method = http.MethodGet
+	case operationHead:
+		method = http.MethodHead
+	case operationDelete:
+		method = http.MethodDelete
+	}
+	signed := url.URL{Scheme: "https", Host: "storage.test", Path: "/" + user.bucket() + "/" + user.objectKey()}
+	return &URLSign{URL: signed.String(), Method: method}, nil
+}
+
+func (storage *memStorage) List(user *User) (*FileList, error) {
+	list := &FileList{Files: []FileInfo{}}
+	err := storage.Each(user.bucket(), []string{user.objectKey()}, 0, func(object StoredObject) bool {
+		list.Files = append(list.Files, FileInfo{
+			Name:         strings.TrimPrefix(object.Key, user.companyPrefix()),
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+		return true
+	})
+	return list, err
+}
+
+func (storage *memStorage) Sum(bucket string, prefixes []string, owner string, maxPages int, fn func(StoredObject)) (int64, error) {
+	var total int64
+	err := storage.Each(bucket, prefixes, maxPages, func(object StoredObject) bool {
+		if !object.isFolderMarker() {
+			total += object.Size
+		}
+		if fn != nil {
+			fn(object)
+		}
+		return true
+	})
+	return total, err
+}
+
+func (storage *memStorage) Each(bucket string, prefixes []string, maxPages int, fn func(object StoredObject) bool) error {
+	if storage.eachErr != nil {
+		return storage.eachErr
+	}
+	for _, prefix := range prefixes {
+		for _, key := range storage.keys(bucket) {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			storage.mu.Lock()
+			object := storage.objects[bucket+"/"+key]
+			storage.mu.Unlock()
+			if !fn(object) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (storage *memStorage) Head(bucket string, key string) (*StoredObject, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	object, ok := storage.objects[bucket+"/"+key]
+	if !ok {
+		return nil, nil
+	}
+	return &object, nil
+}
+
+func (storage *memStorage) Delete(bucket string, key string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	delete(storage.objects, bucket+"/"+key)
+	storage.deleted = append(storage.deleted, key)
+	return nil
+}
+
+func (storage *memStorage) Copy(bucket string, from string, to string) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	object, ok := storage.objects[bucket+"/"+from]
+	if !ok {
+		return false, nil
+	}
+	object.Key = to
+	storage.objects[bucket+"/"+to] = object
+	return true, nil
+}
+
+//fakeS3 answers the S3 calls the handler makes directly.  Requests that are only presigned go to a real client
+//from newTestSession, which never sends them
+type fakeS3 struct {
+	s3iface.S3API
+	mu sync.Mutex
+
+	pages   [][]*s3.Object //Returned by every ListObjectsV2Pages call, filtered to the listed prefix
+	listErr error
+	listed  []string //Prefixes listed, in order
+	grouped bool     //Set when any listing used a delimiter, hiding objects in sub folders
+
+	head    *s3.HeadObjectOutput
+	headErr error
+
+	deleted []string
+
+	copies  []*s3.CopyObjectInput
+	copyErr error
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{S3API: newS3Client(newTestSession(), "", "", signingRoleSettings)}
+}
+
+func (svc *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	svc.mu.Lock()
+	svc.listed = append(svc.listed, aws.StringValue(input.Prefix))
+	svc.grouped = svc.grouped || input.Delimiter != nil
+	svc.mu.Unlock()
+	if svc.listErr != nil {
+		return svc.listErr
+	}
+	for i, page := range svc.pages {
+		var contents []*s3.Object
+		for _, object := range page {
+			if strings.HasPrefix(aws.StringValue(object.Key), aws.StringValue(input.Prefix)) {
+				contents = append(contents, object)
+			}
+		}
+		if !fn(&s3.ListObjectsV2Output{Contents: contents}, i == len(svc.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (svc *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return svc.head, svc.headErr
+}
+
+func (svc *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.deleted = append(svc.deleted, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (svc *fakeS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.copies = append(svc.copies, input)
+	if svc.copyErr != nil {
+		return nil, svc.copyErr
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+//An S3 error response with the code
+func s3Error(code string) error {
+	return awserr.New(code, code, nil)
+}
+
+//An S3 listing entry
+func s3Object(key string, size int64) *s3.Object {
+	return &s3.Object{Key: aws.String(key), Size: aws.Int64(size)}
+}
+
+//fakeDynamo holds items per table, any call it doesn't implement panics
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	mu     sync.Mutex
+	tables map[string][]map[string]*dynamodb.AttributeValue
+	getErr error //Returned by GetItem when set
+	gets   int   //GetItem calls
+
+	batches   []int //Keys requested by each BatchGetItem call
+	unprocess int   //BatchGetItem calls that leave every key unprocessed before answering
+
+	putErr error //Returned by PutItem when set
+	puts   int   //PutItem calls, including those rejected by their condition
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{tables: map[string][]map[string]*dynamodb.AttributeValue{}}
+}
+
+//Store the record, marshaled with its json tags, in the table
+func (db *fakeDynamo) put(table string, record interface{}) {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		panic(err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tables[table] = append(db.tables[table], item)
+}
+
+//The index of the item in the table whose attributes match the key, -1 when there is none
+func (db *fakeDynamo) find(table string, key map[string]*dynamodb.AttributeValue) int {
+	for i, item := range db.tables[table] {
+		matches := true
+		for name, value := range key {
+			if item[name] == nil || aws.StringValue(item[name].S) != aws.StringValue(value.S) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return i
+		}
+	}
+	return -1
+}
+
+//A copy of the item so callers decrypting it in place don't change the table
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	copied := make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, value := range item {
+		copied[name] = value
+	}
+	return copied
+}
+
+func (db *fakeDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.gets++
+	if db.getErr != nil {
+		return nil, db.getErr
+	}
+	table := aws.StringValue(input.TableName)
+	if i := db.find(table, input.Key); i >= 0 {
+		return &dynamodb.GetItemOutput{Item: copyItem(db.tables[table][i])}, nil
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (db *fakeDynamo) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	output := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{}}
+	for table, request := range input.RequestItems {
+		db.batches = append(db.batches, len(request.Keys))
+		if db.unprocess > 0 {
+			db.unprocess--
+			output.UnprocessedKeys = input.RequestItems
+			continue
+		}
+		for _, key := range request.Keys {
+			if i := db.find(table, key); i >= 0 {
+				output.Responses[table] = append(output.Responses[table], copyItem(db.tables[table][i]))
+			}
+		}
+	}
+	return output, nil
+}
+
+//Write the usage record, evaluating the version condition the handler writes with, any other condition panics
+func (db *fakeDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.puts++
+	if db.putErr != nil {
+		return nil, db.putErr
+	}
+	table := aws.StringValue(input.TableName)
+	i := db.find(table, map[string]*dynamodb.AttributeValue{"company_id": input.Item["company_id"]})
+	switch condition := aws.StringValue(input.ConditionExpression); condition {
+	case "":
+	case "attribute_not_exists(company_id) OR version = :version":
+		if i >= 0 && aws.StringValue(db.tables[table][i]["version"].N) != aws.StringValue(input.ExpressionAttributeValues[":version"].N) {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+		}
+	default:
+		panic("fakeDynamo can't evaluate " + condition)
+	}
+	if i >= 0 {
+		db.tables[table][i] = copyItem(input.Item)
+	} else {
+		db.tables[table] = append(db.tables[table], copyItem(input.Item))
+	}
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+//fakeKMS decrypts ciphertext written as "encrypted:" followed by the plaintext
+type fakeKMS struct {
+	kmsiface.KMSAPI
+}
+
+func (svc fakeKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	plaintext := strings.TrimPrefix(string(input.CiphertextBlob), "encrypted:")
+	if len(plaintext) == len(input.CiphertextBlob) {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "not encrypted", nil)
+	}
+	return &kms.DecryptOutput{Plaintext: []byte(plaintext)}, nil
+}
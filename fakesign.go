@@ -0,0 +1,63 @@
+//go:build fakesign
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+//Builds with the fakesign tag return stable URLs without signing so end to end UI tests run without S3
+func init() {
+	newStorageBackend = func(clients *awsClients) StorageBackend {
+		return fakeStorage{}
+	}
+}
+
+//fakeStorage an empty store that signs nothing
+type fakeStorage struct{}
+
+//A deterministic URL naming the bucket, key and operation that was requested
+func (fakeStorage) Presign(user *User) (*URLSign, error) {
+	method := http.MethodPut
+	switch user.operation() {
+	case operationDownload:
+		method = http.MethodGet
+	case operationHead:
+		method = http.MethodHead
+	case operationDelete:
+		method = http.MethodDelete
+	}
+	fake := url.URL{
+		Scheme:   "https",
+		Host:     "fake-s3.invalid",
+		Path:     "/" + user.bucket() + "/" + user.objectKey(),
+		RawQuery: url.Values{"operation": {user.operation()}}.Encode(),
+	}
+	return &URLSign{URL: fake.String(), Method: method}, nil
+}
+
+func (fakeStorage) List(user *User) (*FileList, error) {
+	return &FileList{Files: []FileInfo{}}, nil
+}
+
+//Nothing is stored so every upload is within quota
+func (fakeStorage) Sum(bucket string, prefixes []string, owner string, maxPages int, fn func(StoredObject)) (int64, error) {
+	return 0, nil
+}
+
+func (fakeStorage) Each(bucket string, prefixes []string, maxPages int, fn func(object StoredObject) bool) error {
+	return nil
+}
+
+func (fakeStorage) Head(bucket string, key string) (*StoredObject, error) {
+	return nil, nil
+}
+
+func (fakeStorage) Delete(bucket string, key string) error {
+	return nil
+}
+
+func (fakeStorage) Copy(bucket string, from string, to string) (bool, error) {
+	return false, nil
+}
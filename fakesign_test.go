@@ -0,0 +1,40 @@
+//go:build fakesign
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFakeSignDeterministic(t *testing.T) {
+	tests := []struct {
+		operation  string
+		wantURL    string
+		wantMethod string
+	}{
+		{operationUpload, "https://fake-s3.invalid/bucket/acme/file.txt?operation=upload", http.MethodPut},
+		{operationDownload, "https://fake-s3.invalid/bucket/acme/file.txt?operation=download", http.MethodGet},
+		{operationHead, "https://fake-s3.invalid/bucket/acme/file.txt?operation=head", http.MethodHead},
+		{operationDelete, "https://fake-s3.invalid/bucket/acme/file.txt?operation=delete", http.MethodDelete},
+	}
+	storage := newStorageBackend(&awsClients{})
+	if _, ok := storage.(fakeStorage); !ok {
+		t.Fatalf("newStorageBackend() = %T, want the fake storage in fakesign builds", storage)
+	}
+	for _, test := range tests {
+		t.Run(test.operation, func(t *testing.T) {
+			user := newTestUser()
+			user.Operation = test.operation
+			for i := 0; i < 2; i++ {
+				signed, err := storage.Presign(user)
+				if err != nil {
+					t.Fatalf("Presign() error = %v", err)
+				}
+				if signed.URL != test.wantURL || signed.Method != test.wantMethod {
+					t.Errorf("Presign() = %s %s, want %s %s", signed.Method, signed.URL, test.wantMethod, test.wantURL)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//The companies whose unhashed prefix was found empty, by bucket and company id.  Files only ever land under the
+//hashed prefix once KEY_HASH_LENGTH is set so a company found empty stays empty
+var unhashedPrefixEmpty sync.Map
+
+//The short hash prepended to a company's keys when KEY_HASH_LENGTH is set, spreading companies across S3
+//partitions.  Only the company id is hashed so every file for a company still shares one listable prefix, which
+//spreads many companies apart but keeps a single busy company's keys together
+func keyHash(companyID string) string {
+	length := envInt("KEY_HASH_LENGTH", 0)
+	if length <= 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(companyID))
+	hash := hex.EncodeToString(sum[:])
+	if length < len(hash) {
+		hash = hash[:length]
+	}
+	return hash
+}
+
+//Refuse to serve a company with files under its unhashed prefix once KEY_HASH_LENGTH is set.  Those files are not
+//moved, so they would disappear from listings and the quota while still being stored.  Listing stops at the first
+//file and an empty prefix is remembered so the check costs one listing per company per container.  Keys of other
+//companies whose hash happens to equal the company id are not the company's files
+func (user *User) checkUnhashedPrefix(storage StorageBackend) error {
+	companyID := strings.TrimRight(user.CompanyID, "/")
+	if keyHash(companyID) == "" {
+		return nil
+	}
+	bucket := user.bucket()
+	if _, ok := unhashedPrefixEmpty.Load(bucket + "/" + companyID); ok {
+		return nil
+	}
+	prefix := companyID + "/"
+	var found string
+	err := storage.Each(bucket, []string{prefix}, maxListPages(), func(object StoredObject) bool {
+		folder, _, _ := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+		if keyHash(folder) == companyID { //Another company's hashed key
+			return true
+		}
+		found = object.Key
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("checking %s for files stored before KEY_HASH_LENGTH: %w", prefix, err)
+	}
+	if found != "" {
+		return fmt.Errorf("KEY_HASH_LENGTH is set but %s has files such as %s under the unhashed prefix %s, move them under %s or unset it",
+			companyID, found, prefix, user.companyPrefix())
+	}
+	unhashedPrefixEmpty.Store(bucket+"/"+companyID, true)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Forget which unhashed prefixes were found empty when the test ends
+func resetUnhashedPrefixes(t *testing.T) {
+	t.Cleanup(func() {
+		unhashedPrefixEmpty.Range(func(key, value interface{}) bool {
+			unhashedPrefixEmpty.Delete(key)
+			return true
+		})
+	})
+}
+
+func TestKeyHash(t *testing.T) {
+	tests := []struct {
+		length string
+		want   int
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-3", 0},
+		{"4", 4},
+		{"100", 64},
+	}
+	for _, test := range tests {
+		t.Run("length "+test.length, func(t *testing.T) {
+			t.Setenv("KEY_HASH_LENGTH", test.length)
+			hash := keyHash("acme")
+			if len(hash) != test.want {
+				t.Errorf("keyHash() = %q, want %d characters", hash, test.want)
+			}
+			if again := keyHash("acme"); again != hash {
+				t.Errorf("keyHash() = %q then %q, want it deterministic", hash, again)
+			}
+		})
+	}
+	t.Setenv("KEY_HASH_LENGTH", "8")
+	if keyHash("acme") == keyHash("globex") {
+		t.Error("keyHash() is the same for different companies")
+	}
+}
+
+//Every key of a company shares the hashed prefix so listing it still finds the company's files
+func TestHashedKeysListed(t *testing.T) {
+	t.Setenv("KEY_HASH_LENGTH", "4")
+	user := newTestUser()
+	prefix := keyHash("acme") + "/acme/"
+	if user.companyPrefix() != prefix {
+		t.Fatalf("companyPrefix() = %q, want %q", user.companyPrefix(), prefix)
+	}
+	user.FileRequest = "photos/cat.png"
+	if user.objectKey() != prefix+"photos/cat.png" {
+		t.Errorf("objectKey() = %q, want it under %q", user.objectKey(), prefix)
+	}
+	svc := &fakeListV2{output: &s3.ListObjectsV2Output{Contents: []*s3.Object{s3Object(prefix+"photos/cat.png", 10)}}}
+	user.Operation = operationList
+	user.FileRequest = ""
+	list, err := user.listFiles(newS3TestStorage(svc))
+	if err != nil {
+		t.Fatalf("listFiles() error = %v", err)
+	}
+	if aws.StringValue(svc.input.Prefix) != prefix {
+		t.Errorf("listed %s, want %s", aws.StringValue(svc.input.Prefix), prefix)
+	}
+	if len(list.Files) != 1 || list.Files[0].Name != "photos/cat.png" {
+		t.Errorf("listFiles() = %+v, want photos/cat.png named within the company prefix", list.Files)
+	}
+}
+
+func TestCheckUnhashedPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  string
+		keys    []string
+		wantErr string
+	}{
+		{"hashing disabled", "", []string{"acme/old.txt"}, ""},
+		{"nothing stored", "4", nil, ""},
+		{"only hashed files", "4", []string{"{hash}/acme/new.txt"}, ""},
+		{"unhashed files", "4", []string{"acme/old.txt"}, "files such as acme/old.txt under the unhashed prefix acme/"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetUnhashedPrefixes(t)
+			t.Setenv("KEY_HASH_LENGTH", test.length)
+			storage := newMemStorage()
+			for _, key := range test.keys {
+				storage.put("bucket", strings.Replace(key, "{hash}", keyHash("acme"), 1), 10, time.Now())
+			}
+			err := newTestUser().checkUnhashedPrefix(storage)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkUnhashedPrefix() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("checkUnhashedPrefix() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+//A company whose id is itself a hex string can share its unhashed prefix with the keys of another company whose
+//hash it equals, those aren't its files
+func TestCheckUnhashedPrefixOtherCompany(t *testing.T) {
+	resetUnhashedPrefixes(t)
+	t.Setenv("KEY_HASH_LENGTH", "2")
+	other := ""
+	for i := 0; other == ""; i++ {
+		if id := fmt.Sprintf("company-%d", i); keyHash(id) == "ab" {
+			other = id
+		}
+	}
+	storage := newMemStorage()
+	storage.put("bucket", "ab/"+other+"/file.txt", 10, time.Now())
+	user := newTestUser()
+	user.CompanyID = "ab"
+	if err := user.checkUnhashedPrefix(storage); err != nil {
+		t.Errorf("checkUnhashedPrefix() error = %v, want %s's files ignored", err, other)
+	}
+}
+
+//An empty unhashed prefix is only listed once
+func TestCheckUnhashedPrefixCached(t *testing.T) {
+	resetUnhashedPrefixes(t)
+	t.Setenv("KEY_HASH_LENGTH", "4")
+	storage := &countingStorage{StorageBackend: newMemStorage()}
+	for i := 0; i < 3; i++ {
+		if err := newTestUser().checkUnhashedPrefix(storage); err != nil {
+			t.Fatalf("checkUnhashedPrefix() error = %v", err)
+		}
+	}
+	if storage.calls != 1 {
+		t.Errorf("listed %d times, want once", storage.calls)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+	"strings"
+)
+
+//The file name with a random suffix inserted before its extension, so report.pdf becomes report-1a2b3c4d.pdf
+//and concurrent uploads of the same name don't overwrite each other.  A name that is only an extension such as
+//.env has the suffix appended
+func withKeySuffix(file string) (string, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	suffix := "-" + hex.EncodeToString(b)
+	extension := path.Ext(file)
+	if extension == "" || extension == "/" || extension == path.Base(file) {
+		return file + suffix, nil
+	}
+	return strings.TrimSuffix(file, extension) + suffix + extension, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWithKeySuffix(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"report.pdf", `^report-[0-9a-f]{8}\.pdf$`},
+		{"docs/report.tar.gz", `^docs/report\.tar-[0-9a-f]{8}\.gz$`},
+		{"README", `^README-[0-9a-f]{8}$`},
+		{".env", `^\.env-[0-9a-f]{8}$`},
+		{"docs.v2/README", `^docs\.v2/README-[0-9a-f]{8}$`},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			first, err := withKeySuffix(test.file)
+			if err != nil {
+				t.Fatalf("withKeySuffix() error = %v", err)
+			}
+			if !regexp.MustCompile(test.want).MatchString(first) {
+				t.Errorf("withKeySuffix(%q) = %q, want it to match %s", test.file, first, test.want)
+			}
+			if second, _ := withKeySuffix(test.file); second == first {
+				t.Errorf("withKeySuffix(%q) returned %q twice, want a random suffix", test.file, first)
+			}
+		})
+	}
+}
+
+//The suffixed name is signed and returned so the client knows where its file was stored
+func TestHandleRequestKeySuffix(t *testing.T) {
+	t.Setenv("UNIQUE_KEY_SUFFIX", "true")
+	h, _ := newTestHandler(t, 1)
+	response := post(t, h, `{"sub":"sub-1","file_request":"report.pdf","file_size":100}`)
+	var signed URLSign
+	if err := json.Unmarshal([]byte(response.Body), &signed); err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s, want a signed URL", response.StatusCode, response.Body)
+	}
+	if !regexp.MustCompile(`^report-[0-9a-f]{8}\.pdf$`).MatchString(signed.FileRequest) ||
+		!strings.Contains(signed.URL, "/acme/"+signed.FileRequest+"?") {
+		t.Errorf("signed %s as file_request %q, want the suffixed name signed and returned", signed.URL, signed.FileRequest)
+	}
+}
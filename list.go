@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//FileList json object containing a page of the company's files
+type FileList struct {
+	Files                 []FileInfo `json:"files"`
+	Folders               []string   `json:"folders,omitempty"`                 //Sub folders of the listed folder when grouping folders
+	NextContinuationToken string     `json:"next_continuation_token,omitempty"` //Pass back as continuation_token for the next page, empty on the last page
+}
+
+//FileInfo a file stored by the company
+type FileInfo struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+//List a page of the files stored under the company prefix.  An optional file_request narrows the listing to a
+//folder, and with group_folders only that folder level is listed with its sub folders returned separately
+func (user *User) listFiles(storage *s3Storage) (*FileList, error) {
+	companyPrefix := user.companyPrefix()
+	input := &s3.ListObjectsV2Input{Prefix: aws.String(user.objectKey())}
+	if user.GroupFolders {
+		input.Delimiter = aws.String("/")
+	}
+	if user.ContinuationToken != "" {
+		input.ContinuationToken = aws.String(user.ContinuationToken)
+	}
+	if user.MaxKeys > 0 {
+		input.MaxKeys = aws.Int64(int64(user.MaxKeys))
+	}
+	list := &FileList{Files: []FileInfo{}}
+	err := storage.listPages(user.bucket(), input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			list.Files = append(list.Files, FileInfo{
+				Name:         strings.TrimPrefix(aws.StringValue(object.Key), companyPrefix),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		for _, folder := range page.CommonPrefixes {
+			list.Folders = append(list.Folders, strings.TrimPrefix(aws.StringValue(folder.Prefix), companyPrefix))
+		}
+		if aws.BoolValue(page.IsTruncated) {
+			list.NextContinuationToken = aws.StringValue(page.NextContinuationToken)
+		}
+		return false //One page is returned, the client continues from its token
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing files for %s: %w", user.CompanyID, err)
+	}
+	return list, nil
+}
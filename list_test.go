@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//fakeListV2 lists its output as a single page, keeping the input it was called with
+type fakeListV2 struct {
+	s3iface.S3API
+	input  *s3.ListObjectsV2Input
+	output *s3.ListObjectsV2Output
+	err    error
+}
+
+func (svc *fakeListV2) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	svc.input = input
+	if svc.err != nil {
+		return svc.err
+	}
+	fn(svc.output, !aws.BoolValue(svc.output.IsTruncated))
+	return nil
+}
+
+func TestListFilesPagination(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	listed := func(key string, size int64) *s3.Object {
+		object := s3Object(key, size)
+		object.LastModified = aws.Time(modified)
+		return object
+	}
+	tests := []struct {
+		name      string
+		token     string
+		maxKeys   int
+		truncated bool
+		wantToken *string
+		wantMax   *int64
+		wantNext  string
+	}{
+		{"first page", "", 0, true, nil, nil, "next-page"},
+		{"continued", "this-page", 2, true, aws.String("this-page"), aws.Int64(2), "next-page"},
+		{"last page", "this-page", 0, false, aws.String("this-page"), nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := &fakeListV2{output: &s3.ListObjectsV2Output{
+				Contents:              []*s3.Object{listed("acme/a.txt", 10), listed("acme/docs/b.txt", 20)},
+				IsTruncated:           aws.Bool(test.truncated),
+				NextContinuationToken: aws.String("next-page"),
+			}}
+			user := newTestUser()
+			user.Operation = operationList
+			user.FileRequest = ""
+			user.ContinuationToken = test.token
+			user.MaxKeys = test.maxKeys
+			list, err := user.listFiles(newS3TestStorage(svc))
+			if err != nil {
+				t.Fatalf("listFiles() error = %v", err)
+			}
+			if aws.StringValue(svc.input.Prefix) != "acme/" {
+				t.Errorf("listed under %s, want acme/", aws.StringValue(svc.input.Prefix))
+			}
+			if !reflect.DeepEqual(svc.input.ContinuationToken, test.wantToken) || !reflect.DeepEqual(svc.input.MaxKeys, test.wantMax) {
+				t.Errorf("listed from token %v with max keys %v, want %v and %v", aws.StringValue(svc.input.ContinuationToken),
+					aws.Int64Value(svc.input.MaxKeys), aws.StringValue(test.wantToken), aws.Int64Value(test.wantMax))
+			}
+			want := []FileInfo{{Name: "a.txt", Size: 10, LastModified: modified}, {Name: "docs/b.txt", Size: 20, LastModified: modified}}
+			if !reflect.DeepEqual(list.Files, want) {
+				t.Errorf("files = %+v, want them named within the company prefix %+v", list.Files, want)
+			}
+			if list.NextContinuationToken != test.wantNext {
+				t.Errorf("next_continuation_token = %q, want %q", list.NextContinuationToken, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestListFilesFailure(t *testing.T) {
+	svc := &fakeListV2{err: s3Error("AccessDenied")}
+	_, err := newTestUser().listFiles(newS3TestStorage(svc))
+	if err == nil || !strings.Contains(err.Error(), "listing files for acme") || statusCodeFor(err) != http.StatusInternalServerError {
+		t.Errorf("listFiles() error = %v, want the wrapped listing failure", err)
+	}
+}
+
+func TestValidateList(t *testing.T) {
+	tests := []struct {
+		maxKeys int
+		wantErr error
+	}{
+		{0, nil},
+		{1000, nil},
+		{-1, ErrInvalidRequest},
+		{1001, ErrInvalidRequest},
+	}
+	for _, test := range tests {
+		user := newTestUser()
+		user.Operation = operationList
+		user.FileRequest = ""
+		user.MaxKeys = test.maxKeys
+		if err := user.Validate(); !errors.Is(err, test.wantErr) {
+			t.Errorf("Validate() with max_keys %d error = %v, want %v", test.maxKeys, err, test.wantErr)
+		}
+	}
+}
+
+func TestListFilesGroupFolders(t *testing.T) {
+	tests := []struct {
+		name          string
+		group         bool
+		folder        string
+		wantPrefix    string
+		wantDelimiter *string
+		wantFolders   []string
+	}{
+		{"flat", false, "", "acme/", nil, nil},
+		{"grouped", true, "", "acme/", aws.String("/"), []string{"docs/", "photos/"}},
+		{"grouped within a folder", true, "docs/", "acme/docs/", aws.String("/"), []string{"docs/", "photos/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &s3.ListObjectsV2Output{Contents: []*s3.Object{s3Object(test.wantPrefix+"a.txt", 10)}}
+			if test.group {
+				output.CommonPrefixes = []*s3.CommonPrefix{{Prefix: aws.String("acme/docs/")}, {Prefix: aws.String("acme/photos/")}}
+			}
+			svc := &fakeListV2{output: output}
+			user := newTestUser()
+			user.Operation = operationList
+			user.FileRequest = test.folder
+			user.GroupFolders = test.group
+			list, err := user.listFiles(newS3TestStorage(svc))
+			if err != nil {
+				t.Fatalf("listFiles() error = %v", err)
+			}
+			if aws.StringValue(svc.input.Prefix) != test.wantPrefix || !reflect.DeepEqual(svc.input.Delimiter, test.wantDelimiter) {
+				t.Errorf("listed %s with delimiter %v, want %s with %v", aws.StringValue(svc.input.Prefix),
+					aws.StringValue(svc.input.Delimiter), test.wantPrefix, aws.StringValue(test.wantDelimiter))
+			}
+			if !reflect.DeepEqual(list.Folders, test.wantFolders) {
+				t.Errorf("folders = %q, want %q", list.Folders, test.wantFolders)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+)
+
+//requestLog logs one request's lines, each prefixed with its correlation ID.  Info level lines are only logged
+//when the request was sampled, errors and warnings always are.  Every request has its own, so requests served
+//concurrently on the http platform never share a prefix or a sampling decision
+type requestLog struct {
+	*log.Logger
+	sampled bool
+}
+
+//The log for the request with the correlation ID, sampling 1 of every LOG_SAMPLE_RATE requests' info lines
+func newRequestLog(id string) *requestLog {
+	return &requestLog{
+		Logger:  log.New(log.Writer(), "["+id+"] ", log.Flags()),
+		sampled: shouldSample(envInt("LOG_SAMPLE_RATE", 1), rand.Int()),
+	}
+}
+
+//Whether a request is sampled when logging 1 of every rate requests, roll is a random number.  Every request is
+//sampled when the rate is 1 or less
+func shouldSample(rate int, roll int) bool {
+	return rate <= 1 || roll%rate == 0
+}
+
+//Log an info level line when the request is sampled
+func (l *requestLog) infof(format string, v ...interface{}) {
+	if l.sampled {
+		l.Printf(format, v...)
+	}
+}
+
+//Log a debug level line when LOG_LEVEL is debug and the request is sampled
+func (l *requestLog) debugf(format string, v ...interface{}) {
+	if strings.EqualFold(setting("LOG_LEVEL"), "debug") {
+		l.infof(format, v...)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Collects log output written from many goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+//Send the standard logger's output, which request logs write through, to a buffer for the test
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+	return buf
+}
+
+//A request log writing to buf
+func testLog(buf *syncBuffer, id string, sampled bool) *requestLog {
+	return &requestLog{Logger: log.New(buf, "["+id+"] ", 0), sampled: sampled}
+}
+
+func TestShouldSample(t *testing.T) {
+	tests := []struct {
+		rate, roll int
+		want       bool
+	}{
+		{rate: 0, roll: 7, want: true},
+		{rate: 1, roll: 7, want: true},
+		{rate: 100, roll: 200, want: true},
+		{rate: 100, roll: 201, want: false},
+		{rate: -5, roll: 3, want: true},
+	}
+	for _, test := range tests {
+		if got := shouldSample(test.rate, test.roll); got != test.want {
+			t.Errorf("shouldSample(%d, %d) = %v, want %v", test.rate, test.roll, got, test.want)
+		}
+	}
+}
+
+func TestRequestLogSampling(t *testing.T) {
+	tests := []struct {
+		name     string
+		sampled  bool
+		logLevel string
+		want     string
+	}{
+		{"sampled info", true, "", "[id] info\n[id] error\n"},
+		{"unsampled info", false, "", "[id] error\n"},
+		{"sampled debug", true, "DEBUG", "[id] info\n[id] debug\n[id] error\n"},
+		{"unsampled debug", false, "debug", "[id] error\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", test.logLevel)
+			buf := &syncBuffer{}
+			l := testLog(buf, "id", test.sampled)
+			l.infof("info\n")
+			l.debugf("debug\n")
+			l.Println("error")
+			if got := buf.String(); got != test.want {
+				t.Errorf("logged %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewRequestLogPrefix(t *testing.T) {
+	t.Setenv("LOG_SAMPLE_RATE", "")
+	buf := captureLog(t)
+	l := newRequestLog("abc-123")
+	if !l.sampled {
+		t.Error("sampled = false, want every request sampled without LOG_SAMPLE_RATE")
+	}
+	l.infof("hello\n")
+	if got := buf.String(); got != "[abc-123] hello\n" {
+		t.Errorf("logged %q, want the correlation ID prefix", got)
+	}
+}
+
+//Requests served concurrently on the http platform each keep their own correlation ID and sampling decision
+func TestRequestLogsConcurrent(t *testing.T) {
+	buf := &syncBuffer{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := testLog(buf, fmt.Sprintf("req-%d", i), i%2 == 0)
+			for line := 0; line < 50; line++ {
+				l.infof("line from req-%d\n", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 10*50 {
+		t.Fatalf("logged %d lines, want %d from the sampled requests", len(lines), 10*50)
+	}
+	for _, line := range lines {
+		prefix, message, _ := strings.Cut(line, " ")
+		if id := strings.Trim(prefix, "[]"); message != "line from "+id {
+			t.Fatalf("line %q logged with another request's prefix", line)
+		}
+		var i int
+		fmt.Sscanf(prefix, "[req-%d]", &i)
+		if i%2 != 0 {
+			t.Fatalf("line %q logged for an unsampled request", line)
+		}
+	}
+}
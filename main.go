@@ -3,185 +3,883 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 //User the representation of a user to retrieve from DynamoDB
 type User struct {
-	Email       string `json:"email"`
-	Sub         string `json:"sub"`
-	CompanyID   string `json:"company_id,omitempty"`
-	UserName    string `json:"user_name"`
-	FileRequest string `json:"file_request"`
-	FileSize    int    `json:"file_size"` //Size of the file upload request in bytes
-	Payed       bool   `json:"payed,omitempty"`
-	ServiceTier int    `json:"service_tier"`
+	Email       string     `json:"email"`
+	Sub         string     `json:"sub"`
+	CompanyID   string     `json:"company_id,omitempty"`
+	UserName    string     `json:"user_name"`
+	FileRequest string     `json:"file_request"`
+	FileSize    int        `json:"file_size"` //Size of the file upload request in bytes
+	Payed       bool       `json:"payed,omitempty"`
+	PaidUntil   *time.Time `json:"paid_until,omitempty"` //When the subscription lapses, takes precedence over payed
+	ServiceTier int        `json:"service_tier"`
+	BypassQuota bool       `json:"bypass_quota,omitempty"` //Internal testing accounts skip the storage checks, only read from DynamoDB
+
+	URLExpirySeconds int      `json:"url_expiry_seconds,omitempty"` //Negotiated lifetime of signed URLs, only read from DynamoDB
+	Operation        string   `json:"operation,omitempty"`          //upload (default), download, head, delete, tag, list, verify or validate_users
+	Subs             []string `json:"subs,omitempty"`               //Users to look up when an admin validates users
+
+	ContinuationToken string `json:"continuation_token,omitempty"` //Token from the previous page when listing files
+	MaxKeys           int    `json:"max_keys,omitempty"`           //Maximum files to return per page when listing
+	GroupFolders      bool   `json:"group_folders,omitempty"`      //List one folder level, returning sub folders instead of their files
+
+	DownloadFilename    string            `json:"download_filename,omitempty"`     //Filename presented to the browser when downloading, stored with an upload
+	DownloadContentType string            `json:"download_content_type,omitempty"` //Content type served on download, overriding the stored type
+	VersionID           string            `json:"version_id,omitempty"`            //Version to download from a versioned bucket, the latest when empty
+	QueryParameters     map[string]string `json:"query_parameters,omitempty"`      //Extra parameters signed into the URL for downstream apps, limited to SIGNED_QUERY_PARAMS
+	Redirect            bool              `json:"redirect,omitempty"`              //Respond to a download with a 302 to the signed URL instead of JSON
+	StorageClass        string            `json:"storage_class,omitempty"`         //Storage class the upload is written to, defaults to STANDARD
+	ContentType         string            `json:"content_type,omitempty"`          //Content type of the upload, signed so the client must send it
+	PublicRead          bool              `json:"public_read,omitempty"`           //Upload with the public-read ACL, only on tiers allowing it
+	Tags                map[string]string `json:"tags,omitempty"`                  //Tags replacing those of an existing file
+	ChecksumAlgorithm   string            `json:"checksum_algorithm,omitempty"`    //CRC32, CRC32C, SHA1 or SHA256 checksum S3 validates the upload with
+	Checksum            string            `json:"checksum,omitempty"`              //Base64 digest of the file using the checksum algorithm
+
+	companyOverride string     //Company the request asked to operate on instead of the stored one
+	admin           bool       //Verified admin allowed to operate on any company
+	sourceIP        string     //Client address signed URLs are restricted to when RESTRICT_SOURCE_IP is set
+	expirationDays  int        //Days the company's lifecycle rule keeps uploads, from the company record
+	usage           *Usage     //Stored data once the upload completes, measured by the quota check
+	quota           *quotaPlan //The upload's quota check, reserved immediately before signing
+	trashedTo       string     //Key a deleted file was copied to when SOFT_DELETE_PREFIX is set
+
+	additionalPrefixes []string //Prefixes outside the company prefix counted towards its quota, from the company record
+
+	config *Config     //The deployment's configuration, from the handler serving the request
+	log    *requestLog //Logs the request's lines with its correlation ID
+
+	ObjectLockMode        string     `json:"object_lock_mode,omitempty"`         //GOVERNANCE or COMPLIANCE retention for regulated tenants
+	ObjectLockRetainUntil *time.Time `json:"object_lock_retain_until,omitempty"` //RFC3339 timestamp the object is retained until
+}
+
+const (
+	operationUpload   = "upload"
+	operationDownload = "download"
+	operationDelete   = "delete"
+	operationTag      = "tag"
+	operationList     = "list"
+	operationVerify   = "verify"
+	operationHead     = "head"
+
+	operationValidateUsers = "validate_users"
+)
+
+//Company the representation of a company billing record stored in DynamoDB
+type Company struct {
+	CompanyID   string     `json:"company_id"`
+	Payed       bool       `json:"payed"`
+	PaidUntil   *time.Time `json:"paid_until,omitempty"`
+	ServiceTier int        `json:"service_tier"`
+
+	ExpirationDays     int      `json:"expiration_days,omitempty"`     //Days the bucket lifecycle rule for the company's prefix keeps files
+	AdditionalPrefixes []string `json:"additional_prefixes,omitempty"` //Other prefixes, such as per project, counted towards the quota
+	URLExpirySeconds   int      `json:"url_expiry_seconds,omitempty"`  //Negotiated lifetime of signed URLs for the company's users
 }
 
 //URLSign json object containing signed URL to return back to client
 type URLSign struct {
-	URL string `json:"url"`
+	URL               string            `json:"url"`
+	Method            string            `json:"method"`                        //HTTP method the client must use with the URL
+	FileRequest       string            `json:"file_request,omitempty"`        //The file uploaded to, differs from the request's with UNIQUE_KEY_SUFFIX
+	RequiredHeaders   map[string]string `json:"required_headers,omitempty"`    //Headers the client must send with the request
+	Body              string            `json:"body,omitempty"`                //Body the client must send with the request
+	PreviousVersionID string            `json:"previous_version_id,omitempty"` //Version the upload will overwrite when TRACK_OVERWRITES is set
+	TrashKey          string            `json:"trash_key,omitempty"`           //Where a deleted file was kept when SOFT_DELETE_PREFIX is set
+	ExpiresAt         *time.Time        `json:"expires_at,omitempty"`          //When the URL stops working
+	ExpiresIn         int               `json:"expires_in,omitempty"`          //Seconds the URL is valid for from when it was signed
+	ExpirationDays    int               `json:"expiration_days,omitempty"`     //Days after upload the bucket lifecycle deletes the file, omitted when kept
+	AlternateURLs     map[string]string `json:"alternate_urls,omitempty"`      //The URL through each regional CDN host, keyed by region
+	ServiceTier       string            `json:"service_tier,omitempty"`        //Name of the user's service tier when RETURN_TIER_NAME is set
+	Usage             *Usage            `json:"usage,omitempty"`               //Stored data against the tier's limit, omitted unless the quota was checked
 }
 
-//HandleRequest the APIGateway proxy request and return either an error or a signed URL
-func HandleRequest(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	sess, err := session.NewSession()
+//Usage the company's stored data against its tier's limit, so a usage bar can be updated without another call
+type Usage struct {
+	UsedBytes  int64   `json:"used_bytes"`
+	LimitBytes int64   `json:"limit_bytes"`
+	Percent    float64 `json:"percent"` //UsedBytes as a percentage of LimitBytes to 2 decimal places
+}
+
+//The usage of used out of limit bytes.  A limit of zero allows nothing so any usage is reported as 100%
+func newUsage(used, limit int64) *Usage {
+	usage := &Usage{UsedBytes: used, LimitBytes: limit}
+	switch {
+	case limit > 0:
+		usage.Percent = math.Round(float64(used)*10000/float64(limit)) / 100
+	case used > 0:
+		usage.Percent = 100
+	}
+	return usage
+}
+
+//handler serves requests with the configuration loaded at startup
+type handler struct {
+	config *Config
+}
+
+//HandleRequest the APIGateway proxy request and return either an error or a signed URL.  Every log line and the
+//response carry the request's correlation ID, and a panic is logged and returned as a 500.  Error responses are
+//logged with their body.  The response is shaped for the version the client asked for
+func (h *handler) HandleRequest(ctx context.Context, event events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+	id := correlationID(event)
+	reqLog := newRequestLog(id)
+	ctx, span := startSpan(ctx, "HandleRequest", attribute.String("request.id", id))
+	defer flushTelemetry(ctx)
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+		countRequest(ctx, response.StatusCode)
+		span.End()
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			reqLog.Printf("PANIC: %v\n%s", r, debug.Stack())
+			response = events.APIGatewayProxyResponse{
+				Body:       errorBody(codeInternal, "Internal Server Error"),
+				StatusCode: http.StatusInternalServerError,
+				Headers:    map[string]string{correlationHeader: id},
+			}
+			err = nil
+		}
+	}()
+	version, versionErr := responseVersion(event)
+	if versionErr != nil {
+		response = errorResponse(versionErr)
+	} else {
+		response, err = h.handleRequest(ctx, event, reqLog)
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		reqLog.Println(response.Body)
+	}
+	response = versionResponse(response, version)
+	response.Headers[correlationHeader] = id
+	return response, err
+}
+
+//Validate the request and sign the URL or run the requested operation
+func (h *handler) handleRequest(ctx context.Context, event events.APIGatewayProxyRequest, reqLog *requestLog) (events.APIGatewayProxyResponse, error) {
+	switch event.HTTPMethod {
+	case "", http.MethodPost:
+	case http.MethodOptions: //CORS preflight
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent, Headers: corsHeaders()}, nil
+	default:
+		return events.APIGatewayProxyResponse{
+			Body:       errorBody(codeMethodNotAllowed, "Method Not Allowed"),
+			StatusCode: http.StatusMethodNotAllowed,
+			Headers:    map[string]string{"Allow": allowedMethods},
+		}, nil
+	}
+	clients, err := newAWSClients(h.config)
+	if err != nil {
+		return errorResponse(fmt.Errorf("creating AWS clients: %w", err)), nil
+	}
+	clients.log = reqLog
+	user := User{config: h.config, log: reqLog}
+	err = decodeBody(event.Body, &user)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+	err = user.authorizeCompanyOverride(event)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+	user.sourceIP, err = sourceIP(event, h.config.RestrictSourceIP)
 	if err != nil {
-		return events.APIGatewayProxyResponse{Body: err.Error()}, nil
+		return errorResponse(err), nil
 	}
-	var user User
-	err = json.Unmarshal([]byte(event.Body), &user)
+	_, span := startSpan(ctx, "validate", attribute.String("operation", user.operation()))
+	err = user.Validate()
+	endSpan(span, err)
 	if err != nil {
-		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
+		return errorResponse(err), nil
 	}
-	valid, err := user.validateUser(sess)
+	if user.writes() && envBool("READ_ONLY", false) {
+		return errorResponse(fmt.Errorf("%w: %s is unavailable during maintenance, downloads still work", ErrReadOnly, user.operation())), nil
+	}
+	if user.operation() == operationUpload && int64(user.FileSize) > largestTierStorage() {
+		return errorResponse(ErrFileTooLarge), nil
+	}
+	if maxPut := int64(envInt("MAX_SINGLE_PUT_BYTES", maxSinglePut)); user.operation() == operationUpload && int64(user.FileSize) > maxPut {
+		return errorResponse(fmt.Errorf("%w: file_size exceeds the %d byte limit of a single PUT, use a multipart upload", ErrFileTooLarge, maxPut)), nil
+	}
+	if user.operation() == operationValidateUsers {
+		if !isAdmin(event, user.Sub, user.config.AdminGroup) {
+			return errorResponse(fmt.Errorf("%w: only admins may validate users", ErrForbidden)), nil
+		}
+		results, err := validateUsers(clients, user.Subs)
+		if err != nil {
+			return errorResponse(err), nil
+		}
+		return jsonResponse(results), nil
+	}
+	if user.operation() == operationUpload && envBool("UNIQUE_KEY_SUFFIX", false) { //The quota check needs the final key
+		user.FileRequest, err = withKeySuffix(user.FileRequest)
+		if err != nil {
+			return errorResponse(fmt.Errorf("generating key suffix: %w", err)), nil
+		}
+	}
+	_, span = startSpan(ctx, "quota", attribute.String("operation", user.operation()))
+	valid, err := user.validateUser(clients)
+	endSpan(span, err)
 	if !valid || err != nil {
 		if err != nil {
-			return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
+			return errorResponse(err), nil
 		} else {
-			return events.APIGatewayProxyResponse{Body: "Invalid User Request", StatusCode: 400}, nil
+			return errorResponse(fmt.Errorf("%w: invalid user request", ErrInvalidRequest)), nil
 		}
 	}
-	url, err := user.signURLForUser(sess)
-	log.Println("Signed URL: " + url)
-	if url == "" || err != nil {
+	if user.operation() == operationList {
+		files, err := clients.storage.List(&user)
 		if err != nil {
-			return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
-		} else {
-			return events.APIGatewayProxyResponse{Body: "Unable to sign URL", StatusCode: 400}, nil
+			return errorResponse(err), nil
+		}
+		return jsonResponse(files), nil
+	}
+	if user.operation() == operationVerify {
+		verification, err := user.verifyUpload(clients)
+		if err != nil {
+			return errorResponse(err), nil
+		}
+		return jsonResponse(verification), nil
+	}
+	var previousVersion string
+	if user.operation() == operationUpload && envBool("TRACK_OVERWRITES", false) {
+		version, exists, err := user.currentVersion(clients.storage)
+		if err != nil {
+			return errorResponse(err), nil
+		}
+		if exists && version == "" {
+			version = "null" //Unversioned bucket, the overwrite replaces the object
 		}
+		previousVersion = version
 	}
-	var signedURL URLSign
-	signedURL.URL = url
-	data, err := json.Marshal(&signedURL)
+	err = signs.allow(user.log, time.Now())
 	if err != nil {
-		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
+		return errorResponse(err), nil
 	}
-	headers := map[string]string{
-		"Access-Control-Allow-Origin":  "*",
-		"Access-Control-Allow-Methods": "*",
+	reserved, err := user.reserveUpload(clients)
+	if err != nil {
+		return errorResponse(err), nil
+	}
+	_, span = startSpan(ctx, "sign", attribute.String("operation", user.operation()))
+	signedURL, err := user.signURLForUser(clients)
+	endSpan(span, err)
+	if err != nil {
+		reserved.release()
+		return errorResponse(err), nil
+	}
+	user.log.infof("Signed URL: %s\n", signedURL.URL)
+	if user.operation() == operationDelete {
+		user.releaseDeleted(clients.dynamo)
+	}
+	signedURL.PreviousVersionID = previousVersion
+	signedURL.TrashKey = user.trashedTo
+	if envBool("RETURN_TIER_NAME", false) {
+		signedURL.ServiceTier = tierName(user.ServiceTier)
+	}
+	if user.operation() == operationUpload {
+		signedURL.FileRequest = user.FileRequest
+	}
+	if user.operation() == operationUpload {
+		signedURL.ExpirationDays = user.lifecycleExpirationDays()
+	}
+	signedURL.Usage = user.usage
+	user.publishSignedEvent(clients.events)
+	if user.wantsRedirect() {
+		return redirectResponse(signedURL), nil
+	}
+	return jsonResponse(signedURL), nil
+}
+
+//Build a successful JSON response
+func jsonResponse(body interface{}) events.APIGatewayProxyResponse {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errorResponse(err)
 	}
 	return events.APIGatewayProxyResponse{
 		Body:       string(data),
 		StatusCode: 200,
-		Headers:    headers,
-	}, nil
+		Headers:    corsHeaders(),
+	}
 }
 
-//Get the user from dynamo, verify that the "sub" from the current user matches the "sub" stored in dynamo.  set the company_id
-func (user *User) validateUser(sess *session.Session) (bool, error) {
+//S3 rejects a single PutObject larger than 5GB
+const maxSinglePut = 5 * 1024 * 1024 * 1024
+
+//The methods the handler accepts
+const allowedMethods = "POST, OPTIONS"
 
-	// Create DynamoDB client
-	svc := dynamodb.New(sess)
+//Headers allowing browsers to call the handler from any origin
+func corsHeaders() map[string]string {
+	return map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "*",
+	}
+}
+
+//Build the error response with the status code matching the error category
+func errorResponse(err error) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{Body: errorBody(errorCodeFor(err), err.Error()), StatusCode: statusCodeFor(err)}
+}
+
+//Get the user from dynamo, verify that the "sub" from the current user matches the "sub" stored in dynamo.  set the company_id
+func (user *User) validateUser(clients *awsClients) (bool, error) {
+	svc := clients.dynamo
+	key, err := user.userKey()
+	if err != nil {
+		return false, err
+	}
 	result, err := svc.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(os.Getenv("DYNAMO_TABLE")),
-		Key: map[string]*dynamodb.AttributeValue{
-			"sub": {
-				S: aws.String(user.Sub),
-			},
-		},
+		TableName: aws.String(user.config.DynamoTable),
+		Key:       key,
 	})
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("getting user %s: %w", user.Sub, err)
 	}
 	if len(result.Item) == 0 { //Response empty meaning the user associated with that sub is not found
-		return false, errors.New("User not found")
+		return false, ErrUserNotFound
 	}
-	var dUser User
-	err = dynamodbattribute.UnmarshalMap(result.Item, &dUser)
+	//if dUser.Sub == user.Sub {
+	err = user.loadRecord(clients, result.Item)
 	if err != nil {
 		return false, err
 	}
-	//if dUser.Sub == user.Sub {
-	user.CompanyID = dUser.CompanyID
-	user.ServiceTier = dUser.ServiceTier
-	user.Payed = dUser.Payed
-	log.Println(user)
-	grants, err := user.verifyUserGrants(sess)
+	user.log.infof("%v\n", user)
+	user.log.infof("User %s in company %s is on the %s tier\n", user.Sub, user.CompanyID, tierName(user.ServiceTier))
+	if !user.isPaid(time.Now()) && user.requiresPayment() {
+		return false, ErrNotPaid
+	}
+	if !user.config.bucketAllowed(user.bucket()) { //A bad TIER_<n>_BUCKET or a parameter store value pointing elsewhere
+		return false, fmt.Errorf("%w: %s", ErrBucketNotAllowed, user.bucket())
+	}
+	err = user.checkUnhashedPrefix(clients.storage)
 	if err != nil {
 		return false, err
 	}
-	if grants && user.Payed {
+	if user.operation() != operationUpload { //Only uploads add to the stored data
 		return true, nil
 	}
+	grants, err := user.verifyUserGrants(clients)
+	if err != nil {
+		return false, err
+	}
 	//}
 
-	return false, err
+	return grants, nil
+}
+
+//Load the company, tier and billing from the user's record in DYNAMO_TABLE: decrypted, switched to the company
+//override when the user is a member, then overridden by the company record.  Shared by validateUser and
+//validateUsers so a sub is judged the same way whichever looked it up
+func (user *User) loadRecord(clients *awsClients, item map[string]*dynamodb.AttributeValue) error {
+	err := decryptItem(clients.kms, item, user.config.EncryptedAttributes)
+	if err != nil {
+		return err
+	}
+	var dUser User
+	err = unmarshalRecord(item, &dUser)
+	if err != nil {
+		return fmt.Errorf("unmarshaling user %s: %w", user.Sub, err)
+	}
+	user.CompanyID = dUser.CompanyID
+	if user.companyOverride != "" {
+		err = user.authorizeMembership(clients.dynamo)
+		if err != nil {
+			return err
+		}
+		user.CompanyID = user.companyOverride
+	}
+	user.ServiceTier = dUser.ServiceTier
+	user.Payed = dUser.Payed
+	user.PaidUntil = dUser.PaidUntil
+	user.BypassQuota = dUser.BypassQuota
+	user.URLExpirySeconds = dUser.URLExpirySeconds
+	return user.applyCompanyBilling(clients.dynamo)
+}
+
+//Whether the subscription is paid up.  With a paid_until the user stays paid for PAID_GRACE_PERIOD (default 72h)
+//after it lapses, records without one fall back to payed
+func (user *User) isPaid(now time.Time) bool {
+	if user.PaidUntil == nil {
+		return user.Payed
+	}
+	grace := envDuration("PAID_GRACE_PERIOD", time.Hour*72)
+	if now.After(*user.PaidUntil) && now.Before(user.PaidUntil.Add(grace)) {
+		user.log.infof("Subscription for %s lapsed, within grace period\n", user.Sub)
+	}
+	return now.Before(user.PaidUntil.Add(grace))
+}
+
+//Every paid tier must be paid up, whether the free tier must also be is the FREE_TIER_REQUIRES_PAID policy
+func (user *User) requiresPayment() bool {
+	if user.ServiceTier == freeTier {
+		return envBool("FREE_TIER_REQUIRES_PAID", true)
+	}
+	return true
+}
+
+//If a company table is configured, override the user's service tier and paid status with the company record.
+//Falls back to the user level values when no company table is set or the company has no record
+func (user *User) applyCompanyBilling(svc dynamodbiface.DynamoDBAPI) error {
+	table := user.config.CompanyTable
+	if table == "" || user.CompanyID == "" {
+		return nil
+	}
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"company_id": {
+				S: aws.String(user.CompanyID),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("getting company %s: %w", user.CompanyID, err)
+	}
+	if len(result.Item) == 0 { //No company record, keep the user level billing
+		user.log.infof("No company record found for %s, using user billing\n", user.CompanyID)
+		return nil
+	}
+	var company Company
+	err = unmarshalRecord(result.Item, &company)
+	if err != nil {
+		return fmt.Errorf("unmarshaling company %s: %w", user.CompanyID, err)
+	}
+	user.ServiceTier = company.ServiceTier
+	user.Payed = company.Payed
+	user.PaidUntil = company.PaidUntil
+	user.expirationDays = company.ExpirationDays
+	user.additionalPrefixes = company.AdditionalPrefixes
+	if company.URLExpirySeconds > 0 {
+		user.URLExpirySeconds = company.URLExpirySeconds
+	}
+	return nil
+}
+
+//Days the bucket lifecycle keeps the company's uploads, the company's configuration or LIFECYCLE_EXPIRATION_DAYS.
+//Zero when files are kept until deleted
+func (user *User) lifecycleExpirationDays() int {
+	if user.expirationDays > 0 {
+		return user.expirationDays
+	}
+	return envInt("LIFECYCLE_EXPIRATION_DAYS", 0)
 }
 
 //Check that the user is paid up, and has the correct service tier for the file they're uploading
-func (user *User) verifyUserGrants(sess *session.Session) (bool, error) {
-	svc := s3.New(sess)
-	totalSize := user.calculateObjectSize(svc)
-	var maxSize int64
-	switch user.ServiceTier {
-	case 0:
-		maxSize = 10000000 //10MB Free Tier
-	case 1:
-		maxSize = 40000000000 //40GB
-	case 2:
-		maxSize = 1000000000000 //1TB
-	default:
-		maxSize = 10000000 //Default to free tier
+func (user *User) verifyUserGrants(clients *awsClients) (bool, error) {
+	tier := tierFor(user.ServiceTier)
+	if !tier.allowsContentType(user.uploadContentType()) {
+		return false, fmt.Errorf("%w: content type %q is not allowed for this service tier, allowed types are %s",
+			ErrInvalidRequest, user.uploadContentType(), strings.Join(tier.AllowedContentTypes, ", "))
+	}
+	err := user.applyTierObjectLock(tier, time.Now())
+	if err != nil {
+		return false, err
 	}
-	if totalSize >= maxSize || totalSize+int64(user.FileSize) > maxSize {
-		return false, errors.New("Maximum amount of stored data exceeded")
+	if user.PublicRead && !tier.PublicRead {
+		return false, fmt.Errorf("%w: public_read uploads are not allowed for this service tier", ErrForbidden)
 	}
+	err = user.checkBucketCapacity(clients.storage)
+	if err != nil {
+		return false, err
+	}
+	if user.BypassQuota {
+		user.log.Println("WARNING: QUOTA BYPASSED for " + user.Sub + " in company " + user.CompanyID)
+		return true, nil
+	}
+	plan, err := user.planQuota(clients.storage, user.readUsage(clients.dynamo), tier)
+	if err != nil {
+		return false, err
+	}
+	used, err := addSizes(plan.stored, plan.record.pendingBytes(plan.seen, user.objectKey(), time.Now()))
+	if err != nil {
+		return false, err
+	}
+	afterUpload, err := addSizes(used, int64(user.FileSize))
+	if err != nil {
+		return false, err
+	}
+	if !tier.fits(used, int64(user.FileSize)) {
+		if !tier.EvictOldest {
+			return false, ErrQuotaExceeded
+		}
+		plan.evict, err = user.planEvictions(clients.storage, afterUpload-tier.MaxStorage)
+		if err != nil {
+			return false, err
+		}
+		for _, object := range plan.evict {
+			plan.stored -= object.Size
+		}
+	}
+	user.quota = plan
 	return true, nil
 }
 
-//calculate the total space in bytes a user/company is using
-func (user *User) calculateObjectSize(svc *s3.S3) int64 {
-	inputparams := &s3.ListObjectsInput{
-		Bucket:    aws.String(os.Getenv("BUCKET")),
-		Prefix:    aws.String(user.CompanyID + "/"),
-		Delimiter: aws.String("/"),
+//quotaPlan the quota check of an upload, made while validating the user and reserved once every other check has
+//passed, immediately before the URL is signed
+type quotaPlan struct {
+	tier   tierConfig
+	stored int64                   //Bytes listed once the upload replaces any file at its key
+	seen   map[string]StoredObject //The listed objects at the upload's key and the keys of the record's pending uploads
+	record *usageRecord            //Read before listing, nil without USAGE_TABLE or when it is unavailable
+	evict  []StoredObject          //Oldest files to delete to make room, already taken off stored
+}
+
+//List the company's stored data for the quota check of an upload, bounded by MAX_LIST_PAGES when set.  No
+//delimiter is used so objects in every folder under the company prefix count towards the quota, along with the
+//objects under the company's additional prefixes.  The file at the upload's key is about to be replaced so it
+//isn't counted, and the objects at the record's pending keys are kept to tell which uploads have landed
+func (user *User) planQuota(storage StorageBackend, record *usageRecord, tier tierConfig) (*quotaPlan, error) {
+	plan := &quotaPlan{tier: tier, seen: map[string]StoredObject{}, record: record}
+	watched := map[string]bool{user.objectKey(): true}
+	if record != nil {
+		for key := range record.Pending {
+			watched[key] = true
+		}
 	}
-	pageNum := 0
-	var totalSize int64
-	svc.ListObjectsPages(inputparams, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		log.Println("PAGE: ", pageNum)
-		pageNum++
-		for _, value := range page.Contents {
-			size := *value.Size
-			totalSize += size
+	total, err := storage.Sum(user.bucket(), user.quotaPrefixes(), user.CompanyID, maxListPages(), func(object StoredObject) {
+		if watched[object.Key] {
+			plan.seen[object.Key] = object
 		}
-		return true //return if we should continue to the next page
 	})
-	return totalSize
+	if err != nil {
+		return nil, err
+	}
+	plan.stored = total - plan.seen[user.objectKey()].Size
+	return plan, nil
 }
 
-//Create the signed url using the company id
-func (user *User) signURLForUser(sess *session.Session) (string, error) {
-	svc := s3.New(sess)
-	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String("rsmachiner-user-code"),
-		Key:    aws.String(user.CompanyID + "/" + user.FileRequest),
-	})
-	str, err := req.Presign(time.Minute * 60 * 24 * 5) //Expire in 5 days
+//Reserve the planned upload against the quota and evict the files planned to make room, the last step before the
+//URL is signed.  The returned reservation is released if eviction or signing then fails.  Nothing is reserved for
+//operations other than uploads or bypassed quotas
+func (user *User) reserveUpload(clients *awsClients) (*reservation, error) {
+	plan := user.quota
+	if plan == nil {
+		return nil, nil
+	}
+	reserved, err := user.reserveUsage(clients.dynamo, plan, plan.stored)
+	if err != nil {
+		return nil, err
+	}
+	err = user.evict(clients.storage, plan.evict)
 	if err != nil {
-		return "", err
+		reserved.release()
+		return nil, err
 	}
-	return str, nil
+	user.usage = newUsage(plan.stored+int64(user.FileSize), plan.tier.MaxStorage) //Checked for overflow with the plan
+	return reserved, nil
 }
 
-//Entrypoint lambda to run code
-func main() {
-	switch os.Getenv("PLATFORM") {
+//calculate the total space in bytes a user/company is using, bounded by MAX_LIST_PAGES when set.
+//No delimiter is used so objects in every folder under the company prefix count towards the quota, along with
+//the objects under the company's additional prefixes
+func (user *User) calculateObjectSize(storage StorageBackend) (int64, error) {
+	return storage.Sum(user.bucket(), user.quotaPrefixes(), user.CompanyID, maxListPages(), nil)
+}
+
+//The most ListObjects pages a company's files may take to list, MAX_LIST_PAGES, unbounded when unset
+func maxListPages() int {
+	return envInt("MAX_LIST_PAGES", 0)
+}
+
+//The prefixes whose objects count towards the company's quota, the company prefix and any additional prefixes
+//from the company record.  An empty prefix would count the whole bucket so it is skipped
+func (user *User) quotaPrefixes() []string {
+	prefixes := []string{user.companyPrefix()}
+	for _, prefix := range user.additionalPrefixes {
+		if prefix == "" {
+			user.log.Println("Skipping empty additional prefix for " + user.CompanyID)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+//The x-amz-request-payer header value to sign when the bucket has Requester Pays enabled via REQUESTER_PAYS
+func requestPayer() *string {
+	if envBool("REQUESTER_PAYS", false) {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
+//The requested operation, defaulting to an upload
+func (user *User) operation() string {
+	if user.Operation == "" {
+		return operationUpload
+	}
+	return user.Operation
+}
+
+//The prefix every key for the company is stored under, led by the company's key hash when enabled.  Trailing
+//slashes on the company id are trimmed so an id stored as "acme/" doesn't produce "acme//" keys
+func (user *User) companyPrefix() string {
+	companyID := strings.TrimRight(user.CompanyID, "/")
+	if hash := keyHash(companyID); hash != "" {
+		return hash + "/" + companyID + "/"
+	}
+	return companyID + "/"
+}
+
+//Whether the operation changes stored files, which READ_ONLY refuses.  Verifying an upload deletes it when it takes
+//the company over its quota
+func (user *User) writes() bool {
+	switch user.operation() {
+	case operationUpload, operationDelete, operationTag, operationVerify:
+		return true
+	}
+	return false
+}
+
+//The object key for the requested file under the company prefix
+func (user *User) objectKey() string {
+	return user.companyPrefix() + user.FileRequest
+}
+
+//The bucket the user's files are stored in, selected by service tier
+func (user *User) bucket() string {
+	return tierFor(user.ServiceTier).bucket(user.config.Bucket)
+}
+
+//Create the signed url using the company id, downloads going through CloudFront when it is configured and
+//everything else through the storage backend
+func (user *User) signURLForUser(clients *awsClients) (*URLSign, error) {
+	if user.operation() == operationDownload && clients.cdnSigner != nil {
+		signed, err := user.cloudFrontURL(clients.cdnSigner, clampExpiry(user.log, user.urlExpiry()))
+		if err != nil {
+			return nil, err
+		}
+		err = requireHTTPS(signed.URL)
+		if err != nil {
+			return nil, err
+		}
+		return signed, nil
+	}
+	if user.operation() == operationDelete {
+		trash, err := user.moveToTrash(clients.storage)
+		if err != nil {
+			return nil, err
+		}
+		user.trashedTo = trash
+	}
+	return clients.storage.Presign(user)
+}
+
+//Presign the S3 request for the user's operation
+func (user *User) presignS3(clients *awsClients) (*URLSign, error) {
+	svc, creds := clients.presigner, clients.s3Credentials
+	if user.sourceIP != "" {
+		var err error
+		svc, creds, err = clients.restrictedPresigner(user.sourceIP)
+		if err != nil {
+			return nil, fmt.Errorf("creating source restricted presigner: %w", err)
+		}
+	}
+	var req *request.Request
+	var err error
+	switch user.operation() {
+	case operationUpload:
+		req, err = user.uploadRequest(svc)
+	case operationDownload:
+		req, err = user.downloadRequest(svc)
+	case operationHead:
+		req, err = user.headRequest(svc)
+	case operationDelete:
+		req, err = user.deleteRequest(svc)
+	case operationTag:
+		req, err = user.taggingRequest(svc)
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %s", ErrInvalidRequest, user.Operation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.operation() != operationTag { //Already built with them
+		user.addQueryParameters(req)
+	}
+	expiry := user.presignExpiry(creds)
+	str, headers, err := req.PresignRequest(expiry)
+	if err != nil {
+		return nil, fmt.Errorf("presigning %s for %s: %w", user.operation(), user.objectKey(), err)
+	}
+	err = requireHTTPS(str)
+	if err != nil {
+		return nil, err
+	}
+	signed := &URLSign{URL: str, Method: req.HTTPRequest.Method, AlternateURLs: alternateURLs(str)}
+	signed.setExpiry(presignedAt(str), expiry)
+	if user.operation() == operationTag {
+		body, err := ioutil.ReadAll(req.GetBody())
+		if err != nil {
+			return nil, fmt.Errorf("reading tagging body for %s: %w", user.objectKey(), err)
+		}
+		signed.Body = string(body)
+	}
+	if len(headers) > 0 { //Signed headers the SDK doesn't move into the query string, without them S3 rejects the signature
+		signed.RequiredHeaders = map[string]string{}
+		for name, values := range headers { //Keyed by the lowercase signed name, which Get would canonicalize
+			signed.RequiredHeaders[name] = strings.Join(values, ",")
+		}
+	}
+	return signed, nil
+}
+
+//Signed URLs carry credentials for their lifetime so they must never be handed out over plain HTTP.
+//ALLOW_INSECURE_ENDPOINT permits an http S3_ENDPOINT for local testing
+func requireHTTPS(signed string) error {
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		return fmt.Errorf("parsing signed URL: %w", err)
+	}
+	if parsed.Scheme == "https" || envBool("ALLOW_INSECURE_ENDPOINT", false) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInsecureEndpoint, parsed.Host)
+}
+
+//Build the PutObject request for an upload
+func (user *User) uploadRequest(svc s3iface.S3API) (*request.Request, error) {
+	input := &s3.PutObjectInput{
+		Bucket:              aws.String(user.bucket()),
+		Key:                 aws.String(user.objectKey()),
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: user.config.expectedBucketOwner(),
+	}
+	if user.ObjectLockMode != "" { //Retention was checked in Validate and verifyUserGrants
+		input.ObjectLockMode = aws.String(user.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = user.ObjectLockRetainUntil
+	}
+	if user.StorageClass != "" {
+		input.StorageClass = aws.String(user.StorageClass)
+	}
+	if user.PublicRead { //The tier was checked in verifyUserGrants
+		input.ACL = aws.String(s3.ObjectCannedACLPublicRead)
+	}
+	if user.DownloadFilename != "" { //Later downloads present the filename without having to ask for it
+		input.ContentDisposition = aws.String(contentDisposition(user.DownloadFilename))
+	}
+	applyEncryption(input, user.config.SSEKMSKeyID)
+	if contentType := user.uploadContentType(); contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	user.applyChecksum(input)
+	req, _ := svc.PutObjectRequest(input)
+	return req, nil
+}
+
+//The content type signed into an upload, DEFAULT_CONTENT_TYPE when the request doesn't declare one
+func (user *User) uploadContentType() string {
+	if user.ContentType != "" {
+		return user.ContentType
+	}
+	return os.Getenv("DEFAULT_CONTENT_TYPE")
+}
+
+//Build the GetObject request for a download
+func (user *User) downloadRequest(svc s3iface.S3API) (*request.Request, error) {
+	input := &s3.GetObjectInput{
+		Bucket:              aws.String(user.bucket()),
+		Key:                 aws.String(user.objectKey()),
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: user.config.expectedBucketOwner(),
+	}
+	if user.DownloadFilename != "" {
+		input.ResponseContentDisposition = aws.String(contentDisposition(user.DownloadFilename))
+	}
+	if user.DownloadContentType != "" {
+		input.ResponseContentType = aws.String(user.DownloadContentType)
+	}
+	if user.VersionID != "" {
+		input.VersionId = aws.String(user.VersionID)
+	}
+	req, _ := svc.GetObjectRequest(input)
+	return req, nil
+}
+
+//Build the HeadObject request for checking a file's metadata without downloading it
+func (user *User) headRequest(svc s3iface.S3API) (*request.Request, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:              aws.String(user.bucket()),
+		Key:                 aws.String(user.objectKey()),
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: user.config.expectedBucketOwner(),
+	}
+	if user.VersionID != "" {
+		input.VersionId = aws.String(user.VersionID)
+	}
+	req, _ := svc.HeadObjectRequest(input)
+	return req, nil
+}
+
+//Build the DeleteObject request for a delete
+func (user *User) deleteRequest(svc s3iface.S3API) (*request.Request, error) {
+	req, _ := svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket:              aws.String(user.bucket()),
+		Key:                 aws.String(user.objectKey()),
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: user.config.expectedBucketOwner(),
+	})
+	return req, nil
+}
+
+//The attachment Content-Disposition presenting the given filename, empty if the filename can't be encoded
+func contentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+//Start the handler for the configured platform, an unknown platform is a misconfiguration
+func run(config *Config) error {
+	h := &handler{config: config}
+	switch config.Platform {
 	case "lambda":
-		lambda.Start(HandleRequest)
+		lambda.Start(h.HandleEvent)
+		return nil
+	case "http":
+		return h.serveHTTP()
 	default:
-		log.Println("no platform defined")
+		return fmt.Errorf("no platform defined: %q", config.Platform)
+	}
+}
+
+//Entrypoint lambda to run code
+func main() {
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	err = initTelemetry(context.Background())
+	if err != nil {
+		log.Println("Unable to start OpenTelemetry export, continuing without it: " + err.Error())
+	}
+	parameters.awsConfig = config.awsConfig()
+	warmUpClients(config)
+	err = run(config)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 }
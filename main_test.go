@@ -0,0 +1,1209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestApplyCompanyBilling(t *testing.T) {
+	paidUntil := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		table     string
+		company   *Company
+		wantTier  int
+		wantPayed bool
+	}{
+		{"no company table", "", &Company{CompanyID: "acme", ServiceTier: 2, Payed: true}, 1, false},
+		{"no company record", "companies", nil, 1, false},
+		{"company record", "companies", &Company{CompanyID: "acme", ServiceTier: 2, Payed: true}, 2, true},
+		{"unpaid company", "companies", &Company{CompanyID: "acme", ServiceTier: 2}, 2, false},
+		{"company paid until", "companies", &Company{CompanyID: "acme", ServiceTier: 2, PaidUntil: &paidUntil}, 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDynamo()
+			if test.company != nil {
+				db.put("companies", test.company)
+			}
+			user := newTestUser()
+			user.config.CompanyTable = test.table
+			user.ServiceTier = 1
+			if err := user.applyCompanyBilling(db); err != nil {
+				t.Fatalf("applyCompanyBilling() error = %v", err)
+			}
+			if paid := user.isPaid(time.Now()); user.ServiceTier != test.wantTier || paid != test.wantPayed {
+				t.Errorf("tier %d paid %v, want tier %d paid %v", user.ServiceTier, paid, test.wantTier, test.wantPayed)
+			}
+		})
+	}
+}
+
+//The company's negotiated expiry replaces the user's, a company without one leaves the user's in place
+func TestApplyCompanyBillingExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		company int
+		want    int
+	}{
+		{"company expiry", 600, 600},
+		{"no company expiry", 0, 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDynamo()
+			db.put("companies", &Company{CompanyID: "acme", ServiceTier: 1, URLExpirySeconds: test.company})
+			user := newTestUser()
+			user.config.CompanyTable = "companies"
+			user.URLExpirySeconds = 60
+			if err := user.applyCompanyBilling(db); err != nil {
+				t.Fatalf("applyCompanyBilling() error = %v", err)
+			}
+			if user.URLExpirySeconds != test.want {
+				t.Errorf("URLExpirySeconds = %d, want %d", user.URLExpirySeconds, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyCompanyBillingFailure(t *testing.T) {
+	db := newFakeDynamo()
+	db.getErr = errors.New("unavailable")
+	user := newTestUser()
+	user.config.CompanyTable = "companies"
+	if err := user.applyCompanyBilling(db); err == nil || !strings.Contains(err.Error(), "getting company acme") {
+		t.Errorf("applyCompanyBilling() error = %v, want the company read failure", err)
+	}
+}
+
+//DynamoDB holding the user record of newTestUser on the tier
+func newUserTable(tier int, payed bool) *fakeDynamo {
+	db := newFakeDynamo()
+	db.put("users", User{Sub: "sub-1", CompanyID: "acme", ServiceTier: tier, Payed: payed})
+	return db
+}
+
+func TestValidateUser(t *testing.T) {
+	svc := newFakeS3()
+	svc.pages = [][]*s3.Object{{s3Object("acme/old.bin", 900)}}
+	user := &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, Sub: "sub-1", FileRequest: "file.txt", FileSize: 100}
+	valid, err := user.validateUser(withS3Storage(&awsClients{dynamo: newUserTable(1, true), lister: svc}))
+	if !valid || err != nil {
+		t.Fatalf("validateUser() = %v, %v", valid, err)
+	}
+	if user.CompanyID != "acme" || user.ServiceTier != 1 || !user.Payed {
+		t.Errorf("user %+v, want the stored company, tier and paid status", user)
+	}
+	if len(svc.listed) != 1 || svc.listed[0] != "acme/" {
+		t.Errorf("listed %v, want the acme prefix", svc.listed)
+	}
+}
+
+//Only the stored record can negotiate the URL expiry, a request claiming one has it replaced
+func TestValidateUserURLExpiryFromRecord(t *testing.T) {
+	db := newFakeDynamo()
+	db.put("users", User{Sub: "sub-1", CompanyID: "acme", ServiceTier: 1, Payed: true, URLExpirySeconds: 300})
+	user := &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, Sub: "sub-1", FileRequest: "file.txt", Operation: operationDownload, URLExpirySeconds: 604800}
+	if _, err := user.validateUser(withS3Storage(&awsClients{dynamo: db})); err != nil {
+		t.Fatalf("validateUser() error = %v", err)
+	}
+	if user.URLExpirySeconds != 300 {
+		t.Errorf("URLExpirySeconds = %d, want the stored 300", user.URLExpirySeconds)
+	}
+}
+
+func TestValidateUserErrors(t *testing.T) {
+	lapsed := newFakeDynamo()
+	paidUntil := time.Now().Add(-time.Hour * 24 * 4)
+	lapsed.put("users", User{Sub: "sub-1", CompanyID: "acme", ServiceTier: 1, Payed: true, PaidUntil: &paidUntil})
+	tests := []struct {
+		name    string
+		db      *fakeDynamo
+		stored  int64
+		wantErr error
+	}{
+		{"user not found", newFakeDynamo(), 0, ErrUserNotFound},
+		{"not paid", newUserTable(freeTier, false), 0, ErrNotPaid},
+		{"subscription lapsed past the grace period", lapsed, 0, ErrNotPaid},
+		{"over quota", newUserTable(1, true), 40000000000, ErrQuotaExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("PAID_GRACE_PERIOD", "")
+			captureLog(t)
+			svc := newFakeS3()
+			svc.pages = [][]*s3.Object{{s3Object("acme/big.bin", test.stored)}}
+			user := &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, Sub: "sub-1", FileRequest: "file.txt", FileSize: 100}
+			valid, err := user.validateUser(withS3Storage(&awsClients{dynamo: test.db, lister: svc}))
+			if valid || !errors.Is(err, test.wantErr) {
+				t.Errorf("validateUser() = %v, %v, want %v", valid, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUserAWSFailure(t *testing.T) {
+	db := newFakeDynamo()
+	db.getErr = errors.New("unavailable")
+	user := &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, Sub: "sub-1"}
+	_, err := user.validateUser(withS3Storage(&awsClients{dynamo: db}))
+	if err == nil || !strings.Contains(err.Error(), "getting user sub-1") || statusCodeFor(err) != http.StatusInternalServerError {
+		t.Errorf("validateUser() error = %v, want the wrapped read failure as a 500", err)
+	}
+}
+
+func TestCalculateObjectSize(t *testing.T) {
+	pages := [][]*s3.Object{
+		{s3Object("acme/a", 1), s3Object("acme/b", 2)},
+		{s3Object("acme/c", 3), s3Object("acme/photos/d", 4)},
+		{s3Object("acme/photos/2024/e", 5)},
+	}
+	tests := []struct {
+		name     string
+		maxPages string
+		want     int64
+		wantErr  error
+	}{
+		{"unbounded, counting every folder", "", 15, nil},
+		{"limit past the listing", "5", 15, nil},
+		{"limit on the last page", "3", 15, nil},
+		{"limit reached", "2", 0, ErrListingLimitExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_LIST_PAGES", test.maxPages)
+			svc := newFakeS3()
+			svc.pages = pages
+			size, err := newTestUser().calculateObjectSize(newS3TestStorage(svc))
+			if size != test.want || !errors.Is(err, test.wantErr) {
+				t.Errorf("calculateObjectSize() = %d, %v, want %d, %v", size, err, test.want, test.wantErr)
+			}
+			if svc.grouped {
+				t.Error("listed with a delimiter, want objects in every folder counted")
+			}
+		})
+	}
+}
+
+//Objects under the company's additional prefixes count towards its quota, MAX_LIST_PAGES bounds the pages listed
+//across every prefix
+func TestCalculateObjectSizeAdditionalPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		maxPages string
+		want     int64
+		wantErr  error
+	}{
+		{"company prefix only", nil, "", 1, nil},
+		{"projects", []string{"projects/acme/", "archive/acme/"}, "", 111, nil},
+		{"empty prefix skipped", []string{"", "projects/acme/"}, "", 11, nil},
+		{"limit across prefixes", []string{"projects/acme/", "archive/acme/"}, "2", 0, ErrListingLimitExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_LIST_PAGES", test.maxPages)
+			captureLog(t)
+			svc := newFakeS3()
+			svc.pages = [][]*s3.Object{{s3Object("acme/a", 1), s3Object("projects/acme/b", 10), s3Object("archive/acme/c", 100),
+				s3Object("globex/d", 1000)}}
+			user := newTestUser()
+			user.additionalPrefixes = test.prefixes
+			size, err := user.calculateObjectSize(newS3TestStorage(svc))
+			if size != test.want || !errors.Is(err, test.wantErr) {
+				t.Errorf("calculateObjectSize() = %d, %v, want %d, %v", size, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+//One summary line is logged per calculation, the per-page lines only at debug level
+func TestCalculateObjectSizeLogging(t *testing.T) {
+	tests := []struct {
+		logLevel  string
+		wantPages int
+	}{
+		{"", 0},
+		{"debug", 2},
+	}
+	for _, test := range tests {
+		t.Run("LOG_LEVEL="+test.logLevel, func(t *testing.T) {
+			t.Setenv("LOG_LEVEL", test.logLevel)
+			buf := captureLog(t)
+			svc := newFakeS3()
+			svc.pages = [][]*s3.Object{{s3Object("acme/a", 10)}, {s3Object("acme/b", 5)}}
+			storage := newS3TestStorage(svc)
+			storage.clients.log = testLog(buf, "id", true)
+			if _, err := newTestUser().calculateObjectSize(storage); err != nil {
+				t.Fatalf("calculateObjectSize() error = %v", err)
+			}
+			logged := buf.String()
+			if pages := strings.Count(logged, "PAGE: "); pages != test.wantPages {
+				t.Errorf("logged %d page lines, want %d: %q", pages, test.wantPages, logged)
+			}
+			if strings.Count(logged, "Listed 15 bytes for acme in ") != 1 {
+				t.Errorf("logged %q, want one summary line", logged)
+			}
+		})
+	}
+}
+
+func TestCalculateObjectSizeListingFailure(t *testing.T) {
+	svc := newFakeS3()
+	svc.listErr = s3Error("AccessDenied")
+	_, err := newTestUser().calculateObjectSize(newS3TestStorage(svc))
+	if err == nil || !strings.Contains(err.Error(), "summing objects for acme") {
+		t.Errorf("calculateObjectSize() error = %v, want the listing failure", err)
+	}
+}
+
+func TestDownloadFilenameSigned(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"none", "", ""},
+		{"plain", "report.pdf", "attachment; filename=report.pdf"},
+		{"quoted", "my report.pdf", `attachment; filename="my report.pdf"`},
+		{"non ASCII", "résumé.pdf", "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, CompanyID: "acme", FileRequest: "file.txt", Operation: operationDownload, DownloadFilename: test.filename}
+			signed, query := presignQuery(t, user)
+			if got := query.Get("response-content-disposition"); got != test.want {
+				t.Errorf("URL %s has response-content-disposition %q, want %q", signed.URL, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignUnknownOperation(t *testing.T) {
+	user := &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, CompanyID: "acme", FileRequest: "file.txt", Operation: "rename"}
+	if _, err := user.signURLForUser(withS3Storage(&awsClients{presigner: newFakeS3()})); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("signURLForUser() error = %v, want ErrInvalidRequest", err)
+	}
+}
+
+//An upload's filename is stored with the object, so later downloads present it without asking
+func TestUploadContentDispositionSigned(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"none", "", ""},
+		{"plain", "report.pdf", "attachment; filename=report.pdf"},
+		{"quoted", "my report.pdf", `attachment; filename="my report.pdf"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.DownloadFilename = test.filename
+			signed, query := presignQuery(t, user)
+			if got := signed.RequiredHeaders["content-disposition"]; got != test.want {
+				t.Errorf("required content-disposition = %q, want %q", got, test.want)
+			}
+			signedHeaders := query.Get("X-Amz-SignedHeaders")
+			if strings.Contains(signedHeaders, "content-disposition") != (test.want != "") {
+				t.Errorf("signed headers %q, want content-disposition signed only with a filename", signedHeaders)
+			}
+		})
+	}
+}
+
+func TestExpectedBucketOwnerSigned(t *testing.T) {
+	tests := []struct {
+		operation string
+		owner     string
+	}{
+		{operationUpload, ""},
+		{operationUpload, "123456789012"},
+		{operationDownload, "123456789012"},
+		{operationDelete, "123456789012"},
+	}
+	for _, test := range tests {
+		t.Run(test.operation+" "+test.owner, func(t *testing.T) {
+			user := newTestUser()
+			user.config.BucketOwner = test.owner
+			user.Operation = test.operation
+			signed, query := presignQuery(t, user)
+			if got := signed.RequiredHeaders["x-amz-expected-bucket-owner"]; got != test.owner {
+				t.Errorf("required x-amz-expected-bucket-owner = %q, want %q", got, test.owner)
+			}
+			if strings.Contains(query.Get("X-Amz-SignedHeaders"), "x-amz-expected-bucket-owner") != (test.owner != "") {
+				t.Errorf("signed headers %q, want the bucket owner signed only when configured", query.Get("X-Amz-SignedHeaders"))
+			}
+		})
+	}
+}
+
+//Nothing is signed for a bucket outside ALLOWED_BUCKETS, whether it is the default bucket or a tier's own
+func TestValidateUserBucketAllowlist(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		allowed   []string
+		tier1     string
+		wantErr   error
+	}{
+		{"no allowlist", operationUpload, nil, "", nil},
+		{"allowed upload", operationUpload, []string{"bucket"}, "", nil},
+		{"disallowed upload", operationUpload, []string{"other"}, "", ErrBucketNotAllowed},
+		{"disallowed tier bucket", operationUpload, []string{"bucket"}, "elsewhere", ErrBucketNotAllowed},
+		{"disallowed download", operationDownload, []string{"other"}, "", ErrBucketNotAllowed},
+		{"disallowed list", operationList, []string{"other"}, "", ErrBucketNotAllowed},
+		{"disallowed verify", operationVerify, []string{"other"}, "", ErrBucketNotAllowed},
+		{"disallowed delete", operationDelete, []string{"other"}, "", ErrBucketNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TIER_1_BUCKET", test.tier1)
+			storage := &countingStorage{StorageBackend: newMemStorage()}
+			user := newTestUser()
+			user.Operation = test.operation
+			user.config.AllowedBuckets = test.allowed
+			_, err := user.validateUser(&awsClients{dynamo: newUserTable(1, true), storage: storage, log: discardLog})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("validateUser() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil && storage.calls > 0 {
+				t.Errorf("storage was called %d times for a bucket outside the allowlist", storage.calls)
+			}
+		})
+	}
+}
+
+//countingStorage counts the calls reaching the storage backend
+type countingStorage struct {
+	StorageBackend
+	calls int
+}
+
+func (storage *countingStorage) Sum(bucket string, prefixes []string, owner string, maxPages int, fn func(StoredObject)) (int64, error) {
+	storage.calls++
+	return storage.StorageBackend.Sum(bucket, prefixes, owner, maxPages, fn)
+}
+
+func (storage *countingStorage) Each(bucket string, prefixes []string, maxPages int, fn func(object StoredObject) bool) error {
+	storage.calls++
+	return storage.StorageBackend.Each(bucket, prefixes, maxPages, fn)
+}
+
+func (storage *countingStorage) Head(bucket string, key string) (*StoredObject, error) {
+	storage.calls++
+	return storage.StorageBackend.Head(bucket, key)
+}
+
+func TestDownloadContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        string
+		invalid     bool
+	}{
+		{"none", "", "", false},
+		{"type", "application/pdf", "application/pdf", false},
+		{"with parameters", "text/plain; charset=utf-8", "text/plain; charset=utf-8", false},
+		{"no subtype", "pdf", "", true},
+		{"malformed", "text/plain; =", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.Operation = operationDownload
+			user.DownloadContentType = test.contentType
+			err := user.Validate()
+			if test.invalid {
+				if !errors.Is(err, ErrInvalidRequest) {
+					t.Errorf("Validate() error = %v, want an invalid request", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			signed, query := presignQuery(t, user)
+			if got := query.Get("response-content-type"); got != test.want {
+				t.Errorf("URL %s has response-content-type %q, want %q", signed.URL, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUploadStorageClass(t *testing.T) {
+	tests := []struct {
+		name    string
+		class   string
+		invalid bool
+	}{
+		{"default", "", false},
+		{"infrequent access", s3.StorageClassStandardIa, false},
+		{"intelligent tiering", s3.StorageClassIntelligentTiering, false},
+		{"lowercase", "standard_ia", true},
+		{"unknown", "COLD", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.StorageClass = test.class
+			err := user.Validate()
+			if test.invalid {
+				if !errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), "invalid storage class") {
+					t.Errorf("Validate() error = %v, want an invalid storage class", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			signed, _ := presignQuery(t, user)
+			if got := signed.RequiredHeaders["x-amz-storage-class"]; got != test.class {
+				t.Errorf("required x-amz-storage-class = %q, want %q", got, test.class)
+			}
+		})
+	}
+}
+
+func TestRunUnknownPlatform(t *testing.T) {
+	for _, platform := range []string{"", "k8s"} {
+		err := run(&Config{Platform: platform})
+		if err == nil || !strings.Contains(err.Error(), "no platform defined") {
+			t.Errorf("run(%q) error = %v, want no platform defined", platform, err)
+		}
+	}
+}
+
+func TestForcePathStyleSigned(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    string
+	}{
+		{"", "https://bucket.s3.amazonaws.com/acme/file.txt?"},
+		{"true", "https://s3.amazonaws.com/bucket/acme/file.txt?"},
+		{"invalid", "https://bucket.s3.amazonaws.com/acme/file.txt?"},
+	}
+	for _, test := range tests {
+		t.Run(test.setting, func(t *testing.T) {
+			t.Setenv("S3_FORCE_PATH_STYLE", test.setting)
+			signed, _ := presignQuery(t, &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, CompanyID: "acme", FileRequest: "file.txt"})
+			if !strings.HasPrefix(signed.URL, test.want) {
+				t.Errorf("URL %s, want it to start %s", signed.URL, test.want)
+			}
+		})
+	}
+}
+
+func TestRequesterPaysSigned(t *testing.T) {
+	for _, requesterPays := range []bool{false, true} {
+		for _, operation := range []string{operationUpload, operationDownload, operationHead, operationDelete} {
+			t.Run(fmt.Sprintf("%s requester pays %v", operation, requesterPays), func(t *testing.T) {
+				t.Setenv("REQUESTER_PAYS", strconv.FormatBool(requesterPays))
+				user := newTestUser()
+				user.Operation = operation
+				signed, query := presignQuery(t, user)
+				want := ""
+				if requesterPays {
+					want = "requester"
+				}
+				if got := signed.RequiredHeaders["x-amz-request-payer"]; got != want {
+					t.Errorf("required x-amz-request-payer = %q, want %q", got, want)
+				}
+				if signedHeaders := query.Get("X-Amz-SignedHeaders"); strings.Contains(signedHeaders, "x-amz-request-payer") != requesterPays {
+					t.Errorf("signed headers %s, want x-amz-request-payer signed %v", signedHeaders, requesterPays)
+				}
+			})
+		}
+	}
+}
+
+//A handler over fake AWS clients holding newTestUser's paid record on the tier, with its logs captured
+func newTestHandler(t *testing.T, tier int) (*handler, *awsClients) {
+	t.Helper()
+	captureLog(t)
+	svc := newFakeS3()
+	clients := withS3Storage(&awsClients{dynamo: newUserTable(tier, true), lister: svc, presigner: svc, kms: fakeKMS{}})
+	stubAWSClients(t, clients)
+	return &handler{config: &Config{Bucket: "bucket", DynamoTable: "users"}}, clients
+}
+
+//POST the body to the handler
+func post(t *testing.T, h *handler, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	return handle(t, h, events.APIGatewayProxyRequest{HTTPMethod: "POST", Body: body})
+}
+
+//Run the event through HandleRequest, which never returns an error to Lambda
+func handle(t *testing.T, h *handler, event events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	t.Helper()
+	response, err := h.HandleRequest(context.Background(), event)
+	if err != nil {
+		t.Fatalf("HandleRequest() error = %v", err)
+	}
+	return response
+}
+
+//The error body of the response
+func errorOf(t *testing.T, response events.APIGatewayProxyResponse) ErrorBody {
+	t.Helper()
+	var body ErrorBody
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("error body %s is not JSON: %v", response.Body, err)
+	}
+	return body
+}
+
+func TestHandleRequestSigns(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantMethod string
+	}{
+		{"upload", `{"sub":"sub-1","file_request":"file.txt","file_size":100}`, "PUT"},
+		{"download", `{"sub":"sub-1","file_request":"file.txt","operation":"download"}`, "GET"},
+		{"head", `{"sub":"sub-1","file_request":"file.txt","operation":"head"}`, "HEAD"},
+		{"delete", `{"sub":"sub-1","file_request":"file.txt","operation":"delete"}`, "DELETE"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, 1)
+			response := post(t, h, test.body)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", response.StatusCode, response.Body)
+			}
+			var signed URLSign
+			if err := json.Unmarshal([]byte(response.Body), &signed); err != nil {
+				t.Fatalf("body %s is not a URLSign: %v", response.Body, err)
+			}
+			if !strings.HasPrefix(signed.URL, "https://bucket.s3.amazonaws.com/acme/file.txt?") || signed.Method != test.wantMethod {
+				t.Errorf("signed %s %s, want %s acme/file.txt", signed.Method, signed.URL, test.wantMethod)
+			}
+			if response.Headers[correlationHeader] == "" || response.Headers["Access-Control-Allow-Origin"] != "*" {
+				t.Errorf("headers = %v, want the CORS and correlation headers", response.Headers)
+			}
+		})
+	}
+}
+
+func TestHandleRequestUploadUsage(t *testing.T) {
+	t.Setenv("TRACK_OVERWRITES", "")
+	h, clients := newTestHandler(t, 1)
+	clients.presigner.(*fakeS3).pages = [][]*s3.Object{{s3Object("acme/old.txt", 900)}}
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	var signed URLSign
+	if err := json.Unmarshal([]byte(response.Body), &signed); err != nil {
+		t.Fatalf("body %s is not a URLSign: %v", response.Body, err)
+	}
+	if signed.FileRequest != "file.txt" || signed.Usage == nil || signed.Usage.UsedBytes != 1000 {
+		t.Fatalf("signed %+v, want file.txt with 1000 bytes used", signed)
+	}
+	if want := newUsage(1000, tierFor(1).MaxStorage); *signed.Usage != *want {
+		t.Errorf("usage %+v, want %+v against the pro tier's limit", signed.Usage, want)
+	}
+	response = post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download"}`)
+	if strings.Contains(response.Body, `"usage"`) {
+		t.Errorf("download body %s, want no usage without a quota check", response.Body)
+	}
+}
+
+func TestHandleRequestMethods(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"OPTIONS", http.StatusNoContent, ""},
+		{"GET", http.StatusMethodNotAllowed, "POST, OPTIONS"},
+		{"PUT", http.StatusMethodNotAllowed, "POST, OPTIONS"},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			h, _ := newTestHandler(t, 1)
+			response, err := h.HandleRequest(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: test.method})
+			if err != nil {
+				t.Fatalf("HandleRequest() error = %v", err)
+			}
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode, test.wantStatus)
+			}
+			if allow := response.Headers["Allow"]; allow != test.wantAllow {
+				t.Errorf("Allow = %q, want %q", allow, test.wantAllow)
+			}
+			if test.wantAllow != "" && errorOf(t, response).Code != codeMethodNotAllowed {
+				t.Errorf("body %s, want the %s code", response.Body, codeMethodNotAllowed)
+			}
+		})
+	}
+}
+
+func TestHandleRequestVerify(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	clients.presigner.(*fakeS3).head = &s3.HeadObjectOutput{ContentLength: aws.Int64(80)}
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100,"operation":"verify"}`)
+	var verification UploadVerification
+	if err := json.Unmarshal([]byte(response.Body), &verification); err != nil {
+		t.Fatalf("body %s is not an UploadVerification: %v", response.Body, err)
+	}
+	if response.StatusCode != http.StatusOK || !verification.Verified || verification.Key != "acme/file.txt" || verification.Size != 80 {
+		t.Errorf("verified %d %s, want acme/file.txt verified at 80 bytes", response.StatusCode, response.Body)
+	}
+}
+
+func TestHandleRequestFailures(t *testing.T) {
+	unpaid := func(db *fakeDynamo, svc *fakeS3) {
+		db.put("users", User{Sub: "sub-unpaid", CompanyID: "acme", ServiceTier: 1})
+	}
+	full := func(db *fakeDynamo, svc *fakeS3) {
+		svc.pages = [][]*s3.Object{{s3Object("acme/big", 40000000000)}}
+	}
+	tests := []struct {
+		name        string
+		body        string
+		setup       func(db *fakeDynamo, svc *fakeS3)
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{"invalid JSON", `{"sub":`, nil, 400, codeInvalidRequest, ErrInvalidRequest.Error()},
+		{"missing sub", `{"file_request":"file.txt"}`, nil, 400, codeInvalidRequest, "sub is required"},
+		{"unknown operation", `{"sub":"sub-1","file_request":"f","operation":"rename"}`, nil, 400, codeInvalidRequest, "unknown operation rename"},
+		{"escaping file", `{"sub":"sub-1","file_request":"../globex/file.txt"}`, nil, 400, codeInvalidFilename, "must not start with / or contain . or .. segments"},
+		{"every problem reported", `{"file_size":-1}`, nil, 400, codeInvalidRequest, "sub is required; file_request is required; file_size must not be negative"},
+		{"company override", `{"sub":"sub-1","file_request":"f","company_id":"globex"}`, nil, 403, codeForbidden, "company_id may only be set by admins"},
+		{"larger than any tier", `{"sub":"sub-1","file_request":"f","file_size":2000000000000}`, nil, 413, codeFileTooLarge, ErrFileTooLarge.Error()},
+		{"user not found", `{"sub":"nobody","file_request":"f"}`, nil, 404, codeUserNotFound, ErrUserNotFound.Error()},
+		{"unpaid", `{"sub":"sub-unpaid","file_request":"f"}`, unpaid, 402, codeUnpaid, ErrNotPaid.Error()},
+		{"over quota", `{"sub":"sub-1","file_request":"f","file_size":100}`, full, 403, codeQuotaExceeded, ErrQuotaExceeded.Error()},
+		{"invalid content type", `{"sub":"sub-1","file_request":"f","content_type":"png"}`, nil, 400, codeInvalidRequest, "invalid content type png"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, clients := newTestHandler(t, 1)
+			if test.setup != nil {
+				test.setup(clients.dynamo.(*fakeDynamo), clients.presigner.(*fakeS3))
+			}
+			response := post(t, h, test.body)
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+			body := errorOf(t, response)
+			if body.Code != test.wantCode || !strings.Contains(body.Message, test.wantMessage) {
+				t.Errorf("error = %+v, want %s reporting %q", body, test.wantCode, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestHandleRequestClientsFailure(t *testing.T) {
+	previous := newAWSClients
+	newAWSClients = func(config *Config) (*awsClients, error) { return nil, errors.New("no region") }
+	t.Cleanup(func() { newAWSClients = previous })
+	captureLog(t)
+	h := &handler{config: &Config{Bucket: "bucket", DynamoTable: "users"}}
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt"}`)
+	if response.StatusCode != http.StatusInternalServerError || !strings.Contains(response.Body, "creating AWS clients") {
+		t.Errorf("response %d %q, want the client failure as a 500", response.StatusCode, response.Body)
+	}
+}
+
+func TestUploadContentTypeSigned(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultType string
+		contentType string
+		wantSigned  bool
+	}{
+		{"none", "", "", false},
+		{"default", "application/octet-stream", "", true},
+		{"declared", "", "image/png", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_CONTENT_TYPE", test.defaultType)
+			user := newTestUser()
+			user.ContentType = test.contentType
+			_, query := presignQuery(t, user)
+			if signedHeaders := query.Get("X-Amz-SignedHeaders"); strings.Contains(signedHeaders, "content-type") != test.wantSigned {
+				t.Errorf("signed headers %s, want content-type signed %v", signedHeaders, test.wantSigned)
+			}
+		})
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	t.Setenv("DEFAULT_CONTENT_TYPE", "application/octet-stream")
+	user := newTestUser()
+	if got := user.uploadContentType(); got != "application/octet-stream" {
+		t.Errorf("uploadContentType() = %q, want the default", got)
+	}
+	user.ContentType = "image/png"
+	if got := user.uploadContentType(); got != "image/png" {
+		t.Errorf("uploadContentType() = %q, want the declared type", got)
+	}
+}
+
+//Only the tiers TIER_<n>_ALLOWED_CONTENT_TYPES restricts reject the upload's content type
+func TestHandleRequestTierContentTypes(t *testing.T) {
+	t.Setenv("TIER_1_ALLOWED_CONTENT_TYPES", "")
+	tests := []struct {
+		name        string
+		tier        int
+		allowed     string
+		defaultType string
+		contentType string
+		wantStatus  int
+	}{
+		{"restricted tier image", freeTier, "image/*", "", "image/png", http.StatusOK},
+		{"restricted tier document", freeTier, "image/*", "", "application/pdf", http.StatusBadRequest},
+		{"restricted tier undeclared", freeTier, "image/*", "", "", http.StatusBadRequest},
+		{"restricted tier default image", freeTier, "image/*", "image/jpeg", "", http.StatusOK},
+		{"free tier unrestricted by default", freeTier, "", "", "application/pdf", http.StatusOK},
+		{"unrestricted tier document", 1, "image/*", "", "application/pdf", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TIER_0_ALLOWED_CONTENT_TYPES", test.allowed)
+			t.Setenv("DEFAULT_CONTENT_TYPE", test.defaultType)
+			h, _ := newTestHandler(t, test.tier)
+			body := fmt.Sprintf(`{"sub":"sub-1","file_request":"f","file_size":100,"content_type":%q}`, test.contentType)
+			response := post(t, h, body)
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+			if test.wantStatus == http.StatusBadRequest && !strings.Contains(response.Body, "allowed types are image/*") {
+				t.Errorf("body %s, want the allowed types reported", response.Body)
+			}
+		})
+	}
+}
+
+func TestHandleRequestTracksOverwrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		track   string
+		head    *s3.HeadObjectOutput
+		headErr error
+		wantPre string
+	}{
+		{"not tracked", "", &s3.HeadObjectOutput{VersionId: aws.String("v1")}, nil, ""},
+		{"nothing to overwrite", "true", nil, s3Error("NotFound"), ""},
+		{"versioned object", "true", &s3.HeadObjectOutput{VersionId: aws.String("v1")}, nil, "v1"},
+		{"unversioned object", "true", &s3.HeadObjectOutput{}, nil, "null"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TRACK_OVERWRITES", test.track)
+			h, clients := newTestHandler(t, 1)
+			clients.presigner.(*fakeS3).head, clients.presigner.(*fakeS3).headErr = test.head, test.headErr
+			response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+			var signed URLSign
+			if err := json.Unmarshal([]byte(response.Body), &signed); err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s, want a signed URL", response.StatusCode, response.Body)
+			}
+			if signed.PreviousVersionID != test.wantPre {
+				t.Errorf("previous_version_id = %q, want %q", signed.PreviousVersionID, test.wantPre)
+			}
+		})
+	}
+}
+
+func TestHandleRequestTrackOverwritesFailure(t *testing.T) {
+	t.Setenv("TRACK_OVERWRITES", "true")
+	h, clients := newTestHandler(t, 1)
+	clients.presigner.(*fakeS3).headErr = s3Error("AccessDenied")
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	if response.StatusCode != http.StatusInternalServerError || !strings.Contains(response.Body, "getting object acme/file.txt") {
+		t.Errorf("response %d %s, want the lookup failure as a 500", response.StatusCode, response.Body)
+	}
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		insecure string
+		wantErr  error
+	}{
+		{"default endpoint", "", "", nil},
+		{"https endpoint", "https://minio.example.com", "", nil},
+		{"http endpoint", "http://minio.example.com", "", ErrInsecureEndpoint},
+		{"http endpoint allowed for testing", "http://localhost:9000", "true", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ALLOW_INSECURE_ENDPOINT", test.insecure)
+			signed, err := newTestUser().signURLForUser(withS3Storage(&awsClients{presigner: newS3Client(newTestSession(), test.endpoint, "", signingRoleSettings)}))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("signURLForUser() = %v, %v, want %v", signed, err, test.wantErr)
+			}
+			if err != nil && statusCodeFor(err) != http.StatusInternalServerError {
+				t.Errorf("status for %v = %d, want a 500 for the misconfigured endpoint", err, statusCodeFor(err))
+			}
+		})
+	}
+}
+
+func TestVerifyUserGrantsBypassQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		bypass  bool
+		wantErr error
+	}{
+		{"over quota", false, ErrQuotaExceeded},
+		{"bypassed", true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := captureLog(t)
+			svc := newFakeS3()
+			svc.pages = [][]*s3.Object{{s3Object("acme/big", 10000000)}}
+			user := newTestUser()
+			user.ContentType = "image/png"
+			user.BypassQuota = test.bypass
+			user.log = testLog(buf, "id", true)
+			_, err := user.verifyUserGrants(withS3Storage(&awsClients{lister: svc}))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("verifyUserGrants() error = %v, want %v", err, test.wantErr)
+			}
+			if warned := strings.Contains(buf.String(), "WARNING: QUOTA BYPASSED for sub-1 in company acme"); warned != test.bypass {
+				t.Errorf("logged %q, want the bypass warned %v", buf.String(), test.bypass)
+			}
+		})
+	}
+}
+
+//Only the stored record can bypass the quota, a request claiming it is still checked
+func TestHandleRequestBypassQuotaFromRecord(t *testing.T) {
+	t.Setenv("TRACK_OVERWRITES", "")
+	h, clients := newTestHandler(t, 1)
+	clients.presigner.(*fakeS3).pages = [][]*s3.Object{{s3Object("acme/big", 40000000000)}}
+	body := `{"sub":"sub-1","file_request":"file.txt","file_size":100,"bypass_quota":true}`
+	if response := post(t, h, body); response.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want the quota checked: %s", response.StatusCode, response.Body)
+	}
+	db := newFakeDynamo()
+	db.put("users", User{Sub: "sub-1", CompanyID: "acme", ServiceTier: 1, Payed: true, BypassQuota: true})
+	clients.dynamo = db
+	if response := post(t, h, body); response.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want the stored bypass honoured: %s", response.StatusCode, response.Body)
+	}
+}
+
+func TestFreeTierRequiresPaid(t *testing.T) {
+	tests := []struct {
+		name       string
+		setting    string
+		tier       int
+		wantStatus int
+	}{
+		{"free tier by default", "", freeTier, http.StatusPaymentRequired},
+		{"free tier allowed unpaid", "false", freeTier, http.StatusOK},
+		{"paid tier always", "false", 1, http.StatusPaymentRequired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("FREE_TIER_REQUIRES_PAID", test.setting)
+			h, clients := newTestHandler(t, test.tier)
+			clients.dynamo.(*fakeDynamo).put("users", User{Sub: "sub-unpaid", CompanyID: "acme", ServiceTier: test.tier})
+			response := post(t, h, `{"sub":"sub-unpaid","file_request":"file.png","file_size":100,"content_type":"image/png"}`)
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+		})
+	}
+}
+
+func TestVersionIDSigned(t *testing.T) {
+	tests := []struct {
+		operation string
+		version   string
+		want      string
+	}{
+		{operationDownload, "", ""},
+		{operationDownload, "3HL4kqtJlcpXroDTDmJ.rmSpXd3dIbrHY", "3HL4kqtJlcpXroDTDmJ.rmSpXd3dIbrHY"},
+		{operationUpload, "v2", ""},
+		{operationHead, "v2", "v2"},
+	}
+	for _, test := range tests {
+		t.Run(test.operation+" "+test.version, func(t *testing.T) {
+			user := newTestUser()
+			user.Operation = test.operation
+			user.VersionID = test.version
+			signed, query := presignQuery(t, user)
+			if got := query.Get("versionId"); got != test.want {
+				t.Errorf("URL %s has versionId %q, want %q", signed.URL, got, test.want)
+			}
+		})
+	}
+}
+
+//A URL_EXPIRY past the SigV4 maximum is signed with the maximum rather than failing to presign
+func TestURLExpiryClampedSigned(t *testing.T) {
+	captureLog(t)
+	t.Setenv("URL_EXPIRY", "720h")
+	signed, query := presignQuery(t, &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, CompanyID: "acme", FileRequest: "file.txt", ServiceTier: 1})
+	if got := query.Get("X-Amz-Expires"); got != "604800" {
+		t.Errorf("URL %s expires in %s seconds, want the 604800 maximum", signed.URL, got)
+	}
+}
+
+//panickingS3 panics signing every download
+type panickingS3 struct {
+	s3iface.S3API
+}
+
+func (svc panickingS3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	panic("nil map")
+}
+
+func TestHandleRequestRecoversPanic(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	logged := captureLog(t)
+	clients.presigner = panickingS3{clients.presigner}
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download"}`)
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("response %d %s, want a 500", response.StatusCode, response.Body)
+	}
+	if body := errorOf(t, response); body.Code != codeInternal || strings.Contains(body.Message, "nil map") {
+		t.Errorf("body %s, want an internal error that doesn't leak the panic", response.Body)
+	}
+	if response.Headers[correlationHeader] == "" {
+		t.Errorf("headers = %v, want the correlation ID", response.Headers)
+	}
+	if !strings.Contains(logged.String(), "PANIC: nil map") {
+		t.Errorf("logged %q, want the panic and its stack", logged)
+	}
+}
+
+//Listing for the quota runs on the lister so the presigner's credentials never need s3:ListBucket
+func TestHandleRequestListsWithLister(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	lister := newFakeS3()
+	clients.lister = lister
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", response.StatusCode, response.Body)
+	}
+	if presigner := clients.presigner.(*fakeS3); len(lister.listed) != 1 || len(presigner.listed) != 0 {
+		t.Errorf("lister listed %v and presigner %v, want only the lister used", lister.listed, presigner.listed)
+	}
+}
+
+func TestIsPaidGracePeriod(t *testing.T) {
+	captureLog(t)
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration) *time.Time {
+		paidUntil := now.Add(offset)
+		return &paidUntil
+	}
+	tests := []struct {
+		name      string
+		payed     bool
+		paidUntil *time.Time
+		grace     string
+		want      bool
+	}{
+		{"payed without paid_until", true, nil, "", true},
+		{"unpaid without paid_until", false, nil, "", false},
+		{"paid up", false, at(time.Hour), "", true},
+		{"within the default grace", false, at(-71 * time.Hour), "", true},
+		{"past the default grace", false, at(-73 * time.Hour), "", false},
+		{"paid_until overrides payed", true, at(-73 * time.Hour), "", false},
+		{"within a configured grace", false, at(-6 * 24 * time.Hour), "168h", true},
+		{"no grace", false, at(-time.Minute), "0s", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("PAID_GRACE_PERIOD", test.grace)
+			user := newTestUser()
+			user.Payed = test.payed
+			user.PaidUntil = test.paidUntil
+			if got := user.isPaid(now); got != test.want {
+				t.Errorf("isPaid() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLifecycleExpirationDays(t *testing.T) {
+	tests := []struct {
+		name        string
+		company     int
+		setting     string
+		operation   string
+		wantDays    int
+		wantInReply bool
+	}{
+		{"kept until deleted", 0, "", operationUpload, 0, false},
+		{"bucket default", 0, "30", operationUpload, 30, true},
+		{"company configuration", 7, "30", operationUpload, 7, true},
+		{"downloads don't report it", 7, "30", operationDownload, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LIFECYCLE_EXPIRATION_DAYS", test.setting)
+			h, clients := newTestHandler(t, 1)
+			h.config.CompanyTable = "companies"
+			clients.dynamo.(*fakeDynamo).put("companies", Company{CompanyID: "acme", ServiceTier: 1, Payed: true, ExpirationDays: test.company})
+			response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100,"operation":"`+test.operation+`"}`)
+			var signed URLSign
+			if err := json.Unmarshal([]byte(response.Body), &signed); err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s, want a signed URL", response.StatusCode, response.Body)
+			}
+			if signed.ExpirationDays != test.wantDays || strings.Contains(response.Body, "expiration_days") != test.wantInReply {
+				t.Errorf("body %s, want expiration_days %d", response.Body, test.wantDays)
+			}
+		})
+	}
+}
+
+//Only a file no tier could hold is too large, one that a larger tier could hold is over quota for the user's tier
+func TestHandleRequestFileTooLarge(t *testing.T) {
+	t.Setenv("MAX_SINGLE_PUT_BYTES", "2000000000000")
+	largest := largestTierStorage()
+	tests := []struct {
+		name       string
+		tier       int
+		size       int64
+		wantStatus int
+	}{
+		{"larger than any tier", 2, largest + 1, http.StatusRequestEntityTooLarge},
+		{"over the user's tier", 1, largest, http.StatusForbidden},
+		{"fills the largest tier", 2, largest, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, test.tier)
+			response := post(t, h, fmt.Sprintf(`{"sub":"sub-1","file_request":"file.txt","file_size":%d}`, test.size))
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+		})
+	}
+}
+
+func TestHandleRequestSinglePutLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      string
+		size       int64
+		wantStatus int
+	}{
+		{"at the S3 limit", "", maxSinglePut, http.StatusOK},
+		{"past the S3 limit", "", maxSinglePut + 1, http.StatusRequestEntityTooLarge},
+		{"at a configured limit", "1000", 1000, http.StatusOK},
+		{"past a configured limit", "1000", 1001, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_SINGLE_PUT_BYTES", test.limit)
+			h, _ := newTestHandler(t, 1)
+			response := post(t, h, fmt.Sprintf(`{"sub":"sub-1","file_request":"file.txt","file_size":%d}`, test.size))
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+		})
+	}
+}
+
+func TestHandleRequestReadOnly(t *testing.T) {
+	tests := []struct {
+		operation  string
+		wantStatus int
+	}{
+		{"upload", http.StatusServiceUnavailable},
+		{"delete", http.StatusServiceUnavailable},
+		{"verify", http.StatusServiceUnavailable},
+		{"download", http.StatusOK},
+		{"list", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.operation, func(t *testing.T) {
+			t.Setenv("READ_ONLY", "true")
+			h, clients := newTestHandler(t, 1)
+			clients.lister = &fakeListV2{output: &s3.ListObjectsV2Output{}}
+			response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100,"operation":"`+test.operation+`"}`)
+			if response.StatusCode != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, test.wantStatus, response.Body)
+			}
+			if test.wantStatus == http.StatusServiceUnavailable && errorOf(t, response).Code != codeReadOnly {
+				t.Errorf("body %s, want code %s", response.Body, codeReadOnly)
+			}
+		})
+	}
+}
+
+func TestHandleRequestReturnsTierName(t *testing.T) {
+	for _, enabled := range []string{"", "true"} {
+		t.Run("RETURN_TIER_NAME="+enabled, func(t *testing.T) {
+			t.Setenv("RETURN_TIER_NAME", enabled)
+			h, _ := newTestHandler(t, 1)
+			response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+			var signed URLSign
+			if err := json.Unmarshal([]byte(response.Body), &signed); err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("response %d %s, want a signed URL", response.StatusCode, response.Body)
+			}
+			want := ""
+			if enabled == "true" {
+				want = "pro"
+			}
+			if signed.ServiceTier != want {
+				t.Errorf("service_tier = %q, want %q", signed.ServiceTier, want)
+			}
+		})
+	}
+}
+
+//Signing and the quota listing use the same prefix however the company id was stored
+func TestCompanyPrefixTrailingSlash(t *testing.T) {
+	for _, companyID := range []string{"acme", "acme/", "acme//"} {
+		user := newTestUser()
+		user.CompanyID = companyID
+		if prefix := user.companyPrefix(); prefix != "acme/" {
+			t.Errorf("companyPrefix() for %q = %q, want acme/", companyID, prefix)
+		}
+		if key := user.objectKey(); key != "acme/file.txt" {
+			t.Errorf("objectKey() for %q = %q, want acme/file.txt", companyID, key)
+		}
+		if prefixes := user.quotaPrefixes(); !reflect.DeepEqual(prefixes, []string{"acme/"}) {
+			t.Errorf("quotaPrefixes() for %q = %v, want [acme/]", companyID, prefixes)
+		}
+	}
+}
+
+func TestNewUsage(t *testing.T) {
+	tests := []struct {
+		used, limit int64
+		want        float64
+	}{
+		{0, 1000, 0},
+		{250, 1000, 25},
+		{1, 3, 33.33},
+		{2, 3, 66.67},
+		{1000, 1000, 100},
+		{1500, 1000, 150},
+		{0, 0, 0},
+		{10, 0, 100},
+	}
+	for _, test := range tests {
+		usage := newUsage(test.used, test.limit)
+		if usage.Percent != test.want || usage.UsedBytes != test.used || usage.LimitBytes != test.limit {
+			t.Errorf("newUsage(%d, %d) = %+v, want %v%%", test.used, test.limit, usage, test.want)
+		}
+	}
+}
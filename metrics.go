@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+//Emit a count metric using the CloudWatch embedded metric format so it is extracted from the logs
+//without an extra API call.  The namespace is METRICS_NAMESPACE, defaulting to SignS3URL
+func emitMetric(name string, value float64) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = "SignS3URL"
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{{}},
+				"Metrics":    []map[string]string{{"Name": name, "Unit": "Count"}},
+			}},
+		},
+		name: value,
+	})
+	if err != nil {
+		log.Println("Unable to emit metric " + name + ": " + err.Error())
+		return
+	}
+	fmt.Println(string(data)) //Must be written without the log prefix to be parsed
+}
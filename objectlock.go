@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Apply the tier's object lock to an upload, for tiers of regulated tenants with TIER_<n>_OBJECT_LOCK_MODE set.
+//An upload without its own retention is signed with the tier's mode and retention, one with its own must retain
+//the file at least as long and can't weaken COMPLIANCE to GOVERNANCE.  S3 rejects locked uploads without a
+//checksum so one is required
+func (user *User) applyTierObjectLock(tier tierConfig, now time.Time) error {
+	if tier.ObjectLockMode == "" {
+		return nil
+	}
+	if tier.ObjectLockMode != s3.ObjectLockModeGovernance && tier.ObjectLockMode != s3.ObjectLockModeCompliance {
+		return fmt.Errorf("object lock mode %q of the %s tier must be GOVERNANCE or COMPLIANCE", tier.ObjectLockMode, tier.Name)
+	}
+	if tier.ObjectLockRetention <= 0 {
+		return fmt.Errorf("object lock of the %s tier needs a retention", tier.Name)
+	}
+	retainUntil := now.Add(tier.ObjectLockRetention)
+	switch {
+	case user.ObjectLockMode == "":
+		user.ObjectLockMode = tier.ObjectLockMode
+		user.ObjectLockRetainUntil = &retainUntil
+	case tier.ObjectLockMode == s3.ObjectLockModeCompliance && user.ObjectLockMode != s3.ObjectLockModeCompliance:
+		return fmt.Errorf("%w: object lock mode must be COMPLIANCE for this service tier", ErrInvalidRequest)
+	case user.ObjectLockRetainUntil.Before(retainUntil):
+		return fmt.Errorf("%w: object lock retain until date must be at least %s away for this service tier",
+			ErrInvalidRequest, tier.ObjectLockRetention)
+	}
+	if user.ChecksumAlgorithm == "" {
+		return fmt.Errorf("%w: uploads on this service tier are object locked so checksum_algorithm and checksum are required",
+			ErrInvalidRequest)
+	}
+	return nil
+}
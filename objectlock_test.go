@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A valid base64 SHA256 checksum
+var testChecksum = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+func TestValidateObjectLock(t *testing.T) {
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	tests := []struct {
+		name        string
+		mode        string
+		retainUntil *time.Time
+		algorithm   string
+		want        string
+	}{
+		{"no retention", "", nil, "", ""},
+		{"locked with checksum", "COMPLIANCE", &future, "SHA256", ""},
+		{"locked without checksum", "GOVERNANCE", &future, "", "object lock requires checksum_algorithm and checksum"},
+		{"unknown mode", "FOREVER", &future, "SHA256", "object lock mode must be GOVERNANCE or COMPLIANCE"},
+		{"no retain until", "COMPLIANCE", nil, "SHA256", "object lock requires a retain until date"},
+		{"retain until passed", "COMPLIANCE", &past, "SHA256", "must be in the future"},
+		{"retain until without mode", "", &future, "SHA256", "object lock mode must be GOVERNANCE or COMPLIANCE"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.ObjectLockMode = test.mode
+			user.ObjectLockRetainUntil = test.retainUntil
+			user.ChecksumAlgorithm = test.algorithm
+			if test.algorithm != "" {
+				user.Checksum = testChecksum
+			}
+			err := user.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Validate() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyTierObjectLock(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	month := time.Hour * 24 * 30
+	later, sooner := now.Add(2*month), now.Add(month/2)
+	tests := []struct {
+		name        string
+		tier        tierConfig
+		mode        string
+		retainUntil *time.Time
+		algorithm   string
+		wantMode    string
+		wantUntil   time.Time
+		wantErr     error
+		wantFailure bool
+	}{
+		{name: "tier without lock", tier: tierConfig{}},
+		{name: "tier lock applied", tier: tierConfig{ObjectLockMode: "COMPLIANCE", ObjectLockRetention: month},
+			algorithm: "SHA256", wantMode: "COMPLIANCE", wantUntil: now.Add(month)},
+		{name: "longer request retention kept", tier: tierConfig{ObjectLockMode: "GOVERNANCE", ObjectLockRetention: month},
+			mode: "COMPLIANCE", retainUntil: &later, algorithm: "SHA256", wantMode: "COMPLIANCE", wantUntil: later},
+		{name: "shorter request retention", tier: tierConfig{ObjectLockMode: "GOVERNANCE", ObjectLockRetention: month},
+			mode: "GOVERNANCE", retainUntil: &sooner, algorithm: "SHA256", wantErr: ErrInvalidRequest},
+		{name: "weaker request mode", tier: tierConfig{ObjectLockMode: "COMPLIANCE", ObjectLockRetention: month},
+			mode: "GOVERNANCE", retainUntil: &later, algorithm: "SHA256", wantErr: ErrInvalidRequest},
+		{name: "no checksum", tier: tierConfig{ObjectLockMode: "COMPLIANCE", ObjectLockRetention: month},
+			wantErr: ErrInvalidRequest},
+		{name: "misconfigured mode", tier: tierConfig{ObjectLockMode: "FOREVER", ObjectLockRetention: month},
+			algorithm: "SHA256", wantFailure: true},
+		{name: "misconfigured retention", tier: tierConfig{ObjectLockMode: "COMPLIANCE"},
+			algorithm: "SHA256", wantFailure: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.ObjectLockMode = test.mode
+			user.ObjectLockRetainUntil = test.retainUntil
+			user.ChecksumAlgorithm = test.algorithm
+			err := user.applyTierObjectLock(test.tier, now)
+			switch {
+			case test.wantFailure:
+				if err == nil || statusCodeFor(err) != 500 {
+					t.Errorf("applyTierObjectLock() error = %v, want a misconfiguration", err)
+				}
+				return
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("applyTierObjectLock() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatalf("applyTierObjectLock() error = %v", err)
+			}
+			if user.ObjectLockMode != test.wantMode {
+				t.Errorf("mode = %q, want %q", user.ObjectLockMode, test.wantMode)
+			}
+			if test.wantMode != "" && !user.ObjectLockRetainUntil.Equal(test.wantUntil) {
+				t.Errorf("retain until = %s, want %s", user.ObjectLockRetainUntil, test.wantUntil)
+			}
+		})
+	}
+}
+
+func TestTierObjectLockConfig(t *testing.T) {
+	t.Setenv("TIER_2_OBJECT_LOCK_MODE", "compliance")
+	t.Setenv("TIER_2_OBJECT_LOCK_RETENTION", "2160h")
+	tier := tierFor(2)
+	if tier.ObjectLockMode != "COMPLIANCE" || tier.ObjectLockRetention != time.Hour*2160 {
+		t.Errorf("object lock = %q for %s, want COMPLIANCE for 2160h", tier.ObjectLockMode, tier.ObjectLockRetention)
+	}
+	if other := tierFor(1); other.ObjectLockMode != "" {
+		t.Errorf("tier 1 object lock = %q, want none", other.ObjectLockMode)
+	}
+}
+
+//The lock and checksum headers are signed, so a client can't drop them and S3 accepts the locked put
+func TestObjectLockHeadersSigned(t *testing.T) {
+	retainUntil := time.Now().Add(time.Hour * 24).UTC().Truncate(time.Second)
+	user := newTestUser()
+	user.ObjectLockMode = "COMPLIANCE"
+	user.ObjectLockRetainUntil = &retainUntil
+	user.ChecksumAlgorithm = "SHA256"
+	user.Checksum = testChecksum
+	signed, query := presignQuery(t, user)
+	signedHeaders := strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	for _, name := range []string{"x-amz-object-lock-mode", "x-amz-object-lock-retain-until-date"} {
+		if !containsString(signedHeaders, name) {
+			t.Errorf("signed headers %q are missing %s", signedHeaders, name)
+		}
+	}
+	if query.Get("X-Amz-Checksum-Sha256") != testChecksum || query.Get("X-Amz-Sdk-Checksum-Algorithm") != "SHA256" {
+		t.Errorf("URL %s doesn't sign the SHA256 checksum", signed.URL)
+	}
+}
+
+//The retention headers the SDK leaves out of the query string are returned with their values for the client to send
+func TestObjectLockRequiredHeaders(t *testing.T) {
+	retainUntil := time.Now().Add(time.Hour * 24).UTC().Truncate(time.Second)
+	user := newTestUser()
+	user.ObjectLockMode = "GOVERNANCE"
+	user.ObjectLockRetainUntil = &retainUntil
+	user.ChecksumAlgorithm = "SHA256"
+	user.Checksum = testChecksum
+	signed, _ := presignQuery(t, user)
+	want := map[string]string{
+		"x-amz-object-lock-mode":              "GOVERNANCE",
+		"x-amz-object-lock-retain-until-date": retainUntil.Format(time.RFC3339),
+	}
+	if !reflect.DeepEqual(signed.RequiredHeaders, want) {
+		t.Errorf("RequiredHeaders = %v, want %v", signed.RequiredHeaders, want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+//parameterCache tunables read from SSM Parameter Store under SSM_PARAMETER_PREFIX so operators can change them
+//without a redeploy.  The parameters are fetched together and cached for SSM_CACHE_TTL (default 5m)
+type parameterCache struct {
+	mu        sync.Mutex
+	client    ssmiface.SSMAPI
+	awsConfig *aws.Config //Session config from the deployment's Config, set at startup
+	values    map[string]string
+	fetchedAt time.Time
+}
+
+var parameters = &parameterCache{}
+
+//Look up a tunable, a parameter named e.g. /sign-s3-url/URL_EXPIRY overrides the URL_EXPIRY environment variable
+func setting(name string) string {
+	if value, ok := parameters.get(name); ok {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+//Get a cached parameter, refreshing the cache when it has expired.  A failed refresh keeps the previous values
+func (cache *parameterCache) get(name string) (string, bool) {
+	prefix := os.Getenv("SSM_PARAMETER_PREFIX")
+	if prefix == "" {
+		return "", false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	ttl := time.Minute * 5
+	if value := os.Getenv("SSM_CACHE_TTL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			ttl = d
+		}
+	}
+	if cache.values == nil || time.Since(cache.fetchedAt) > ttl {
+		values, err := cache.fetch(prefix)
+		if err != nil {
+			log.Println("Unable to refresh parameters from SSM: " + err.Error())
+			emitMetric("ParameterRefreshFailed", 1)
+		} else {
+			cache.values = values
+		}
+		cache.fetchedAt = time.Now() //Don't retry a failed fetch on every lookup
+	}
+	value, ok := cache.values[name]
+	return value, ok
+}
+
+//Fetch every parameter under the prefix, keyed by the name after the prefix
+func (cache *parameterCache) fetch(prefix string) (map[string]string, error) {
+	if cache.client == nil {
+		sess, err := session.NewSession(cache.awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		cache.client = ssm.New(sess)
+	}
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	values := map[string]string{}
+	err := cache.client.GetParametersByPathPages(&ssm.GetParametersByPathInput{
+		Path:           aws.String(prefix),
+		WithDecryption: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
+		for _, parameter := range page.Parameters {
+			values[strings.TrimPrefix(aws.StringValue(parameter.Name), prefix)] = aws.StringValue(parameter.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
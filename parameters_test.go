@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+//fakeSSM serves its parameters in pages of one, failing with err when set
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+	err        error
+	fetches    int
+	path       string
+}
+
+func (svc *fakeSSM) GetParametersByPathPages(input *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool) error {
+	svc.fetches++
+	svc.path = aws.StringValue(input.Path)
+	if svc.err != nil {
+		return svc.err
+	}
+	for name, value := range svc.parameters {
+		page := &ssm.GetParametersByPathOutput{Parameters: []*ssm.Parameter{{Name: aws.String(name), Value: aws.String(value)}}}
+		if !fn(page, false) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestParameterCacheGet(t *testing.T) {
+	t.Setenv("SSM_PARAMETER_PREFIX", "/sign-s3-url")
+	t.Setenv("SSM_CACHE_TTL", "1h")
+	svc := &fakeSSM{parameters: map[string]string{"/sign-s3-url/URL_EXPIRY": "1h", "/sign-s3-url/READ_ONLY": "true"}}
+	cache := &parameterCache{client: svc}
+	if value, ok := cache.get("URL_EXPIRY"); !ok || value != "1h" {
+		t.Errorf("get(URL_EXPIRY) = %q, %v, want 1h", value, ok)
+	}
+	if value, ok := cache.get("READ_ONLY"); !ok || value != "true" {
+		t.Errorf("get(READ_ONLY) = %q, %v, want true", value, ok)
+	}
+	if _, ok := cache.get("MAX_LIST_PAGES"); ok {
+		t.Error("get(MAX_LIST_PAGES) found a parameter that isn't stored")
+	}
+	if svc.fetches != 1 || svc.path != "/sign-s3-url/" {
+		t.Errorf("fetched %d times under %q, want once under /sign-s3-url/ within the TTL", svc.fetches, svc.path)
+	}
+}
+
+func TestParameterCacheRefresh(t *testing.T) {
+	t.Setenv("SSM_PARAMETER_PREFIX", "/sign-s3-url/")
+	t.Setenv("SSM_CACHE_TTL", "1m")
+	captureLog(t)
+	svc := &fakeSSM{parameters: map[string]string{"/sign-s3-url/URL_EXPIRY": "1h"}}
+	cache := &parameterCache{client: svc}
+	cache.get("URL_EXPIRY")
+	svc.parameters["/sign-s3-url/URL_EXPIRY"] = "2h"
+	cache.fetchedAt = time.Now().Add(-2 * time.Minute)
+	if value, _ := cache.get("URL_EXPIRY"); value != "2h" || svc.fetches != 2 {
+		t.Errorf("get() after the TTL = %q with %d fetches, want the refreshed 2h", value, svc.fetches)
+	}
+	svc.err = errors.New("throttled")
+	cache.fetchedAt = time.Now().Add(-2 * time.Minute)
+	if value, _ := cache.get("URL_EXPIRY"); value != "2h" {
+		t.Errorf("get() after a failed refresh = %q, want the previous 2h", value)
+	}
+	cache.get("URL_EXPIRY")
+	if svc.fetches != 3 {
+		t.Errorf("fetched %d times, want a failed refresh not retried on every lookup", svc.fetches)
+	}
+}
+
+//Without SSM_PARAMETER_PREFIX nothing is fetched and the environment is used
+func TestParameterCacheDisabled(t *testing.T) {
+	t.Setenv("SSM_PARAMETER_PREFIX", "")
+	svc := &fakeSSM{parameters: map[string]string{"/sign-s3-url/URL_EXPIRY": "1h"}}
+	cache := &parameterCache{client: svc}
+	if _, ok := cache.get("URL_EXPIRY"); ok || svc.fetches > 0 {
+		t.Errorf("get() fetched %d times without a prefix, want none", svc.fetches)
+	}
+}
+
+//A stored parameter overrides the environment variable of the same name
+func TestSetting(t *testing.T) {
+	t.Setenv("SSM_PARAMETER_PREFIX", "/sign-s3-url")
+	t.Setenv("URL_EXPIRY", "72h")
+	t.Setenv("MAX_LIST_PAGES", "5")
+	saved := parameters
+	parameters = &parameterCache{client: &fakeSSM{parameters: map[string]string{"/sign-s3-url/URL_EXPIRY": "1h"}}}
+	t.Cleanup(func() { parameters = saved })
+	if got := envDuration("URL_EXPIRY", 0); got != time.Hour {
+		t.Errorf("envDuration(URL_EXPIRY) = %s, want the parameter's 1h", got)
+	}
+	if got := envInt("MAX_LIST_PAGES", 0); got != 5 {
+		t.Errorf("envInt(MAX_LIST_PAGES) = %d, want the environment's 5", got)
+	}
+}
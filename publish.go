@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+)
+
+//URLSignedEvent detail of the event published to EVENT_BUS_NAME when a URL is signed
+type URLSignedEvent struct {
+	CompanyID string `json:"company_id"`
+	Sub       string `json:"sub"`
+	Key       string `json:"key"`
+	FileSize  int    `json:"file_size"`
+	Operation string `json:"operation"`
+}
+
+//Publish the URL signed event so downstream systems can react to upload authorizations.  Failures are
+//logged and counted rather than failing the request since the URL has already been signed
+func (user *User) publishSignedEvent(svc eventbridgeiface.EventBridgeAPI) {
+	bus := user.config.EventBusName
+	if bus == "" {
+		return
+	}
+	err := user.putSignedEvent(svc, bus)
+	if err != nil {
+		user.log.Println("Unable to publish URL signed event: " + err.Error())
+		emitMetric("EventPublishFailed", 1)
+	}
+}
+
+//Put the event on the bus, treating a rejected entry as an error
+func (user *User) putSignedEvent(svc eventbridgeiface.EventBridgeAPI, bus string) error {
+	detail, err := json.Marshal(&URLSignedEvent{
+		CompanyID: user.CompanyID,
+		Sub:       user.Sub,
+		Key:       user.objectKey(),
+		FileSize:  user.FileSize,
+		Operation: user.operation(),
+	})
+	if err != nil {
+		return err
+	}
+	result, err := svc.PutEvents(&eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			EventBusName: aws.String(bus),
+			Source:       aws.String("sign-s3-url"),
+			DetailType:   aws.String("URL Signed"),
+			Detail:       aws.String(string(detail)),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(result.FailedEntryCount) > 0 {
+		return fmt.Errorf("event rejected: %s", aws.StringValue(result.Entries[0].ErrorMessage))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+)
+
+//fakeEvents records the entries put on the bus, answering with the error or rejecting every entry when set
+type fakeEvents struct {
+	eventbridgeiface.EventBridgeAPI
+	entries []*eventbridge.PutEventsRequestEntry
+	err     error
+	reject  string
+}
+
+func (svc *fakeEvents) PutEvents(input *eventbridge.PutEventsInput) (*eventbridge.PutEventsOutput, error) {
+	svc.entries = append(svc.entries, input.Entries...)
+	if svc.err != nil {
+		return nil, svc.err
+	}
+	output := &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}
+	if svc.reject != "" {
+		output.FailedEntryCount = aws.Int64(1)
+		output.Entries = []*eventbridge.PutEventsResultEntry{{ErrorMessage: aws.String(svc.reject)}}
+	}
+	return output, nil
+}
+
+func TestPublishSignedEvent(t *testing.T) {
+	user := newTestUser()
+	user.config.EventBusName = "uploads"
+	svc := &fakeEvents{}
+	user.publishSignedEvent(svc)
+	if len(svc.entries) != 1 {
+		t.Fatalf("put %d events, want 1", len(svc.entries))
+	}
+	entry := svc.entries[0]
+	if aws.StringValue(entry.EventBusName) != "uploads" || aws.StringValue(entry.Source) != "sign-s3-url" ||
+		aws.StringValue(entry.DetailType) != "URL Signed" {
+		t.Errorf("entry = %v, want a URL Signed event from sign-s3-url on uploads", entry)
+	}
+	var detail URLSignedEvent
+	if err := json.Unmarshal([]byte(aws.StringValue(entry.Detail)), &detail); err != nil {
+		t.Fatalf("detail %s is not JSON: %v", aws.StringValue(entry.Detail), err)
+	}
+	want := URLSignedEvent{CompanyID: "acme", Sub: "sub-1", Key: "acme/file.txt", FileSize: 100, Operation: operationUpload}
+	if detail != want {
+		t.Errorf("detail = %+v, want %+v", detail, want)
+	}
+}
+
+func TestPublishSignedEventNoBus(t *testing.T) {
+	svc := &fakeEvents{}
+	newTestUser().publishSignedEvent(svc)
+	if len(svc.entries) > 0 {
+		t.Errorf("put %d events without EVENT_BUS_NAME, want none", len(svc.entries))
+	}
+}
+
+//The URL is already signed, a failed publish is logged rather than failing the request
+func TestPublishSignedEventFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		svc  *fakeEvents
+		want string
+	}{
+		{"put failed", &fakeEvents{err: errors.New("bus unavailable")}, "bus unavailable"},
+		{"entry rejected", &fakeEvents{reject: "malformed detail"}, "event rejected: malformed detail"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := captureLog(t)
+			user := newTestUser()
+			user.config.EventBusName = "uploads"
+			user.log = testLog(buf, "id", true)
+			user.publishSignedEvent(test.svc)
+			if logged := buf.String(); !strings.Contains(logged, "Unable to publish URL signed event: "+test.want) {
+				t.Errorf("logged %q, want the publish failure %q", logged, test.want)
+			}
+		})
+	}
+}
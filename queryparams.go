@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+//Parameters the signer sets itself, a request can't replace them even when SIGNED_QUERY_PARAMS lists them
+var reservedQueryParams = []string{"versionId", "response-content-disposition", "response-content-type", "tagging"}
+
+//The query parameters requests may have signed into their URL, from the comma separated SIGNED_QUERY_PARAMS
+func signedQueryParams() []string {
+	var allowed []string
+	for _, name := range strings.Split(setting("SIGNED_QUERY_PARAMS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
+}
+
+//The problems with the request's query_parameters.  Each must be listed in SIGNED_QUERY_PARAMS, and the X-Amz-
+//signature parameters and those the signer sets can never be given, whatever the list says
+func (user *User) validateQueryParameters() []string {
+	var problems []string
+	allowed := signedQueryParams()
+	for _, name := range sortedKeys(user.QueryParameters) {
+		switch {
+		case strings.HasPrefix(strings.ToLower(name), "x-amz-"), containsString(reservedQueryParams, name):
+			problems = append(problems, fmt.Sprintf("query parameter %q is set by the signer", name))
+		case !containsString(allowed, name):
+			problems = append(problems, fmt.Sprintf("query parameter %q is not allowed", name))
+		}
+	}
+	return problems
+}
+
+//Add the request's query_parameters to the S3 request once it is built, so they are covered by the signature.
+//Must be called before the request is built, as the tagging request is while building its body
+func (user *User) addQueryParameters(req *request.Request) {
+	if len(user.QueryParameters) == 0 {
+		return
+	}
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.URL.RawQuery = user.withQueryParameters(r.HTTPRequest.URL.Query()).Encode()
+	})
+}
+
+//The query with the request's query_parameters set
+func (user *User) withQueryParameters(query url.Values) url.Values {
+	for name, value := range user.QueryParameters {
+		query.Set(name, value)
+	}
+	return query
+}
+
+//Whether values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//The map's keys in order so problems are reported the same way every time
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+//The query_parameters are signed into the URL of every operation, including tagging whose request is built early,
+//so the signature still verifies with them in the query
+func TestQueryParametersSigned(t *testing.T) {
+	t.Setenv("SIGNED_QUERY_PARAMS", "x-id")
+	tests := []struct {
+		operation string
+		tags      map[string]string
+		want      []string
+	}{
+		{operation: operationUpload},
+		{operation: operationDownload},
+		{operation: operationHead},
+		{operation: operationDelete},
+		{operation: operationTag, tags: map[string]string{"team": "ops"}, want: []string{"tagging"}},
+	}
+	for _, test := range tests {
+		t.Run(test.operation, func(t *testing.T) {
+			user := newTestUser()
+			user.Operation = test.operation
+			user.Tags = test.tags
+			user.QueryParameters = map[string]string{"x-id": "abc"}
+			signed, err := user.presignS3(newFixedSigningClients(credentials.NewStaticCredentials(testAccessKey, testSecretKey, "")))
+			if err != nil {
+				t.Fatalf("presignS3() error = %v", err)
+			}
+			sig := verifySigV4(t, signed, testSecretKey)
+			if sig.query.Get("x-id") != "abc" {
+				t.Errorf("URL %s is missing x-id=abc", signed.URL)
+			}
+			for _, name := range test.want {
+				if _, ok := sig.query[name]; !ok {
+					t.Errorf("URL %s is missing %s", signed.URL, name)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateQueryParameters(t *testing.T) {
+	t.Setenv("SIGNED_QUERY_PARAMS", " x-id ,tagging,")
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   int
+	}{
+		{"none", nil, 0},
+		{"allowed", map[string]string{"x-id": "1"}, 0},
+		{"not listed", map[string]string{"other": "1"}, 1},
+		{"signature parameter", map[string]string{"X-Amz-Date": "1"}, 1},
+		{"reserved even when listed", map[string]string{"tagging": "1"}, 1},
+		{"several", map[string]string{"a": "1", "x-amz-acl": "1", "x-id": "1"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.QueryParameters = test.params
+			if problems := user.validateQueryParameters(); len(problems) != test.want {
+				t.Errorf("validateQueryParameters() = %q, want %d problems", problems, test.want)
+			}
+		})
+	}
+}
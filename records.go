@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+//Unmarshal a DynamoDB item, naming the attribute that failed (e.g. a number stored as a string) rather than
+//returning the SDK's opaque error.  A failure means the stored record is malformed, not the request
+func unmarshalRecord(item map[string]*dynamodb.AttributeValue, out interface{}) error {
+	err := dynamodbattribute.UnmarshalMap(item, out)
+	if err == nil {
+		return nil
+	}
+	names := make([]string, 0, len(item))
+	for name := range item {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names { //Find the attribute by unmarshaling each on its own
+		single := reflect.New(reflect.TypeOf(out).Elem()).Interface()
+		attributeErr := dynamodbattribute.UnmarshalMap(map[string]*dynamodb.AttributeValue{name: item[name]}, single)
+		if attributeErr != nil {
+			return fmt.Errorf("%w: attribute %s: %v", ErrMalformedRecord, name, attributeErr)
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrMalformedRecord, err)
+}
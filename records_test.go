@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestUnmarshalRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    map[string]*dynamodb.AttributeValue
+		wantErr string
+	}{
+		{"valid", map[string]*dynamodb.AttributeValue{
+			"sub": {S: aws.String("sub-1")}, "service_tier": {N: aws.String("1")}, "payed": {BOOL: aws.Bool(true)},
+		}, ""},
+		{"tier stored as a string", map[string]*dynamodb.AttributeValue{
+			"sub": {S: aws.String("sub-1")}, "service_tier": {S: aws.String("pro")}, "payed": {BOOL: aws.Bool(true)},
+		}, "attribute service_tier"},
+		{"first malformed attribute named", map[string]*dynamodb.AttributeValue{
+			"service_tier": {S: aws.String("pro")}, "payed": {S: aws.String("yes")},
+		}, "attribute payed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var user User
+			err := unmarshalRecord(test.item, &user)
+			if test.wantErr == "" {
+				if err != nil || user.Sub != "sub-1" || user.ServiceTier != 1 || !user.Payed {
+					t.Errorf("unmarshalRecord() = %+v, %v, want the record", user, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMalformedRecord) || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("unmarshalRecord() error = %v, want a malformed record naming %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+//A malformed record is the operator's to fix, so the request fails as an internal error naming the attribute
+func TestHandleRequestMalformedRecord(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	db := clients.dynamo.(*fakeDynamo)
+	db.tables["users"] = []map[string]*dynamodb.AttributeValue{{
+		"sub": {S: aws.String("sub-1")}, "company_id": {S: aws.String("acme")}, "service_tier": {S: aws.String("pro")},
+	}}
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download"}`)
+	if response.StatusCode != http.StatusInternalServerError || !strings.Contains(response.Body, "attribute service_tier") {
+		t.Errorf("response %d %s, want a 500 naming service_tier", response.StatusCode, response.Body)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+//Whether to answer a download with a redirect to the signed URL rather than JSON, so a client following it
+//downloads the file directly.  Asked for with the redirect flag, requests are always JSON POSTs so a browser
+//following a link can't ask for one with its Accept header
+func (user *User) wantsRedirect() bool {
+	return user.operation() == operationDownload && user.Redirect
+}
+
+//Build the 302 response redirecting to the signed URL
+func redirectResponse(signed *URLSign) events.APIGatewayProxyResponse {
+	headers := corsHeaders()
+	headers["Location"] = signed.URL
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusFound, Headers: headers}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWantsRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		redirect  bool
+		want      bool
+	}{
+		{"JSON by default", operationDownload, false, false},
+		{"redirect flag", operationDownload, true, true},
+		{"uploads never redirect", operationUpload, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.Operation = test.operation
+			user.Redirect = test.redirect
+			if got := user.wantsRedirect(); got != test.want {
+				t.Errorf("wantsRedirect() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRedirect(t *testing.T) {
+	h, _ := newTestHandler(t, 1)
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download","redirect":true}`)
+	if response.StatusCode != http.StatusFound || !strings.HasPrefix(response.Headers["Location"], "https://bucket.s3.amazonaws.com/acme/file.txt?") {
+		t.Errorf("response %d with headers %v, want a 302 to the signed URL", response.StatusCode, response.Headers)
+	}
+	if response.Headers["Access-Control-Allow-Origin"] != "*" || response.Headers[correlationHeader] == "" {
+		t.Errorf("headers = %v, want the CORS and correlation headers", response.Headers)
+	}
+}
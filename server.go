@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+//Serve the handler over plain HTTP on the configured port for running outside of Lambda
+func (h *handler) serveHTTP() error {
+	log.Println("Listening on :" + h.config.Port)
+	return http.ListenAndServe(":"+h.config.Port, http.HandlerFunc(h.proxyHTTP))
+}
+
+//Translate the HTTP request into an API Gateway proxy request and write back the response.  At most one byte past
+//MAX_BODY_BYTES is read so an oversized body is never buffered whole, what was read is over the limit and gets the
+//same 400 from the handler as on Lambda
+func (h *handler) proxyHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBodyBytes())+1))
+	var tooLarge *http.MaxBytesError
+	if err != nil && !errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, err := h.HandleRequest(r.Context(), proxyEvent(r, body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write([]byte(response.Body))
+}
+
+//The API Gateway proxy request for the HTTP request and its body
+func proxyEvent(r *http.Request, body []byte) events.APIGatewayProxyRequest {
+	event := events.APIGatewayProxyRequest{
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		Headers:               map[string]string{},
+		QueryStringParameters: map[string]string{},
+		Body:                  string(body),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil { //The address RESTRICT_SOURCE_IP restricts URLs to
+		event.RequestContext.Identity.SourceIP = host
+	}
+	for name := range r.Header {
+		event.Headers[name] = r.Header.Get(name)
+	}
+	for name := range r.URL.Query() {
+		event.QueryStringParameters[name] = r.URL.Query().Get(name)
+	}
+	return event
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//The HTTP request is run through the handler with its headers, and the response written back with its headers
+func TestProxyHTTP(t *testing.T) {
+	h, _ := newTestHandler(t, 1)
+	r := httptest.NewRequest("POST", "/sign?debug=1", strings.NewReader(`{"sub":"sub-1","file_request":"file.txt","file_size":100}`))
+	r.Header.Set("X-Request-ID", "abc-123")
+	w := httptest.NewRecorder()
+	h.proxyHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "acme/file.txt") {
+		t.Errorf("response %d %s, want a signed URL", w.Code, w.Body.String())
+	}
+	if w.Header().Get(correlationHeader) != "abc-123" || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("headers = %v, want the correlation ID and CORS headers", w.Header())
+	}
+}
+
+func TestProxyHTTPMethodNotAllowed(t *testing.T) {
+	h, _ := newTestHandler(t, 1)
+	w := httptest.NewRecorder()
+	h.proxyHTTP(w, httptest.NewRequest("DELETE", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != allowedMethods {
+		t.Errorf("response %d with Allow %q, want 405 listing %q", w.Code, w.Header().Get("Allow"), allowedMethods)
+	}
+}
+
+func TestProxyEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"ipv4", "192.0.2.1:5000", "192.0.2.1"},
+		{"ipv6", "[2001:db8::1]:5000", "2001:db8::1"},
+		{"unknown", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/sign?debug=1", strings.NewReader(""))
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("X-Api-Key", "key")
+			event := proxyEvent(r, []byte(`{"sub":"sub-1"}`))
+			if got := event.RequestContext.Identity.SourceIP; got != test.want {
+				t.Errorf("SourceIP = %q, want %q", got, test.want)
+			}
+			if event.HTTPMethod != "POST" || event.Path != "/sign" || event.Body != `{"sub":"sub-1"}` {
+				t.Errorf("event = %+v, want the request's method, path and body", event)
+			}
+			if event.Headers["X-Api-Key"] != "key" || event.QueryStringParameters["debug"] != "1" {
+				t.Errorf("event = %+v, want the request's headers and query", event)
+			}
+		})
+	}
+}
+
+//countingReader counts the bytes read from it
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+//An oversized body gets the handler's 400 without being read whole
+func TestProxyHTTPOversizedBody(t *testing.T) {
+	t.Setenv("MAX_BODY_BYTES", "1024")
+	captureLog(t)
+	stubAWSClients(t, &awsClients{dynamo: newFakeDynamo(), storage: newMemStorage()})
+	body := &countingReader{Reader: strings.NewReader(`{"sub":"` + strings.Repeat("a", 1<<20) + `"}`)}
+	w := httptest.NewRecorder()
+	(&handler{config: &Config{}}).proxyHTTP(w, httptest.NewRequest("POST", "/", body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), codeInvalidRequest) || !strings.Contains(w.Body.String(), "larger than 1024 bytes") {
+		t.Errorf("body = %s, want the body too large error", w.Body.String())
+	}
+	if w.Header().Get(correlationHeader) == "" {
+		t.Errorf("headers = %v, want the correlation ID", w.Header())
+	}
+	if body.read > 2*1024 {
+		t.Errorf("read %d bytes of the body, want it to stop just past the limit", body.read)
+	}
+}
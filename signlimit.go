@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//signCounter counts the URLs a warm container has signed within the current window
+type signCounter struct {
+	mu          sync.Mutex
+	count       int
+	windowStart time.Time
+	coolUntil   time.Time
+}
+
+var signs = &signCounter{}
+
+//Count a signing against MAX_SIGNS_PER_WINDOW, the most URLs the container signs per SIGN_WINDOW (default 1m).
+//Past the limit a warning is logged to the request's log and, when SIGN_COOLDOWN is set, signing is refused until
+//it elapses.
+//Unlimited when MAX_SIGNS_PER_WINDOW is unset
+func (counter *signCounter) allow(logger *requestLog, now time.Time) error {
+	limit := envInt("MAX_SIGNS_PER_WINDOW", 0)
+	if limit <= 0 {
+		return nil
+	}
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if now.Before(counter.coolUntil) {
+		return fmt.Errorf("%w: signing paused until %s", ErrRateLimited, counter.coolUntil.Format(time.RFC3339))
+	}
+	if now.Sub(counter.windowStart) >= envDuration("SIGN_WINDOW", time.Minute) {
+		counter.windowStart = now
+		counter.count = 0
+	}
+	counter.count++
+	if counter.count <= limit {
+		return nil
+	}
+	logger.Printf("WARNING: container has signed %d URLs this window, over the limit of %d\n", counter.count, limit)
+	cooldown := envDuration("SIGN_COOLDOWN", 0)
+	if cooldown <= 0 {
+		return nil
+	}
+	counter.coolUntil = now.Add(cooldown)
+	counter.windowStart = counter.coolUntil
+	counter.count = 0
+	return fmt.Errorf("%w: signing paused for %s", ErrRateLimited, cooldown)
+}
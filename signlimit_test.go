@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignCounterAllow(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	type signing struct {
+		at      time.Duration //After start
+		limited bool
+	}
+	tests := []struct {
+		name     string
+		limit    string
+		cooldown string
+		signings []signing
+		warnings int
+	}{
+		{"unlimited", "", "", []signing{{0, false}, {0, false}, {0, false}}, 0},
+		{"within the limit", "2", "1m", []signing{{0, false}, {time.Second, false}}, 0},
+		{"over the limit warns", "2", "", []signing{{0, false}, {0, false}, {0, false}, {0, false}}, 2},
+		{"over the limit cools down", "2", "30s", []signing{
+			{0, false}, {0, false}, {time.Second, true}, {29 * time.Second, true}, {31 * time.Second, false},
+		}, 1},
+		{"window resets", "2", "30s", []signing{
+			{0, false}, {59 * time.Second, false}, {time.Minute, false}, {61 * time.Second, false},
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_SIGNS_PER_WINDOW", test.limit)
+			t.Setenv("SIGN_WINDOW", "")
+			t.Setenv("SIGN_COOLDOWN", test.cooldown)
+			logged := &syncBuffer{}
+			counter := &signCounter{}
+			for i, signing := range test.signings {
+				err := counter.allow(testLog(logged, "req-1", true), start.Add(signing.at))
+				if limited := errors.Is(err, ErrRateLimited); limited != signing.limited || err != nil && !limited {
+					t.Errorf("signing %d at +%s: allow() error = %v, want rate limited %v", i, signing.at, err, signing.limited)
+				}
+			}
+			if warnings := strings.Count(logged.String(), "[req-1] WARNING:"); warnings != test.warnings {
+				t.Errorf("logged %d warnings, want %d: %s", warnings, test.warnings, logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+//The fixed credentials and clock URLs are signed with offline
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+var signingTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+//Clients signing S3 URLs in us-east-1 with the credentials at signingTime, presigning makes no network calls
+func newFixedSigningClients(creds *credentials.Credentials) *awsClients {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1"), Credentials: creds}))
+	presigner := newS3ClientWithCredentials(sess, "", nil)
+	presigner.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+		Name: v4.SignRequestHandler.Name,
+		Fn: func(r *request.Request) {
+			v4.SignSDKRequestWithCurrentTime(r, func() time.Time { return signingTime }, func(signer *v4.Signer) {
+				signer.DisableURIPathEscaping = true //As the S3 client signs
+			})
+		},
+	})
+	clients := &awsClients{presigner: presigner, lister: presigner, s3Credentials: creds}
+	clients.storage = &s3Storage{clients: clients}
+	return clients
+}
+
+//sigV4 the parts of a presigned URL's signature
+type sigV4 struct {
+	credential    string
+	date          string
+	expires       string
+	signedHeaders string
+	signature     string
+	query         url.Values
+}
+
+//Parse the presigned URL and check its signature by rebuilding the canonical request from the URL and the headers
+//the client is told to send, then signing it with the secret key as S3 would
+func checkSigV4(signed *URLSign, secret string) (sigV4, error) {
+	parsed, err := url.Parse(signed.URL)
+	if err != nil {
+		return sigV4{}, err
+	}
+	query := parsed.Query()
+	sig := sigV4{
+		credential:    query.Get("X-Amz-Credential"),
+		date:          query.Get("X-Amz-Date"),
+		expires:       query.Get("X-Amz-Expires"),
+		signedHeaders: query.Get("X-Amz-SignedHeaders"),
+		signature:     query.Get("X-Amz-Signature"),
+		query:         query,
+	}
+	if algorithm := query.Get("X-Amz-Algorithm"); algorithm != "AWS4-HMAC-SHA256" {
+		return sig, fmt.Errorf("X-Amz-Algorithm = %q, want AWS4-HMAC-SHA256", algorithm)
+	}
+	scope := strings.SplitN(sig.credential, "/", 2)
+	if len(scope) != 2 {
+		return sig, fmt.Errorf("X-Amz-Credential = %q, want a key and scope", sig.credential)
+	}
+	headers := strings.Split(sig.signedHeaders, ";")
+	if !sort.StringsAreSorted(headers) {
+		return sig, fmt.Errorf("X-Amz-SignedHeaders = %q, want them sorted", sig.signedHeaders)
+	}
+
+	canonicalQuery := url.Values{}
+	for name, values := range query {
+		if name != "X-Amz-Signature" {
+			canonicalQuery[name] = values
+		}
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		value, ok := signed.RequiredHeaders[name]
+		if name == "host" {
+			value, ok = parsed.Host, true
+		}
+		if !ok {
+			return sig, fmt.Errorf("signed header %s isn't returned in required_headers, the client can't send it", name)
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		signed.Method,
+		parsed.EscapedPath(),
+		strings.ReplaceAll(canonicalQuery.Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		sig.signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", sig.date, scope[1], hex.EncodeToString(hashed[:])}, "\n")
+
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope[1], "/") {
+		key = hmacSHA256(key, part)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, stringToSign)); sig.signature != want {
+		return sig, fmt.Errorf("X-Amz-Signature = %s, want %s for the canonical request:\n%s", sig.signature, want, canonicalRequest)
+	}
+	return sig, nil
+}
+
+//The signature of the presigned URL, failing the test when it doesn't verify
+func verifySigV4(t *testing.T, signed *URLSign, secret string) sigV4 {
+	t.Helper()
+	sig, err := checkSigV4(signed, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func TestPresignedSignature(t *testing.T) {
+	t.Setenv("URL_EXPIRY", "1h")
+	tests := []struct {
+		name          string
+		configure     func(user *User)
+		wantMethod    string
+		signedHeaders string
+	}{
+		{"upload", func(user *User) {}, "PUT", "host"},
+		{"upload with content type", func(user *User) { user.ContentType = "image/png" }, "PUT", "content-type;host"},
+		{"upload with download filename", func(user *User) { user.DownloadFilename = "report.pdf" }, "PUT", "content-disposition;host"},
+		{"download", func(user *User) { user.Operation = operationDownload }, "GET", "host"},
+		{"download as", func(user *User) {
+			user.Operation = operationDownload
+			user.DownloadFilename = "my report.pdf"
+		}, "GET", "host"},
+		{"head", func(user *User) { user.Operation = operationHead }, "HEAD", "host"},
+		{"delete", func(user *User) { user.Operation = operationDelete }, "DELETE", "host"},
+		{"tag", func(user *User) {
+			user.Operation = operationTag
+			user.Tags = map[string]string{"team": "ops"}
+		}, "PUT", "content-length;content-md5;host"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.ServiceTier = 1
+			user.FileRequest = "reports/q1 summary.pdf"
+			test.configure(user)
+			clients := newFixedSigningClients(credentials.NewStaticCredentials(testAccessKey, testSecretKey, ""))
+			signed, err := user.presignS3(clients)
+			if err != nil {
+				t.Fatalf("presignS3() error = %v", err)
+			}
+			sig := verifySigV4(t, signed, testSecretKey)
+			if want := testAccessKey + "/20240501/us-east-1/s3/aws4_request"; sig.credential != want {
+				t.Errorf("X-Amz-Credential = %q, want %q", sig.credential, want)
+			}
+			if sig.date != "20240501T120000Z" {
+				t.Errorf("X-Amz-Date = %q, want the fixed clock 20240501T120000Z", sig.date)
+			}
+			if sig.expires != "3600" {
+				t.Errorf("X-Amz-Expires = %q, want the URL_EXPIRY 3600", sig.expires)
+			}
+			if sig.signedHeaders != test.signedHeaders {
+				t.Errorf("X-Amz-SignedHeaders = %q, want %q", sig.signedHeaders, test.signedHeaders)
+			}
+			if signed.Method != test.wantMethod {
+				t.Errorf("Method = %s, want %s", signed.Method, test.wantMethod)
+			}
+			if want := signingTime.Add(time.Hour); signed.ExpiresAt == nil || !signed.ExpiresAt.Equal(want) || signed.ExpiresIn != 3600 {
+				t.Errorf("expires at %v in %d, want %s in 3600", signed.ExpiresAt, signed.ExpiresIn, want)
+			}
+		})
+	}
+}
+
+//A URL whose signature doesn't match its parameters fails the harness, as S3 would reject it
+func TestVerifySigV4DetectsTampering(t *testing.T) {
+	signed, err := newTestUser().presignS3(newFixedSigningClients(credentials.NewStaticCredentials(testAccessKey, testSecretKey, "")))
+	if err != nil {
+		t.Fatalf("presignS3() error = %v", err)
+	}
+	if _, err := checkSigV4(signed, "another secret"); err == nil {
+		t.Error("checkSigV4() passed a URL checked with another secret")
+	}
+	signed.URL = strings.Replace(signed.URL, "X-Amz-Expires=", "X-Amz-Expires=9", 1)
+	if _, err := checkSigV4(signed, testSecretKey); err == nil {
+		t.Error("checkSigV4() passed a URL with a changed expiry")
+	}
+}
+
+//URLs signed with temporary credentials, as Lambda's role and an assumed SIGNING_ROLE_ARN are, carry the session
+//token in the signed query string, without it S3 rejects the signature
+func TestPresignedSecurityToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"temporary credentials", "session-token/with+special=chars"},
+		{"long term credentials", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, operation := range []string{operationUpload, operationDownload, operationDelete} {
+				user := newTestUser()
+				user.Operation = operation
+				clients := newFixedSigningClients(credentials.NewStaticCredentials(testAccessKey, testSecretKey, test.token))
+				signed, err := user.presignS3(clients)
+				if err != nil {
+					t.Fatalf("presignS3() error = %v", err)
+				}
+				sig := verifySigV4(t, signed, testSecretKey)
+				token, ok := sig.query["X-Amz-Security-Token"]
+				if test.token == "" {
+					if ok {
+						t.Errorf("%s URL %s has a security token, want none", operation, signed.URL)
+					}
+					continue
+				}
+				if len(token) != 1 || token[0] != test.token {
+					t.Errorf("%s URL %s has security token %q, want %q", operation, signed.URL, token, test.token)
+				}
+			}
+		})
+	}
+}
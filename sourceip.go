@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//The client address signed URLs are restricted to, empty unless RESTRICT_SOURCE_IP is set.  A request whose
+//address is unknown fails rather than being signed a URL usable from anywhere
+func sourceIP(event events.APIGatewayProxyRequest, restrict bool) (string, error) {
+	if !restrict {
+		return "", nil
+	}
+	ip := event.RequestContext.Identity.SourceIP
+	if ip == "" {
+		return "", errors.New("RESTRICT_SOURCE_IP is set but the request has no source ip to restrict URLs to")
+	}
+	return ip, nil
+}
+
+//The address as a single host CIDR block for an aws:SourceIp condition
+func sourceCIDR(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid source ip %q", ip)
+	}
+	if parsed.To4() != nil {
+		return parsed.String() + "/32", nil
+	}
+	return parsed.String() + "/128", nil
+}
+
+//Session policy allowing the role's S3 permissions only from the address.  S3 presigned URLs and POST policies
+//have no source ip condition, but a URL signed with session credentials is bound by the session policy
+func sourceIPPolicy(ip string) (string, error) {
+	cidr, err := sourceCIDR(ip)
+	if err != nil {
+		return "", err
+	}
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Effect":    "Allow",
+			"Action":    "s3:*",
+			"Resource":  "*",
+			"Condition": map[string]interface{}{"IpAddress": map[string]string{"aws:SourceIp": cidr}},
+		}},
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+//Create a presigner whose credentials only work from the address.  The role is assumed for each request as the
+//session policy differs per client, so unlike the shared presigner the credentials aren't cached
+func newSourceRestrictedPresigner(sess *session.Session, endpoint string, roleARN string) func(ip string) (s3iface.S3API, *credentials.Credentials, error) {
+	return func(ip string) (s3iface.S3API, *credentials.Credentials, error) {
+		if roleARN == "" {
+			return nil, nil, errors.New("RESTRICT_SOURCE_IP requires SIGNING_ROLE_ARN")
+		}
+		policy, err := sourceIPPolicy(ip)
+		if err != nil {
+			return nil, nil, err
+		}
+		role := assumedRole{roleARN: roleARN}
+		role.externalID, role.sessionName = assumeRoleOptions(signingRoleSettings)
+		creds := stscreds.NewCredentials(sess, roleARN, func(provider *stscreds.AssumeRoleProvider) {
+			role.apply(provider)
+			provider.Policy = &policy
+		})
+		svc := newS3ClientWithCredentials(sess, endpoint, creds)
+		return svc, creds, nil
+	}
+}
+
+//The CloudFront custom policy restricting the resource to the user's address
+func (user *User) cloudFrontPolicy(resource string, expires time.Time) (*sign.Policy, error) {
+	policy := sign.NewCannedPolicy(resource, expires)
+	cidr, err := sourceCIDR(user.sourceIP)
+	if err != nil {
+		return nil, err
+	}
+	policy.Statements[0].Condition.IPAddress = &sign.IPAddress{SourceIP: cidr}
+	return policy, nil
+}
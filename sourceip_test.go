@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestSourceIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		restrict bool
+		ip       string
+		want     string
+		wantErr  bool
+	}{
+		{"unrestricted", false, "192.0.2.1", "", false},
+		{"unrestricted without address", false, "", "", false},
+		{"restricted", true, "192.0.2.1", "192.0.2.1", false},
+		{"restricted without address", true, "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := events.APIGatewayProxyRequest{}
+			event.RequestContext.Identity.SourceIP = test.ip
+			got, err := sourceIP(event, test.restrict)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("sourceIP() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("sourceIP() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSourceCIDR(t *testing.T) {
+	tests := []struct {
+		ip      string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", false},
+		{"", "", true},
+		{"192.0.2.1/24", "", true},
+	}
+	for _, test := range tests {
+		got, err := sourceCIDR(test.ip)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("sourceCIDR(%q) = %q, %v, want %q, error %v", test.ip, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestSourceIPPolicy(t *testing.T) {
+	policy, err := sourceIPPolicy("192.0.2.1")
+	if err != nil {
+		t.Fatalf("sourceIPPolicy() error = %v", err)
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(policy), &parsed); err != nil {
+		t.Fatalf("policy %s is not JSON: %v", policy, err)
+	}
+	if !strings.Contains(policy, `"aws:SourceIp":"192.0.2.1/32"`) {
+		t.Errorf("policy %s doesn't restrict to 192.0.2.1/32", policy)
+	}
+}
+
+//Without a signing role there are no session credentials to restrict, so nothing is signed
+func TestRestrictedPresignerRequiresRole(t *testing.T) {
+	_, _, err := newSourceRestrictedPresigner(nil, "", "")("192.0.2.1")
+	if err == nil {
+		t.Error("restricted presigner error = nil, want SIGNING_ROLE_ARN required")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//StorageBackend where files are stored, so stores other than S3 such as GCS, Azure Blob or local disk can sign,
+//measure and manage the company's files
+type StorageBackend interface {
+	Presign(user *User) (*URLSign, error)                                                                   //Sign a URL for the user's operation
+	List(user *User) (*FileList, error)                                                                     //List a page of the company's files
+	Sum(bucket string, prefixes []string, owner string, maxPages int, fn func(StoredObject)) (int64, error) //Total bytes stored under the prefixes, calling fn with each object when set
+	Each(bucket string, prefixes []string, maxPages int, fn func(object StoredObject) bool) error           //Visit the objects under the prefixes until fn returns false
+	Head(bucket string, key string) (*StoredObject, error)                                                  //The object at the key, nil when nothing is stored there
+	Delete(bucket string, key string) error                                                                 //Delete the object at the key
+	Copy(bucket string, from string, to string) (bool, error)                                               //Copy the object within the bucket, false when nothing is stored at from
+}
+
+//StoredObject a file held by a storage backend
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string //Without quotes, the hex MD5 of the file for a single PUT to S3
+	VersionID    string //Empty for unversioned buckets
+}
+
+//Whether the object is a zero byte key ending in / that consoles create to show an empty folder.  Markers take no
+//storage so they are never counted against a quota, while a key ending in / that holds data counts like any file
+func (object StoredObject) isFolderMarker() bool {
+	return strings.HasSuffix(object.Key, "/") && object.Size == 0
+}
+
+//Create the storage backend for a request's clients, replaced with a fake in builds with the fakesign tag
+var newStorageBackend = func(clients *awsClients) StorageBackend {
+	return &s3Storage{clients: clients}
+}
+
+//s3Storage stores files in S3, listing with the lister and signing and changing objects with the presigner
+type s3Storage struct {
+	clients *awsClients
+}
+
+func (storage *s3Storage) Presign(user *User) (*URLSign, error) {
+	return user.presignS3(storage.clients)
+}
+
+func (storage *s3Storage) List(user *User) (*FileList, error) {
+	return user.listFiles(storage)
+}
+
+//Sum the sizes of the objects in the bucket under the prefixes for the owner, listing at most maxPages pages
+//across all of them when above 0.  fn, when set, is called with each listed object so callers can pick out the
+//objects they need from the same listing
+func (storage *s3Storage) Sum(bucket string, prefixes []string, owner string, maxPages int, fn func(StoredObject)) (int64, error) {
+	start := time.Now()
+	var totalSize int64
+	err := storage.Each(bucket, prefixes, maxPages, func(object StoredObject) bool {
+		if !object.isFolderMarker() {
+			totalSize += object.Size
+		}
+		if fn != nil {
+			fn(object)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("summing objects for %s: %w", owner, err)
+	}
+	storage.clients.log.infof("Listed %d bytes for %s in %s\n", totalSize, owner, time.Since(start))
+	return totalSize, nil
+}
+
+//Call fn with each object in the bucket under the prefixes, listing a page at a time so only one page is held in
+//memory however many objects there are.  Listing stops when fn returns false.  When maxPages is above 0 and more
+//pages across all the prefixes would be needed ErrListingLimitExceeded is returned
+func (storage *s3Storage) Each(bucket string, prefixes []string, maxPages int, fn func(object StoredObject) bool) error {
+	pageNum := 0
+	truncated := false
+	stopped := false
+	for _, prefix := range prefixes {
+		if maxPages > 0 && pageNum >= maxPages {
+			truncated = true
+			break
+		}
+		input := &s3.ListObjectsV2Input{Prefix: aws.String(prefix)}
+		err := storage.listPages(bucket, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			storage.clients.log.debugf("PAGE: %d\n", pageNum)
+			pageNum++
+			for _, value := range page.Contents {
+				if !fn(storedObject(value)) {
+					stopped = true
+					return false
+				}
+			}
+			if maxPages > 0 && pageNum >= maxPages && !lastPage {
+				truncated = true
+				return false
+			}
+			return true //return if we should continue to the next page
+		})
+		if err != nil {
+			return fmt.Errorf("listing objects in %s under %q: %w", bucket, prefix, err)
+		}
+		if truncated || stopped {
+			break
+		}
+	}
+	if truncated {
+		return ErrListingLimitExceeded
+	}
+	return nil
+}
+
+//List the bucket with the lister a page at a time, calling fn with each page until it returns false or the last
+//page is listed.  Each and List both list through here so no more than a page of objects is held at once
+func (storage *s3Storage) listPages(bucket string, input *s3.ListObjectsV2Input, fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+	input.Bucket = aws.String(bucket)
+	input.RequestPayer = requestPayer()
+	input.ExpectedBucketOwner = storage.clients.config.expectedBucketOwner()
+	return storage.clients.lister.ListObjectsV2Pages(input, fn)
+}
+
+//HeadObject the key, returning nil when nothing exists there
+func (storage *s3Storage) Head(bucket string, key string) (*StoredObject, error) {
+	head, err := storage.clients.presigner.HeadObject(&s3.HeadObjectInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: storage.clients.config.expectedBucketOwner(),
+	})
+	if err != nil {
+		if notFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("getting object %s: %w", key, err)
+	}
+	return &StoredObject{
+		Key:          key,
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+		ETag:         strings.Trim(aws.StringValue(head.ETag), `"`),
+		VersionID:    aws.StringValue(head.VersionId),
+	}, nil
+}
+
+func (storage *s3Storage) Delete(bucket string, key string) error {
+	_, err := storage.clients.presigner.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:              aws.String(bucket),
+		Key:                 aws.String(key),
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: storage.clients.config.expectedBucketOwner(),
+	})
+	if err != nil {
+		return fmt.Errorf("deleting object %s: %w", key, err)
+	}
+	return nil
+}
+
+func (storage *s3Storage) Copy(bucket string, from string, to string) (bool, error) {
+	_, err := storage.clients.presigner.CopyObject(&s3.CopyObjectInput{
+		Bucket:                    aws.String(bucket),
+		Key:                       aws.String(to),
+		CopySource:                aws.String((&url.URL{Path: bucket + "/" + from}).EscapedPath()),
+		RequestPayer:              requestPayer(),
+		ExpectedBucketOwner:       storage.clients.config.expectedBucketOwner(),
+		ExpectedSourceBucketOwner: storage.clients.config.expectedBucketOwner(),
+	})
+	if err != nil {
+		if notFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("copying %s to %s: %w", from, to, err)
+	}
+	return true, nil
+}
+
+//The listed S3 object as a stored object
+func storedObject(object *s3.Object) StoredObject {
+	return StoredObject{
+		Key:          aws.StringValue(object.Key),
+		Size:         aws.Int64Value(object.Size),
+		LastModified: aws.TimeValue(object.LastModified),
+		ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+	}
+}
+
+//Whether S3 reported nothing stored at the key, HEAD requests have no body so only report NotFound
+func notFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && (aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//S3 storage over the fake S3 client
+func newS3TestStorage(svc s3iface.S3API) *s3Storage {
+	return &s3Storage{clients: &awsClients{lister: svc, presigner: svc, config: &Config{}, log: discardLog}}
+}
+
+func TestS3StorageEach(t *testing.T) {
+	captureLog(t)
+	pages := [][]*s3.Object{{s3Object("acme/a", 1), s3Object("acme/b", 2)}, {s3Object("shared/c", 3)}}
+	tests := []struct {
+		name      string
+		prefixes  []string
+		maxPages  int
+		stopAt    string
+		wantKeys  []string
+		wantErr   error
+		wantLists []string
+	}{
+		{"every object", []string{"acme/"}, 0, "", []string{"acme/a", "acme/b"}, nil, []string{"acme/"}},
+		{"every prefix", []string{"acme/", "shared/"}, 0, "", []string{"acme/a", "acme/b", "shared/c"}, nil, []string{"acme/", "shared/"}},
+		{"stops when fn returns false", []string{"acme/", "shared/"}, 0, "acme/a", []string{"acme/a"}, nil, []string{"acme/"}},
+		{"page limit", []string{"acme/"}, 1, "", []string{"acme/a", "acme/b"}, ErrListingLimitExceeded, []string{"acme/"}},
+		{"page limit across prefixes", []string{"acme/", "shared/"}, 2, "", []string{"acme/a", "acme/b"}, ErrListingLimitExceeded, []string{"acme/"}},
+		{"limit reached on the last page", []string{"acme/"}, 2, "", []string{"acme/a", "acme/b"}, nil, []string{"acme/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newFakeS3()
+			svc.pages = pages
+			var keys []string
+			err := newS3TestStorage(svc).Each("bucket", test.prefixes, test.maxPages, func(object StoredObject) bool {
+				keys = append(keys, object.Key)
+				return object.Key != test.stopAt
+			})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Each() error = %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(keys, test.wantKeys) {
+				t.Errorf("Each() visited %v, want %v", keys, test.wantKeys)
+			}
+			if !reflect.DeepEqual(svc.listed, test.wantLists) {
+				t.Errorf("Each() listed %v, want %v", svc.listed, test.wantLists)
+			}
+		})
+	}
+}
+
+func TestS3StorageEachConvertsObjects(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	object := datedObject("acme/file.txt", 42, modified)
+	object.ETag = aws.String(`"abc"`)
+	svc := newFakeS3()
+	svc.pages = [][]*s3.Object{{object}}
+	var got []StoredObject
+	err := newS3TestStorage(svc).Each("bucket", []string{"acme/"}, 0, func(object StoredObject) bool {
+		got = append(got, object)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Each() error = %v", err)
+	}
+	want := []StoredObject{{Key: "acme/file.txt", Size: 42, LastModified: modified, ETag: "abc"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Each() = %+v, want %+v", got, want)
+	}
+}
+
+//pagedS3 lists pages of generated objects, creating each page only when it is listed
+type pagedS3 struct {
+	s3iface.S3API
+	pages   int //Pages every listing has
+	perPage int
+	listed  int //Pages handed to callers
+}
+
+func (svc *pagedS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	for page := 0; page < svc.pages; page++ {
+		contents := make([]*s3.Object, svc.perPage)
+		for i := range contents {
+			contents[i] = s3Object(fmt.Sprintf("%s%d/%d", aws.StringValue(input.Prefix), page, i), 1)
+		}
+		svc.listed++
+		last := page == svc.pages-1
+		if !fn(&s3.ListObjectsV2Output{Contents: contents, IsTruncated: aws.Bool(!last), NextContinuationToken: aws.String("next")}, last) {
+			break
+		}
+	}
+	return nil
+}
+
+//Listing holds a page of objects at a time, so visiting and summing a prefix with many more objects than fit in
+//the allowed heap growth never holds more than a page however many pages there are
+func TestS3StorageMemoryBounded(t *testing.T) {
+	captureLog(t)
+	const pages, perPage = 200, 1000
+	const allowedGrowth = 8 << 20 //Holding every object would take several times this
+	tests := []struct {
+		name string
+		list func(storage *s3Storage, visit func()) error
+	}{
+		{"Each", func(storage *s3Storage, visit func()) error {
+			return storage.Each("bucket", []string{"acme/"}, 0, func(object StoredObject) bool {
+				visit()
+				return true
+			})
+		}},
+		{"Sum", func(storage *s3Storage, visit func()) error {
+			total, err := storage.Sum("bucket", []string{"acme/"}, "acme", 0, func(object StoredObject) { visit() })
+			if err == nil && total != pages*perPage {
+				t.Errorf("Sum() = %d, want %d", total, pages*perPage)
+			}
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stats runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			baseline, peak := stats.HeapAlloc, stats.HeapAlloc
+			visited := 0
+			err := test.list(newS3TestStorage(&pagedS3{pages: pages, perPage: perPage}), func() {
+				visited++
+				if visited%(perPage*10) == 0 {
+					runtime.GC()
+					runtime.ReadMemStats(&stats)
+					if stats.HeapAlloc > peak {
+						peak = stats.HeapAlloc
+					}
+				}
+			})
+			if err != nil {
+				t.Fatalf("listing error = %v", err)
+			}
+			if visited != pages*perPage {
+				t.Errorf("visited %d objects, want %d", visited, pages*perPage)
+			}
+			if peak > baseline+allowedGrowth {
+				t.Errorf("heap grew %d bytes while listing, want at most %d", peak-baseline, allowedGrowth)
+			}
+		})
+	}
+}
+
+//A listed page of files is all that's fetched, the client continues from the returned token
+func TestS3StorageListOnePage(t *testing.T) {
+	svc := &pagedS3{pages: 3, perPage: 2}
+	user := newTestUser()
+	user.Operation = operationList
+	user.FileRequest = ""
+	list, err := newS3TestStorage(svc).List(user)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list.Files) != 2 || list.NextContinuationToken != "next" || svc.listed != 1 {
+		t.Errorf("List() = %d files with token %q after %d pages, want one page with its token", len(list.Files), list.NextContinuationToken, svc.listed)
+	}
+}
+
+func TestS3StorageSum(t *testing.T) {
+	captureLog(t)
+	svc := newFakeS3()
+	svc.pages = [][]*s3.Object{
+		{s3Object("acme/a", 10), s3Object("acme/folder/", 0), s3Object("acme/b", 20)},
+		{s3Object("acme/data/", 5)},
+	}
+	var visited []string
+	total, err := newS3TestStorage(svc).Sum("bucket", []string{"acme/"}, "acme", 0, func(object StoredObject) {
+		visited = append(visited, object.Key)
+	})
+	if err != nil {
+		t.Fatalf("Sum() error = %v", err)
+	}
+	if total != 35 {
+		t.Errorf("Sum() = %d, want 35 counting a / key holding data but not the empty folder marker", total)
+	}
+	if want := []string{"acme/a", "acme/folder/", "acme/b", "acme/data/"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("Sum() visited %v, want every listed object %v", visited, want)
+	}
+	svc.listErr = errors.New("access denied")
+	if _, err := newS3TestStorage(svc).Sum("bucket", []string{"acme/"}, "acme", 0, nil); err == nil {
+		t.Error("Sum() error = nil, want the listing error")
+	}
+}
+
+func TestS3StorageHead(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		head    *s3.HeadObjectOutput
+		headErr error
+		want    *StoredObject
+		wantErr bool
+	}{
+		{
+			name: "stored",
+			head: &s3.HeadObjectOutput{ContentLength: aws.Int64(7), LastModified: aws.Time(modified),
+				ETag: aws.String(`"abc"`), VersionId: aws.String("v1")},
+			want: &StoredObject{Key: "acme/file.txt", Size: 7, LastModified: modified, ETag: "abc", VersionID: "v1"},
+		},
+		{name: "not found", headErr: s3Error("NotFound")},
+		{name: "no such key", headErr: s3Error(s3.ErrCodeNoSuchKey)},
+		{name: "denied", headErr: s3Error("Forbidden"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newFakeS3()
+			svc.head, svc.headErr = test.head, test.headErr
+			got, err := newS3TestStorage(svc).Head("bucket", "acme/file.txt")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Head() error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Head() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestS3StorageCopy(t *testing.T) {
+	svc := newFakeS3()
+	copied, err := newS3TestStorage(svc).Copy("bucket", "acme/my file.txt", "trash/acme/my file.txt")
+	if err != nil || !copied {
+		t.Fatalf("Copy() = %v, %v, want a copy", copied, err)
+	}
+	if source := aws.StringValue(svc.copies[0].CopySource); source != "bucket/acme/my%20file.txt" {
+		t.Errorf("CopySource = %q, want the escaped bucket/key", source)
+	}
+	svc.copyErr = s3Error(s3.ErrCodeNoSuchKey)
+	copied, err = newS3TestStorage(svc).Copy("bucket", "acme/missing", "trash/acme/missing")
+	if err != nil || copied {
+		t.Errorf("Copy() of a missing object = %v, %v, want false without an error", copied, err)
+	}
+	svc.copyErr = s3Error("AccessDenied")
+	if _, err = newS3TestStorage(svc).Copy("bucket", "acme/a", "trash/acme/a"); err == nil {
+		t.Error("Copy() error = nil, want the S3 error")
+	}
+}
+
+func TestS3StorageDelete(t *testing.T) {
+	svc := newFakeS3()
+	err := newS3TestStorage(svc).Delete("bucket", "acme/file.txt")
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if !reflect.DeepEqual(svc.deleted, []string{"acme/file.txt"}) {
+		t.Errorf("deleted %v, want acme/file.txt", svc.deleted)
+	}
+}
+
+func TestIsFolderMarker(t *testing.T) {
+	tests := []struct {
+		object StoredObject
+		want   bool
+	}{
+		{StoredObject{Key: "acme/folder/"}, true},
+		{StoredObject{Key: "acme/folder/", Size: 3}, false},
+		{StoredObject{Key: "acme/empty.txt"}, false},
+	}
+	for _, test := range tests {
+		if got := test.object.isFolderMarker(); got != test.want {
+			t.Errorf("isFolderMarker(%+v) = %v, want %v", test.object, got, test.want)
+		}
+	}
+}
+
+func TestS3StorageListsWithLister(t *testing.T) {
+	captureLog(t)
+	lister := newFakeS3()
+	lister.pages = [][]*s3.Object{{s3Object("acme/a", 5)}}
+	presigner := newFakeS3()
+	storage := &s3Storage{clients: &awsClients{lister: lister, presigner: presigner, config: &Config{}, log: discardLog}}
+	total, err := storage.Sum("bucket", []string{"acme/"}, "acme", 0, nil)
+	if err != nil || total != 5 {
+		t.Fatalf("Sum() = %d, %v, want 5", total, err)
+	}
+	if len(lister.listed) != 1 || len(presigner.listed) != 0 {
+		t.Errorf("lister listed %v and presigner %v, want only the lister", lister.listed, presigner.listed)
+	}
+}
+
+//Requests are signed by the storage backend when downloads aren't signed by CloudFront
+func TestSignURLThroughStorage(t *testing.T) {
+	user := newTestUser()
+	signed, err := user.signURLForUser(&awsClients{storage: fakeBackend{}})
+	if err != nil || signed.URL != "https://storage.invalid/" {
+		t.Errorf("signURLForUser() = %+v, %v, want the storage backend's URL", signed, err)
+	}
+}
+
+//fakeBackend signs every request with the same URL
+type fakeBackend struct {
+	StorageBackend
+}
+
+func (fakeBackend) Presign(user *User) (*URLSign, error) {
+	return &URLSign{URL: "https://storage.invalid/"}, nil
+}
+
+//The operations that read and change stored files go through the storage backend rather than S3
+func TestVerifyUploadThroughStorage(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      int64
+		others      int64
+		wantErr     error
+		wantDeleted bool
+	}{
+		{"as declared", 100, 0, nil, false},
+		{"larger but within quota", 200, 0, nil, false},
+		{"larger and over quota", 200, 9999900, ErrQuotaExceeded, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newMemStorage()
+			user := newTestUser()
+			user.Operation = operationVerify
+			storage.put("bucket", user.objectKey(), test.stored, time.Now())
+			storage.put("bucket", "acme/other", test.others, time.Now())
+			verification, err := user.verifyUpload(&awsClients{storage: storage})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("verifyUpload() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && (verification.Size != test.stored || verification.ETag != "etag-acme/file.txt") {
+				t.Errorf("verifyUpload() = %+v, want the stored size and ETag", verification)
+			}
+			if deleted := len(storage.deleted) > 0; deleted != test.wantDeleted {
+				t.Errorf("deleted %v, want deleted %v", storage.deleted, test.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestMoveToTrashThroughStorage(t *testing.T) {
+	t.Setenv("SOFT_DELETE_PREFIX", "trash/")
+	storage := newMemStorage()
+	user := newTestUser()
+	user.Operation = operationDelete
+	trash, err := user.moveToTrash(storage)
+	if err != nil || trash != "" {
+		t.Fatalf("moveToTrash() of a missing file = %q, %v, want nothing kept", trash, err)
+	}
+	storage.put("bucket", user.objectKey(), 10, time.Now())
+	trash, err = user.moveToTrash(storage)
+	if err != nil || trash != "trash/acme/file.txt" {
+		t.Fatalf("moveToTrash() = %q, %v, want trash/acme/file.txt", trash, err)
+	}
+	if object, _ := storage.Head("bucket", trash); object == nil || object.Size != 10 {
+		t.Errorf("trash holds %+v, want a copy of the file", object)
+	}
+}
+
+func TestCurrentVersionThroughStorage(t *testing.T) {
+	storage := newMemStorage()
+	user := newTestUser()
+	if version, exists, err := user.currentVersion(storage); err != nil || exists || version != "" {
+		t.Errorf("currentVersion() with nothing stored = %q, %v, %v, want no version", version, exists, err)
+	}
+	storage.put("bucket", user.objectKey(), 10, time.Now())
+	storage.objects["bucket/"+user.objectKey()] = StoredObject{Key: user.objectKey(), VersionID: "v2"}
+	if version, exists, err := user.currentVersion(storage); err != nil || !exists || version != "v2" {
+		t.Errorf("currentVersion() = %q, %v, %v, want v2", version, exists, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//Build the PutObjectTagging request replacing the tags of an existing file without uploading it again.
+//S3 requires a Content-MD5 for tagging so the body is built and its digest signed, the client must send
+//exactly the returned body.  The request is built here so its query_parameters are added first, Build handlers
+//never run again once a request is built
+func (user *User) taggingRequest(svc s3iface.S3API) (*request.Request, error) {
+	keys := make([]string, 0, len(user.Tags))
+	for key := range user.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tagging := &s3.Tagging{}
+	for _, key := range keys {
+		tagging.TagSet = append(tagging.TagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(user.Tags[key])})
+	}
+	req, _ := svc.PutObjectTaggingRequest(&s3.PutObjectTaggingInput{
+		Bucket:              aws.String(user.bucket()),
+		Key:                 aws.String(user.objectKey()),
+		Tagging:             tagging,
+		RequestPayer:        requestPayer(),
+		ExpectedBucketOwner: user.config.expectedBucketOwner(),
+	})
+	user.addQueryParameters(req)
+	err := req.Build()
+	if err != nil {
+		return nil, fmt.Errorf("building tagging request for %s: %w", user.objectKey(), err)
+	}
+	body, err := ioutil.ReadAll(req.GetBody())
+	if err != nil {
+		return nil, fmt.Errorf("reading tagging body for %s: %w", user.objectKey(), err)
+	}
+	sum := md5.Sum(body)
+	req.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.SetBufferBody(body)
+	return req, nil
+}
+
+//Rules for the tags of a tagging request, S3 allows at most 10 tags per object
+func (user *User) validateTags() []string {
+	var problems []string
+	if len(user.Tags) == 0 {
+		problems = append(problems, "tags are required")
+	}
+	if len(user.Tags) > 10 {
+		problems = append(problems, "at most 10 tags are allowed")
+	}
+	for key, value := range user.Tags {
+		if key == "" || len(key) > 128 {
+			problems = append(problems, "tag keys must be 1 to 128 characters")
+		}
+		if len(value) > 256 {
+			problems = append(problems, "tag values must be at most 256 characters")
+		}
+	}
+	return problems
+}
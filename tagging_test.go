@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+//The tagging PUT is signed with the Content-MD5 of the body the client must send
+func TestTaggingSigned(t *testing.T) {
+	user := newTestUser()
+	user.Operation = operationTag
+	user.Tags = map[string]string{"team": "ops", "env": "prod"}
+	signed, err := user.signURLForUser(withS3Storage(&awsClients{presigner: newS3Client(newTestSession(), "", "", signingRoleSettings)}))
+	if err != nil {
+		t.Fatalf("signURLForUser() error = %v", err)
+	}
+	if signed.Method != "PUT" {
+		t.Errorf("Method = %s, want PUT", signed.Method)
+	}
+	var body struct {
+		Tags []struct {
+			Key   string
+			Value string
+		} `xml:"TagSet>Tag"`
+	}
+	if err := xml.Unmarshal([]byte(signed.Body), &body); err != nil {
+		t.Fatalf("Body %s is not XML: %v", signed.Body, err)
+	}
+	var got []string
+	for _, tag := range body.Tags {
+		got = append(got, tag.Key+"="+tag.Value)
+	}
+	if want := []string{"env=prod", "team=ops"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Body %s has tags %q, want %q sorted by key", signed.Body, got, want)
+	}
+	sum := md5.Sum([]byte(signed.Body))
+	want := map[string]string{
+		"content-md5":    base64.StdEncoding.EncodeToString(sum[:]),
+		"content-length": strconv.Itoa(len(signed.Body)),
+	}
+	if !reflect.DeepEqual(signed.RequiredHeaders, want) {
+		t.Errorf("RequiredHeaders = %v, want %v", signed.RequiredHeaders, want)
+	}
+}
+
+//Only tagging returns a body, and a URL signing no headers returns none to send
+func TestRequiredHeadersOnlyWhenSigned(t *testing.T) {
+	for _, operation := range []string{operationUpload, operationDownload, operationHead, operationDelete} {
+		user := newTestUser()
+		user.Operation = operation
+		signed, err := user.signURLForUser(withS3Storage(&awsClients{presigner: newS3Client(newTestSession(), "", "", signingRoleSettings)}))
+		if err != nil {
+			t.Fatalf("signURLForUser() error = %v", err)
+		}
+		if signed.Body != "" || signed.RequiredHeaders != nil {
+			t.Errorf("%s signed with body %q and headers %v, want none", operation, signed.Body, signed.RequiredHeaders)
+		}
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i < 11; i++ {
+		tooMany["key"+strconv.Itoa(i)] = "value"
+	}
+	long := string(make([]byte, 257))
+	tests := []struct {
+		name string
+		tags map[string]string
+		want int
+	}{
+		{"valid", map[string]string{"team": "ops"}, 0},
+		{"none", nil, 1},
+		{"too many", tooMany, 1},
+		{"empty key", map[string]string{"": "ops"}, 1},
+		{"long key", map[string]string{long[:129]: "ops"}, 1},
+		{"long value", map[string]string{"team": long}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.Tags = test.tags
+			if problems := user.validateTags(); len(problems) != test.want {
+				t.Errorf("validateTags() = %q, want %d problems", problems, test.want)
+			}
+		})
+	}
+}
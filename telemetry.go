@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/charles-d-burton/sign-s3-url"
+
+//The providers exporting over OTLP, nil when telemetry isn't configured and the no-op globals are used
+var (
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+)
+
+//Export spans and metrics over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or a signal specific endpoint is set.
+//The exporters and resource read the standard OTEL_* variables such as OTEL_SERVICE_NAME and
+//OTEL_EXPORTER_OTLP_HEADERS, and OTEL_SDK_DISABLED turns export off
+func initTelemetry(ctx context.Context) error {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return nil
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") == "" {
+		return nil
+	}
+	spanExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter))
+	meterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+	return nil
+}
+
+//Export the request's spans and metrics before Lambda freezes the container, a failure is only logged
+func flushTelemetry(ctx context.Context) {
+	if tracerProvider != nil {
+		if err := tracerProvider.ForceFlush(ctx); err != nil {
+			log.Println("Unable to export spans: " + err.Error())
+		}
+	}
+	if meterProvider != nil {
+		if err := meterProvider.ForceFlush(ctx); err != nil {
+			log.Println("Unable to export metrics: " + err.Error())
+		}
+	}
+}
+
+//Start a span for a phase of the request
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+//End the span, recording the error when the phase failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//Count a handled request by status code
+func countRequest(ctx context.Context, statusCode int) {
+	counter, err := otel.Meter(instrumentationName).Int64Counter("sign_s3_url.requests",
+		metric.WithDescription("Requests handled by status code"))
+	if err != nil {
+		log.Println("Unable to create request counter: " + err.Error())
+		return
+	}
+	counter.Add(ctx, 1, metric.WithAttributes(attribute.Int("http.status_code", statusCode)))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+//Without an OTLP endpoint no exporter is started and the no-op globals are left in place
+func TestInitTelemetryUnconfigured(t *testing.T) {
+	for _, name := range []string{"OTEL_SDK_DISABLED", "OTEL_EXPORTER_OTLP_ENDPOINT",
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"} {
+		t.Setenv(name, "")
+	}
+	if err := initTelemetry(context.Background()); err != nil {
+		t.Fatalf("initTelemetry() error = %v", err)
+	}
+	if tracerProvider != nil || meterProvider != nil {
+		t.Error("providers started without an OTLP endpoint")
+	}
+	flushTelemetry(context.Background())
+}
+
+//The handler works with spans recorded instead of exported, one for each phase of the request
+func TestHandleRequestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tracerProvider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		tracerProvider = nil
+	})
+	h, _ := newTestHandler(t, 1)
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", response.StatusCode, response.Body)
+	}
+	var names []string
+	for _, span := range recorder.Ended() {
+		names = append(names, span.Name())
+	}
+	if want := []string{"validate", "quota", "sign", "HandleRequest"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("spans ended %v, want %v", names, want)
+	}
+}
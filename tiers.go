@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//tierConfig the limits applied to a service tier
+type tierConfig struct {
+	Name       string        //Readable name used in logs and responses
+	MaxStorage int64         //Maximum bytes a company on the tier may store
+	URLExpiry  time.Duration //How long signed URLs are valid, from TIER_<n>_URL_EXPIRY or else the global default
+
+	AllowedContentTypes []string //Content types that may be uploaded such as image/png or image/*, from TIER_<n>_ALLOWED_CONTENT_TYPES, any type when empty
+
+	Bucket     string //Bucket the tier's files are stored in, the default bucket when empty
+	PublicRead bool   //Whether uploads may be made public-read for sharing
+
+	EvictOldest bool //Whether the oldest files are deleted to make room for an upload over quota instead of rejecting it
+
+	ObjectLockMode      string        //GOVERNANCE or COMPLIANCE retention signed into every upload, none when empty
+	ObjectLockRetention time.Duration //How long uploads are retained when ObjectLockMode is set
+}
+
+const freeTier = 0
+
+const defaultBucket = "rsmachiner-user-code"
+
+var serviceTiers = map[int]tierConfig{
+	freeTier: {Name: "free", MaxStorage: 10000000},            //10MB Free Tier
+	1:        {Name: "pro", MaxStorage: 40000000000},          //40GB
+	2:        {Name: "enterprise", MaxStorage: 1000000000000}, //1TB
+}
+
+//The configuration for a service tier, unknown tiers default to the free tier
+func tierFor(tier int) tierConfig {
+	config, ok := serviceTiers[tier]
+	if !ok {
+		tier = freeTier
+		config = serviceTiers[freeTier]
+	}
+	if bucket := setting("TIER_" + strconv.Itoa(tier) + "_BUCKET"); bucket != "" {
+		config.Bucket = bucket
+	}
+	config.PublicRead = envBool("TIER_"+strconv.Itoa(tier)+"_PUBLIC_READ", config.PublicRead)
+	config.EvictOldest = envBool("TIER_"+strconv.Itoa(tier)+"_EVICT_OLDEST", config.EvictOldest)
+	config.URLExpiry = envDuration("TIER_"+strconv.Itoa(tier)+"_URL_EXPIRY", config.URLExpiry)
+	config.ObjectLockMode = strings.ToUpper(setting("TIER_" + strconv.Itoa(tier) + "_OBJECT_LOCK_MODE"))
+	config.ObjectLockRetention = envDuration("TIER_"+strconv.Itoa(tier)+"_OBJECT_LOCK_RETENTION", 0)
+	if types := setting("TIER_" + strconv.Itoa(tier) + "_ALLOWED_CONTENT_TYPES"); types != "" {
+		config.AllowedContentTypes = nil
+		for _, contentType := range strings.Split(types, ",") {
+			if contentType = strings.TrimSpace(contentType); contentType != "" {
+				config.AllowedContentTypes = append(config.AllowedContentTypes, contentType)
+			}
+		}
+	}
+	return config
+}
+
+//The readable name of a tier, TIER_<n>_NAME overriding the built in name.  Unknown tiers are named by number as
+//they are treated as the free tier
+func tierName(tier int) string {
+	if name := setting("TIER_" + strconv.Itoa(tier) + "_NAME"); name != "" {
+		return name
+	}
+	if config, ok := serviceTiers[tier]; ok && config.Name != "" {
+		return config.Name
+	}
+	return "tier " + strconv.Itoa(tier)
+}
+
+//The most any tier may store, a file larger than this can never be uploaded
+func largestTierStorage() int64 {
+	var largest int64
+	for _, config := range serviceTiers {
+		if config.MaxStorage > largest {
+			largest = config.MaxStorage
+		}
+	}
+	return largest
+}
+
+//Whether a file of size fits alongside the used bytes.  A file filling the quota exactly fits, including an empty
+//file when the quota is already full.  Compared by subtraction so sizes near the int64 limit can't overflow
+func (config tierConfig) fits(used, size int64) bool {
+	return size <= config.MaxStorage-used
+}
+
+//Add two non-negative byte counts, rejecting a total past the int64 limit as an invalid request rather than letting
+//it wrap negative and pass a quota check
+func addSizes(a, b int64) (int64, error) {
+	if b > 0 && a > math.MaxInt64-b {
+		return 0, fmt.Errorf("%w: %d and %d bytes overflow the size limit", ErrInvalidRequest, a, b)
+	}
+	return a + b, nil
+}
+
+//How long a signed URL for the tier is valid, falling back to URL_EXPIRY or 5 days
+func (config tierConfig) urlExpiry() time.Duration {
+	if config.URLExpiry > 0 {
+		return config.URLExpiry
+	}
+	return envDuration("URL_EXPIRY", time.Minute*60*24*5)
+}
+
+//Whether uploads of the content type are allowed on the tier.  When the tier restricts types the
+//content type must be declared so it can be signed into the URL
+func (config tierConfig) allowsContentType(contentType string) bool {
+	if len(config.AllowedContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range config.AllowedContentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+//The bucket files on the tier are stored in, falling back to the deployment's bucket
+func (config tierConfig) bucket(fallback string) string {
+	if config.Bucket != "" {
+		return config.Bucket
+	}
+	return fallback
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTierFor(t *testing.T) {
+	tests := []struct {
+		tier int
+		want int64
+	}{
+		{freeTier, 10000000},
+		{1, 40000000000},
+		{2, 1000000000000},
+		{7, 10000000},
+		{-1, 10000000},
+	}
+	for _, test := range tests {
+		if got := tierFor(test.tier).MaxStorage; got != test.want {
+			t.Errorf("tierFor(%d).MaxStorage = %d, want %d", test.tier, got, test.want)
+		}
+	}
+}
+
+func TestLargestTierStorage(t *testing.T) {
+	if got := largestTierStorage(); got != 1000000000000 {
+		t.Errorf("largestTierStorage() = %d, want the 1TB tier", got)
+	}
+}
+
+func TestTierURLExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		tier int
+		env  map[string]string
+		want time.Duration
+	}{
+		{"built in default", freeTier, nil, time.Hour * 24 * 5},
+		{"global default", 2, map[string]string{"URL_EXPIRY": "72h"}, time.Hour * 72},
+		{"tier override", freeTier, map[string]string{"URL_EXPIRY": "72h", "TIER_0_URL_EXPIRY": "1h"}, time.Hour},
+		{"other tier unaffected", 1, map[string]string{"URL_EXPIRY": "72h", "TIER_0_URL_EXPIRY": "1h"}, time.Hour * 72},
+		{"invalid tier value", 2, map[string]string{"URL_EXPIRY": "72h", "TIER_2_URL_EXPIRY": "soon"}, time.Hour * 72},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"URL_EXPIRY", "TIER_0_URL_EXPIRY", "TIER_1_URL_EXPIRY", "TIER_2_URL_EXPIRY"} {
+				t.Setenv(name, test.env[name])
+			}
+			if got := tierFor(test.tier).urlExpiry(); got != test.want {
+				t.Errorf("urlExpiry() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestURLExpirySigned(t *testing.T) {
+	t.Setenv("URL_EXPIRY", "72h")
+	_, query := presignQuery(t, &User{config: &Config{Bucket: "bucket", DynamoTable: "users"}, log: discardLog, CompanyID: "acme", FileRequest: "file.txt", ServiceTier: 1})
+	if got := query.Get("X-Amz-Expires"); got != "259200" {
+		t.Errorf("X-Amz-Expires = %s, want 72h", got)
+	}
+}
+
+//The company's negotiated expiry wins over the tier's, and both are clamped to what S3 allows when signing
+func TestUserURLExpiry(t *testing.T) {
+	t.Setenv("TIER_1_URL_EXPIRY", "2h")
+	user := newTestUser()
+	user.ServiceTier = 1
+	if got := user.urlExpiry(); got != time.Hour*2 {
+		t.Errorf("urlExpiry() = %s, want the tier's 2h", got)
+	}
+	user.URLExpirySeconds = 600
+	if got := user.urlExpiry(); got != time.Minute*10 {
+		t.Errorf("urlExpiry() = %s, want the negotiated 10m", got)
+	}
+	user.URLExpirySeconds = int(maxPresignExpiry/time.Second) * 2
+	if got := clampExpiry(user.log, user.urlExpiry()); got != maxPresignExpiry {
+		t.Errorf("clampExpiry() = %s, want %s", got, maxPresignExpiry)
+	}
+}
+
+func TestTierAllowedContentTypes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"unset", "", nil},
+		{"list", " image/*, application/pdf ,,", []string{"image/*", "application/pdf"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TIER_0_ALLOWED_CONTENT_TYPES", test.value)
+			if got := tierFor(freeTier).AllowedContentTypes; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("AllowedContentTypes = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAllowsContentType(t *testing.T) {
+	tests := []struct {
+		allowed     []string
+		contentType string
+		want        bool
+	}{
+		{nil, "", true},
+		{nil, "text/plain", true},
+		{[]string{"image/*"}, "image/png", true},
+		{[]string{"image/*"}, "image/svg+xml; charset=utf-8", true},
+		{[]string{"image/*"}, "text/plain", false},
+		{[]string{"image/*"}, "imagery/png", false},
+		{[]string{"image/*"}, "", false},
+		{[]string{"application/pdf"}, "application/pdf", true},
+		{[]string{"application/pdf"}, "application/pdfx", false},
+	}
+	for _, test := range tests {
+		config := tierConfig{AllowedContentTypes: test.allowed}
+		if got := config.allowsContentType(test.contentType); got != test.want {
+			t.Errorf("allowsContentType(%q) with %q = %v, want %v", test.contentType, test.allowed, got, test.want)
+		}
+	}
+}
+
+//Only a tier restricted by TIER_<n>_ALLOWED_CONTENT_TYPES rejects types, naming the allowed set
+func TestVerifyUserGrantsContentType(t *testing.T) {
+	t.Setenv("TIER_0_ALLOWED_CONTENT_TYPES", "image/*,application/pdf")
+	t.Setenv("TIER_1_ALLOWED_CONTENT_TYPES", "")
+	t.Setenv("DEFAULT_CONTENT_TYPE", "")
+	tests := []struct {
+		name        string
+		tier        int
+		contentType string
+		wantErr     bool
+	}{
+		{"restricted tier allowed type", freeTier, "image/png", false},
+		{"restricted tier other type", freeTier, "text/plain", true},
+		{"restricted tier without type", freeTier, "", true},
+		{"unrestricted tier", 1, "text/plain", false},
+		{"unrestricted tier without type", 1, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.ServiceTier = test.tier
+			user.ContentType = test.contentType
+			_, err := user.verifyUserGrants(&awsClients{storage: newMemStorage()})
+			if !test.wantErr {
+				if err != nil {
+					t.Errorf("verifyUserGrants() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidRequest) || !strings.Contains(err.Error(), "image/*, application/pdf") {
+				t.Errorf("verifyUserGrants() error = %v, want a 400 naming the allowed types", err)
+			}
+		})
+	}
+}
+
+func TestUserBucket(t *testing.T) {
+	tests := []struct {
+		name  string
+		tier  int
+		tier1 string
+		want  string
+	}{
+		{"default bucket", 1, "", "bucket"},
+		{"tier bucket", 1, "pro-files", "pro-files"},
+		{"other tier", 2, "pro-files", "bucket"},
+		{"unknown tier uses the free tier's", 7, "pro-files", "bucket"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TIER_1_BUCKET", test.tier1)
+			user := newTestUser()
+			user.ServiceTier = test.tier
+			if got := user.bucket(); got != test.want {
+				t.Errorf("bucket() = %q, want %q", got, test.want)
+			}
+			signed, _ := presignQuery(t, user)
+			if !strings.HasPrefix(signed.URL, "https://"+test.want+".s3.amazonaws.com/") {
+				t.Errorf("signed %s, want a URL for %s", signed.URL, test.want)
+			}
+		})
+	}
+}
+
+func TestTierFits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int64
+		used, size int64
+		want       bool
+	}{
+		{"room to spare", 100, 40, 50, true},
+		{"fills the quota exactly", 100, 40, 60, true},
+		{"one byte over", 100, 40, 61, false},
+		{"empty file on a full quota", 100, 100, 0, true},
+		{"already over quota", 100, 120, 0, false},
+		{"size near the int64 limit", 100, 40, math.MaxInt64, false},
+		{"unlimited tier near the int64 limit", math.MaxInt64, math.MaxInt64 - 10, 10, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tier := tierConfig{MaxStorage: test.limit}
+			if got := tier.fits(test.used, test.size); got != test.want {
+				t.Errorf("fits(%d, %d) with %d bytes = %v, want %v", test.used, test.size, test.limit, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    int64
+		want    int64
+		invalid bool
+	}{
+		{"small", 40, 60, 100, false},
+		{"zero", math.MaxInt64, 0, math.MaxInt64, false},
+		{"reaches the limit", math.MaxInt64 - 10, 10, math.MaxInt64, false},
+		{"one past the limit", math.MaxInt64 - 10, 11, 0, true},
+		{"both near the limit", math.MaxInt64, math.MaxInt64, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := addSizes(test.a, test.b)
+			if test.invalid {
+				if !errors.Is(err, ErrInvalidRequest) {
+					t.Errorf("addSizes(%d, %d) = %d, %v, want an invalid request", test.a, test.b, got, err)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("addSizes(%d, %d) = %d, %v, want %d", test.a, test.b, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestTierPublicRead(t *testing.T) {
+	tests := []struct {
+		name       string
+		tierPublic string
+		publicRead bool
+		wantErr    error
+		wantACL    string
+	}{
+		{"private upload", "", false, nil, ""},
+		{"public upload refused", "", true, ErrForbidden, ""},
+		{"public upload allowed", "true", true, nil, "public-read"},
+		{"private upload on a public tier", "true", false, nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TIER_1_PUBLIC_READ", test.tierPublic)
+			user := newTestUser()
+			user.ServiceTier = 1
+			user.PublicRead = test.publicRead
+			_, err := user.verifyUserGrants(withS3Storage(&awsClients{lister: newFakeS3()}))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("verifyUserGrants() error = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			signed, _ := presignQuery(t, user)
+			if got := signed.RequiredHeaders["x-amz-acl"]; got != test.wantACL {
+				t.Errorf("required x-amz-acl = %q, want %q", got, test.wantACL)
+			}
+		})
+	}
+}
+
+func TestTierName(t *testing.T) {
+	tests := []struct {
+		tier     int
+		override string
+		want     string
+	}{
+		{0, "", "free"},
+		{2, "", "enterprise"},
+		{1, "professional", "professional"},
+		{7, "", "tier 7"},
+		{7, "partner", "partner"},
+	}
+	for _, test := range tests {
+		t.Setenv("TIER_"+strconv.Itoa(test.tier)+"_NAME", test.override)
+		if got := tierName(test.tier); got != test.want {
+			t.Errorf("tierName(%d) with TIER_%d_NAME %q = %q, want %q", test.tier, test.tier, test.override, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//The key a deleted file is kept at under SOFT_DELETE_PREFIX, empty when soft delete is off.  The trash sits
+//outside the company prefix so a trashed file neither counts towards the quota nor shows in listings
+func (user *User) trashKey() string {
+	prefix := strings.TrimSuffix(setting("SOFT_DELETE_PREFIX"), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/" + user.objectKey()
+}
+
+//Copy the file to its trash key before its delete is signed, so an accidental deletion can be recovered until the
+//bucket's lifecycle rule for SOFT_DELETE_PREFIX expires it.  Returns the trash key, empty when soft delete is off
+//or nothing exists at the key
+func (user *User) moveToTrash(storage StorageBackend) (string, error) {
+	trash := user.trashKey()
+	if trash == "" {
+		return "", nil
+	}
+	copied, err := storage.Copy(user.bucket(), user.objectKey(), trash)
+	if err != nil {
+		return "", fmt.Errorf("copying %s to the trash: %w", user.objectKey(), err)
+	}
+	if !copied { //Nothing to keep
+		return "", nil
+	}
+	user.log.Printf("AUDIT: %s soft deleting %s, kept at %s\n", user.Sub, user.objectKey(), trash)
+	return trash, nil
+}
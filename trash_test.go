@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestTrashKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", ""},
+		{"trash", "trash/acme/file.txt"},
+		{"trash/", "trash/acme/file.txt"},
+	}
+	for _, test := range tests {
+		t.Setenv("SOFT_DELETE_PREFIX", test.prefix)
+		if got := newTestUser().trashKey(); got != test.want {
+			t.Errorf("trashKey() with SOFT_DELETE_PREFIX %q = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestMoveToTrash(t *testing.T) {
+	t.Setenv("SOFT_DELETE_PREFIX", "trash/")
+	captureLog(t)
+	tests := []struct {
+		name      string
+		copyErr   error
+		wantTrash string
+		wantErr   bool
+	}{
+		{"copied", nil, "trash/acme/my file.txt", false},
+		{"missing file", s3Error(s3.ErrCodeNoSuchKey), "", false},
+		{"copy failure", errors.New("access denied"), "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newFakeS3()
+			svc.copyErr = test.copyErr
+			user := newTestUser()
+			user.FileRequest = "my file.txt"
+			trash, err := user.moveToTrash(newS3TestStorage(svc))
+			if (err != nil) != test.wantErr || trash != test.wantTrash {
+				t.Fatalf("moveToTrash() = %q, %v, want %q", trash, err, test.wantTrash)
+			}
+			if len(svc.copies) != 1 {
+				t.Fatalf("copied %d times, want once", len(svc.copies))
+			}
+			input := svc.copies[0]
+			if aws.StringValue(input.CopySource) != "bucket/acme/my%20file.txt" || aws.StringValue(input.Key) != "trash/acme/my file.txt" {
+				t.Errorf("copied %s to %s, want the escaped source kept under the trash prefix",
+					aws.StringValue(input.CopySource), aws.StringValue(input.Key))
+			}
+		})
+	}
+}
+
+//Without SOFT_DELETE_PREFIX nothing is copied
+func TestMoveToTrashDisabled(t *testing.T) {
+	t.Setenv("SOFT_DELETE_PREFIX", "")
+	svc := newFakeS3()
+	if trash, err := newTestUser().moveToTrash(newS3TestStorage(svc)); trash != "" || err != nil || len(svc.copies) > 0 {
+		t.Errorf("moveToTrash() = %q, %v after %d copies, want nothing kept", trash, err, len(svc.copies))
+	}
+}
+
+//A signed delete returns where the file was kept
+func TestHandleRequestSoftDelete(t *testing.T) {
+	t.Setenv("SOFT_DELETE_PREFIX", "trash")
+	h, _ := newTestHandler(t, 1)
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"delete"}`)
+	var signed URLSign
+	if err := json.Unmarshal([]byte(response.Body), &signed); err != nil {
+		t.Fatalf("body %s is not a URLSign: %v", response.Body, err)
+	}
+	if response.StatusCode != 200 || signed.TrashKey != "trash/acme/file.txt" {
+		t.Errorf("response %d %s, want the trash key", response.StatusCode, response.Body)
+	}
+}
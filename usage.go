@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+//How many times a usage record write contended by other requests is retried
+const usageWriteAttempts = 5
+
+//usageRecord the item in USAGE_TABLE holding a company's pending uploads, those signed whose files may not be
+//stored yet.  The listing stays the authority on stored data, the record only covers the gap between a URL being
+//signed and its file being listed.  Every write increments Version and is conditional on the version read, so
+//concurrent requests for the company serialize on the item
+type usageRecord struct {
+	CompanyID string                   `json:"company_id"`
+	Version   int64                    `json:"version"`
+	Pending   map[string]pendingUpload `json:"pending,omitempty"` //Keyed by object key, re-signing a key replaces its entry
+}
+
+//pendingUpload the reservation of a signed upload, held until its file is listed or its URL expires
+type pendingUpload struct {
+	Token    string `json:"token"` //Identifies the reservation, so a retried write or release is only applied once
+	Size     int64  `json:"size"`
+	SignedAt int64  `json:"signed_at"` //Unix seconds the URL was reserved
+	Expires  int64  `json:"expires"`   //Unix seconds the URL stops working, after which nothing more can land
+}
+
+//reservation an upload's pending entry in USAGE_TABLE, released when the URL isn't handed out after all
+type reservation struct {
+	user   *User
+	db     dynamodbiface.DynamoDBAPI
+	key    string
+	upload pendingUpload
+}
+
+//Whether the upload no longer needs reserving, either its URL has expired or its file is in the listing.  The
+//object seen at the key landed from this upload when it was modified no earlier than the URL was signed, an
+//older object is the file the upload will overwrite
+func (upload pendingUpload) settled(object StoredObject, listed bool, now time.Time) bool {
+	if now.Unix() >= upload.Expires {
+		return true
+	}
+	return listed && !object.LastModified.Before(time.Unix(upload.SignedAt, 0))
+}
+
+//The bytes the record's unsettled uploads will add on top of the listing seen, skipping the key being reserved.
+//An upload overwriting a listed file only adds what it is larger by.  Nil records hold nothing
+func (record *usageRecord) pendingBytes(seen map[string]StoredObject, skip string, now time.Time) int64 {
+	if record == nil {
+		return 0
+	}
+	var total int64
+	for key, upload := range record.Pending {
+		object, listed := seen[key]
+		if key == skip || upload.settled(object, listed, now) {
+			continue
+		}
+		if upload.Size > object.Size {
+			total += upload.Size - object.Size
+		}
+	}
+	return total
+}
+
+//Remove the settled uploads so the record only holds those still in flight
+func (record *usageRecord) sweep(seen map[string]StoredObject, now time.Time) {
+	for key, upload := range record.Pending {
+		object, listed := seen[key]
+		if upload.settled(object, listed, now) {
+			delete(record.Pending, key)
+		}
+	}
+}
+
+//Read the company's usage record so its pending uploads can be counted with the listing, nil when USAGE_TABLE is
+//unset or unavailable
+func (user *User) readUsage(db dynamodbiface.DynamoDBAPI) *usageRecord {
+	if user.config.UsageTable == "" {
+		return nil
+	}
+	record, err := user.getUsage(db)
+	if err != nil {
+		user.quotaCacheUnavailable(err)
+		return nil
+	}
+	return record
+}
+
+//Get the company's usage record with a consistent read, an empty record when the company has none yet
+func (user *User) getUsage(db dynamodbiface.DynamoDBAPI) (*usageRecord, error) {
+	result, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(user.config.UsageTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"company_id": {S: aws.String(user.CompanyID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting usage for %s: %w", user.CompanyID, err)
+	}
+	record := &usageRecord{CompanyID: user.CompanyID}
+	if len(result.Item) > 0 {
+		err = unmarshalRecord(result.Item, record)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshaling usage for %s: %w", user.CompanyID, err)
+		}
+	}
+	if record.Pending == nil {
+		record.Pending = map[string]pendingUpload{}
+	}
+	return record, nil
+}
+
+//Write the record as the next version, conditional on nobody having written since it was read
+func (user *User) putUsage(db dynamodbiface.DynamoDBAPI, record *usageRecord) error {
+	read := record.Version
+	record.Version++
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(user.config.UsageTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(company_id) OR version = :version"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatInt(read, 10))},
+		},
+	})
+	return err
+}
+
+//Reserve the upload in the company's usage record in USAGE_TABLE once every other check has passed, so of two
+//concurrent requests that both passed the listing check only those that still fit alongside the other pending
+//uploads are reserved and the rest rejected as over quota.  stored is the bytes listed once the upload replaces
+//any file at its key.  The reservation lasts until the file is listed or the URL expires, and is released if the
+//URL isn't signed after all.  When the record is unavailable the listing check the upload already passed is
+//relied on instead of failing the request
+func (user *User) reserveUsage(db dynamodbiface.DynamoDBAPI, plan *quotaPlan, stored int64) (*reservation, error) {
+	if user.config.UsageTable == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	size := int64(user.FileSize)
+	reserved := &reservation{user: user, db: db, key: user.objectKey(), upload: pendingUpload{
+		Token:    newUUID(),
+		Size:     size,
+		SignedAt: now.Unix(),
+		Expires:  now.Add(clampExpiry(user.log, user.urlExpiry())).Unix(),
+	}}
+	record := plan.record
+	for attempt := 1; attempt <= usageWriteAttempts; attempt++ {
+		if record == nil || attempt > 1 {
+			var err error
+			record, err = user.getUsage(db)
+			if err != nil {
+				user.quotaCacheUnavailable(err)
+				return nil, nil
+			}
+			if record.Pending[reserved.key].Token == reserved.upload.Token { //A retry of a write that landed
+				return reserved, nil
+			}
+		}
+		used, err := addSizes(stored, record.pendingBytes(plan.seen, reserved.key, now))
+		if err != nil {
+			return nil, err
+		}
+		if !plan.tier.fits(used, size) {
+			return nil, ErrQuotaExceeded
+		}
+		record.sweep(plan.seen, now)
+		record.Pending[reserved.key] = reserved.upload
+		err = user.putUsage(db, record)
+		if err == nil {
+			return reserved, nil
+		}
+		if !conditionFailed(err) {
+			user.quotaCacheUnavailable(fmt.Errorf("reserving usage for %s: %w", user.CompanyID, err))
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: usage for %s is contended by other uploads", ErrRateLimited, user.CompanyID)
+}
+
+//Remove the reservation from the usage record so an upload whose URL was never handed out doesn't hold quota.
+//Only the entry with the reservation's token is removed, so a retried release never removes a newer reservation
+//of the same key.  Nil reservations release nothing
+func (reserved *reservation) release() {
+	if reserved == nil {
+		return
+	}
+	err := reserved.user.removePending(reserved.db, reserved.key, reserved.upload.Token)
+	if err != nil {
+		reserved.user.log.Printf("WARNING: unable to release the reservation of %s, it lapses when the URL expires\n", reserved.key)
+	}
+}
+
+//The size reserved for the upload to the user's key when its URL was signed, false without USAGE_TABLE, when the
+//record is unavailable or when the key has no reservation
+func (user *User) reservedSize(db dynamodbiface.DynamoDBAPI) (int64, bool) {
+	if user.config.UsageTable == "" {
+		return 0, false
+	}
+	record, err := user.getUsage(db)
+	if err != nil {
+		user.quotaCacheUnavailable(err)
+		return 0, false
+	}
+	upload, ok := record.Pending[user.objectKey()]
+	return upload.Size, ok
+}
+
+//Remove any reservation of the key being deleted, so an upload signed for it stops holding quota once its file
+//is going away.  Nothing is removed without USAGE_TABLE
+func (user *User) releaseDeleted(db dynamodbiface.DynamoDBAPI) {
+	if user.config.UsageTable == "" {
+		return
+	}
+	key := user.objectKey()
+	err := user.removePending(db, key, "")
+	if err != nil {
+		user.log.Printf("WARNING: unable to release the reservation of deleted %s, it lapses when the URL expires\n", key)
+	}
+}
+
+//Remove the key's pending entry, only when it has the token unless the token is empty.  Like every write the
+//removal is conditional on the version read, and retried when another request wrote in between.  An unavailable
+//record is logged and left as is, only contention past the retries is returned
+func (user *User) removePending(db dynamodbiface.DynamoDBAPI, key, token string) error {
+	for attempt := 1; attempt <= usageWriteAttempts; attempt++ {
+		record, err := user.getUsage(db)
+		if err != nil {
+			user.quotaCacheUnavailable(err)
+			return nil
+		}
+		upload, pending := record.Pending[key]
+		if !pending || token != "" && upload.Token != token { //Already released or replaced
+			return nil
+		}
+		delete(record.Pending, key)
+		err = user.putUsage(db, record)
+		if err == nil || !conditionFailed(err) {
+			if err != nil {
+				user.quotaCacheUnavailable(fmt.Errorf("releasing usage for %s: %w", user.CompanyID, err))
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: usage for %s is contended by other uploads", ErrRateLimited, user.CompanyID)
+}
+
+//Log and count a failed usage record read or write, the listing is relied on alone
+func (user *User) quotaCacheUnavailable(err error) {
+	user.log.Printf("WARNING: usage record unavailable, falling back to the listed total: %v\n", err)
+	emitMetric("QuotaCacheUnavailable", 1)
+}
+
+//Whether the write was rejected by its condition expression
+func conditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// A user of the acme company uploading size bytes to the key, with USAGE_TABLE configured
+func newUsageUser(key string, size int) *User {
+	user := newTestUser()
+	user.FileRequest = key
+	user.FileSize = size
+	user.config.UsageTable = "usage"
+	return user
+}
+
+// A quota plan for a tier limited to limit bytes with nothing listed
+func newTestPlan(limit int64) *quotaPlan {
+	return &quotaPlan{tier: tierConfig{MaxStorage: limit}, seen: map[string]StoredObject{}}
+}
+
+// The company's pending uploads as stored in the fake table
+func pendingUploads(t *testing.T, db *fakeDynamo) map[string]pendingUpload {
+	t.Helper()
+	record, err := newUsageUser("", 0).getUsage(db)
+	if err != nil {
+		t.Fatalf("getUsage() error = %v", err)
+	}
+	return record.Pending
+}
+
+// Two requests that both passed the listing check race to reserve, only the one that still fits is reserved
+func TestReserveUsageConcurrent(t *testing.T) {
+	db := newFakeDynamo()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, key := range []string{"a.txt", "b.txt"} {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			_, errs[i] = newUsageUser(key, 600).reserveUsage(db, newTestPlan(1000), 0)
+		}(i, key)
+	}
+	wg.Wait()
+	reserved, rejected := 0, 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			reserved++
+		case errors.Is(err, ErrQuotaExceeded):
+			rejected++
+		default:
+			t.Errorf("reserveUsage() error = %v", err)
+		}
+	}
+	if reserved != 1 || rejected != 1 {
+		t.Errorf("%d reserved and %d rejected, want one of each", reserved, rejected)
+	}
+	if pending := pendingUploads(t, db); len(pending) != 1 {
+		t.Errorf("pending = %v, want the one reserved upload", pending)
+	}
+}
+
+// However many requests race, the reservations never add up to more than the limit
+func TestReserveUsageConcurrentNeverExceedsLimit(t *testing.T) {
+	db := newFakeDynamo()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := newUsageUser(string(rune('a'+i))+".txt", 300).reserveUsage(db, newTestPlan(1000), 100)
+			if err != nil && !errors.Is(err, ErrQuotaExceeded) && !errors.Is(err, ErrRateLimited) {
+				t.Errorf("reserveUsage() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var total int64 = 100
+	for _, upload := range pendingUploads(t, db) {
+		total += upload.Size
+	}
+	if total > 1000 {
+		t.Errorf("stored and reserved %d bytes, over the 1000 byte limit", total)
+	}
+}
+
+func TestReserveUsageResignReplaces(t *testing.T) {
+	db := newFakeDynamo()
+	for i := 0; i < 3; i++ {
+		_, err := newUsageUser("a.txt", 600).reserveUsage(db, newTestPlan(1000), 0)
+		if err != nil {
+			t.Fatalf("re-signing %d: reserveUsage() error = %v, want the reservation replaced", i, err)
+		}
+	}
+	if pending := pendingUploads(t, db); len(pending) != 1 || pending["acme/a.txt"].Size != 600 {
+		t.Errorf("pending = %v, want one 600 byte reservation", pending)
+	}
+}
+
+func TestPendingBytes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signed := now.Add(-time.Minute).Unix()
+	live := now.Add(time.Hour).Unix()
+	record := &usageRecord{Pending: map[string]pendingUpload{
+		"acme/in-flight":  {Size: 100, SignedAt: signed, Expires: live},
+		"acme/expired":    {Size: 200, SignedAt: signed, Expires: now.Unix()},
+		"acme/landed":     {Size: 400, SignedAt: signed, Expires: live},
+		"acme/overwrite":  {Size: 800, SignedAt: signed, Expires: live},
+		"acme/shrinking":  {Size: 10, SignedAt: signed, Expires: live},
+		"acme/reserving":  {Size: 1600, SignedAt: signed, Expires: live},
+		"acme/same-clock": {Size: 3200, SignedAt: signed, Expires: live},
+	}}
+	seen := map[string]StoredObject{
+		"acme/landed":     {Key: "acme/landed", Size: 400, LastModified: now.Add(-time.Second)},
+		"acme/overwrite":  {Key: "acme/overwrite", Size: 300, LastModified: now.Add(-time.Hour)},
+		"acme/shrinking":  {Key: "acme/shrinking", Size: 50, LastModified: now.Add(-time.Hour)},
+		"acme/same-clock": {Key: "acme/same-clock", Size: 3200, LastModified: time.Unix(signed, 0)},
+	}
+	//in-flight counts in full, the overwrite by what it grows, the rest are settled, shrinking or being reserved
+	if got, want := record.pendingBytes(seen, "acme/reserving", now), int64(100+500); got != want {
+		t.Errorf("pendingBytes() = %d, want %d", got, want)
+	}
+	record.sweep(seen, now)
+	for _, key := range []string{"acme/expired", "acme/landed", "acme/same-clock"} {
+		if _, ok := record.Pending[key]; ok {
+			t.Errorf("sweep() kept the settled %s", key)
+		}
+	}
+	if len(record.Pending) != 4 {
+		t.Errorf("sweep() left %v, want the 4 uploads still in flight", record.Pending)
+	}
+	if (*usageRecord)(nil).pendingBytes(seen, "", now) != 0 {
+		t.Error("pendingBytes() of a nil record, want 0")
+	}
+}
+
+func TestReserveUsageCountsPending(t *testing.T) {
+	db := newFakeDynamo()
+	if _, err := newUsageUser("a.txt", 500).reserveUsage(db, newTestPlan(1000), 0); err != nil {
+		t.Fatalf("reserveUsage() error = %v", err)
+	}
+	_, err := newUsageUser("b.txt", 600).reserveUsage(db, newTestPlan(1000), 0)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("reserveUsage() error = %v, want %v alongside the pending upload", err, ErrQuotaExceeded)
+	}
+	plan := newTestPlan(1000)
+	plan.seen["acme/a.txt"] = StoredObject{Key: "acme/a.txt", Size: 500, LastModified: time.Now().Add(time.Second)}
+	if _, err := newUsageUser("b.txt", 500).reserveUsage(db, plan, 500); err != nil {
+		t.Fatalf("reserveUsage() error = %v, want the landed upload counted once by the listing", err)
+	}
+	if pending := pendingUploads(t, db); len(pending) != 1 || pending["acme/b.txt"].Size != 500 {
+		t.Errorf("pending = %v, want only b.txt once a.txt landed", pending)
+	}
+}
+
+func TestReservationRelease(t *testing.T) {
+	db := newFakeDynamo()
+	reserved, err := newUsageUser("a.txt", 600).reserveUsage(db, newTestPlan(1000), 0)
+	if err != nil || reserved == nil {
+		t.Fatalf("reserveUsage() = %v, %v, want a reservation", reserved, err)
+	}
+	reserved.release()
+	if pending := pendingUploads(t, db); len(pending) != 0 {
+		t.Errorf("pending = %v after release, want nothing", pending)
+	}
+	if _, err := newUsageUser("b.txt", 1000).reserveUsage(db, newTestPlan(1000), 0); err != nil {
+		t.Errorf("reserveUsage() error = %v, want the released quota available", err)
+	}
+	(*reservation)(nil).release() //Nothing reserved without USAGE_TABLE
+}
+
+func TestReservationReleaseKeepsNewerReservation(t *testing.T) {
+	db := newFakeDynamo()
+	first, err := newUsageUser("a.txt", 100).reserveUsage(db, newTestPlan(1000), 0)
+	if err != nil {
+		t.Fatalf("reserveUsage() error = %v", err)
+	}
+	if _, err := newUsageUser("a.txt", 200).reserveUsage(db, newTestPlan(1000), 0); err != nil {
+		t.Fatalf("reserveUsage() error = %v", err)
+	}
+	first.release()
+	if pending := pendingUploads(t, db); pending["acme/a.txt"].Size != 200 {
+		t.Errorf("pending = %v, want the newer 200 byte reservation kept", pending)
+	}
+}
+
+func TestReserveUsageWithoutTable(t *testing.T) {
+	user := newUsageUser("a.txt", 600)
+	user.config.UsageTable = ""
+	reserved, err := user.reserveUsage(newFakeDynamo(), newTestPlan(1000), 0)
+	if reserved != nil || err != nil {
+		t.Errorf("reserveUsage() = %v, %v, want nothing reserved without USAGE_TABLE", reserved, err)
+	}
+}
+
+// retriedDynamo applies every PutItem twice, as the SDK does when retrying a write whose response was lost
+type retriedDynamo struct {
+	*fakeDynamo
+}
+
+func (db retriedDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	_, err := db.fakeDynamo.PutItem(input)
+	if err != nil {
+		return nil, err
+	}
+	return db.fakeDynamo.PutItem(input)
+}
+
+func TestReserveUsageRetriedWrite(t *testing.T) {
+	db := newFakeDynamo()
+	reserved, err := newUsageUser("a.txt", 600).reserveUsage(retriedDynamo{db}, newTestPlan(1000), 0)
+	if err != nil || reserved == nil {
+		t.Fatalf("reserveUsage() = %v, %v, want the retried write recognized as reserved", reserved, err)
+	}
+	if db.puts != 2 {
+		t.Errorf("%d writes, want the retried write suppressed rather than reapplied", db.puts)
+	}
+	pending := pendingUploads(t, db)
+	if len(pending) != 1 || pending["acme/a.txt"].Token != reserved.upload.Token {
+		t.Errorf("pending = %v, want the one reservation", pending)
+	}
+}
+
+func TestReservationReleaseRetried(t *testing.T) {
+	tests := []struct {
+		name    string
+		between func(t *testing.T, db *fakeDynamo) *reservation //Runs between the release and its retry, returning what must survive
+	}{
+		{"release retried", func(t *testing.T, db *fakeDynamo) *reservation { return nil }},
+		{"release A, release B, retry A", func(t *testing.T, db *fakeDynamo) *reservation {
+			b, err := newUsageUser("b.txt", 100).reserveUsage(db, newTestPlan(1000), 0)
+			if err != nil {
+				t.Fatalf("reserveUsage() error = %v", err)
+			}
+			b.release()
+			kept, err := newUsageUser("b.txt", 100).reserveUsage(db, newTestPlan(1000), 0)
+			if err != nil {
+				t.Fatalf("reserveUsage() error = %v", err)
+			}
+			return kept
+		}},
+		{"key re-signed before the retry", func(t *testing.T, db *fakeDynamo) *reservation {
+			kept, err := newUsageUser("a.txt", 100).reserveUsage(db, newTestPlan(1000), 0)
+			if err != nil {
+				t.Fatalf("reserveUsage() error = %v", err)
+			}
+			return kept
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDynamo()
+			a, err := newUsageUser("a.txt", 100).reserveUsage(db, newTestPlan(1000), 0)
+			if err != nil {
+				t.Fatalf("reserveUsage() error = %v", err)
+			}
+			a.release()
+			kept := test.between(t, db)
+			a.release()
+			pending := pendingUploads(t, db)
+			if kept == nil {
+				if len(pending) != 0 {
+					t.Errorf("pending = %v, want nothing", pending)
+				}
+				return
+			}
+			if len(pending) != 1 || pending[kept.key].Token != kept.upload.Token {
+				t.Errorf("pending = %v, want only the later reservation of %s", pending, kept.key)
+			}
+		})
+	}
+}
+
+// racingDynamo runs the write of another request before the first PutItem, so that written version fails the condition
+type racingDynamo struct {
+	*fakeDynamo
+	race func()
+}
+
+func (db *racingDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if db.race != nil {
+		race := db.race
+		db.race = nil
+		race()
+	}
+	return db.fakeDynamo.PutItem(input)
+}
+
+// Deleting a key removes its reservation whichever upload reserved it, retrying on the version like every write
+func TestReleaseDeleted(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		race     bool
+		wantPuts int
+		wantKeys []string
+	}{
+		{"reserved key", "a.txt", false, 1, []string{"acme/b.txt"}},
+		{"written in between", "a.txt", true, 3, []string{"acme/b.txt", "acme/c.txt"}},
+		{"key not reserved", "d.txt", false, 0, []string{"acme/a.txt", "acme/b.txt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newFakeDynamo()
+			for _, key := range []string{"a.txt", "b.txt"} {
+				_, err := newUsageUser(key, 100).reserveUsage(db, newTestPlan(1000), 0)
+				if err != nil {
+					t.Fatalf("reserveUsage() error = %v", err)
+				}
+			}
+			db.puts = 0
+			racing := &racingDynamo{fakeDynamo: db}
+			if test.race {
+				racing.race = func() {
+					_, err := newUsageUser("c.txt", 100).reserveUsage(db, newTestPlan(1000), 0)
+					if err != nil {
+						t.Fatalf("reserveUsage() error = %v", err)
+					}
+				}
+			}
+			newUsageUser(test.key, 0).releaseDeleted(racing)
+			var keys []string
+			for key := range pendingUploads(t, db) {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, test.wantKeys) {
+				t.Errorf("pending = %v, want %v", keys, test.wantKeys)
+			}
+			if db.puts != test.wantPuts {
+				t.Errorf("%d writes, want %d", db.puts, test.wantPuts)
+			}
+		})
+	}
+}
+
+// Signing a delete releases the deleted key's reservation
+func TestHandleRequestDeleteReleases(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	h.config.UsageTable = "usage"
+	db := clients.dynamo.(*fakeDynamo)
+	now := time.Now()
+	db.put("usage", usageRecord{CompanyID: "acme", Version: 1, Pending: map[string]pendingUpload{
+		"acme/file.txt":  {Token: "deleted", Size: 100, SignedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+		"acme/other.txt": {Token: "other", Size: 100, SignedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+	}})
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"delete"}`)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("response %d %s, want the delete signed", response.StatusCode, response.Body)
+	}
+	if pending := pendingUploads(t, db); len(pending) != 1 || pending["acme/other.txt"].Token != "other" {
+		t.Errorf("pending = %v, want only the reservation of other.txt", pending)
+	}
+}
+
+// Uploads are still signed while the usage record can't be written
+func TestHandleRequestUsageUnavailable(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	h.config.UsageTable = "usage"
+	clients.dynamo.(*fakeDynamo).putErr = errors.New("throttled")
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("response %d %s, want it signed", response.StatusCode, response.Body)
+	}
+}
+
+// failingStorage fails every signing
+type failingStorage struct {
+	StorageBackend
+}
+
+func (storage failingStorage) Presign(user *User) (*URLSign, error) {
+	return nil, errors.New("signing failed")
+}
+
+// An upload that can't be signed releases its reservation rather than holding the quota until it expires
+func TestHandleRequestSigningFailureReleases(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	h.config.UsageTable = "usage"
+	db := clients.dynamo.(*fakeDynamo)
+	clients.storage = failingStorage{StorageBackend: clients.storage}
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500: %s", response.StatusCode, response.Body)
+	}
+	if pending := pendingUploads(t, db); len(pending) != 0 {
+		t.Errorf("pending uploads = %v, want the reservation released", pending)
+	}
+	if db.puts != 2 {
+		t.Errorf("usage written %d times, want a reservation and its release", db.puts)
+	}
+}
+
+// An upload the listing allows is still rejected when the company's pending uploads leave no room for it
+func TestHandleRequestUploadReserved(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	h.config.UsageTable = "usage"
+	db := clients.dynamo.(*fakeDynamo)
+	now := time.Now()
+	db.put("usage", usageRecord{CompanyID: "acme", Version: 1, Pending: map[string]pendingUpload{
+		"acme/other.txt": {Size: tierFor(1).MaxStorage - 50, SignedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+	}})
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":100}`)
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("response %d %s, want a 403 over quota", response.StatusCode, response.Body)
+	}
+	response = post(t, h, `{"sub":"sub-1","file_request":"file.txt","file_size":50}`)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("response %d %s, want the upload signed", response.StatusCode, response.Body)
+	}
+	if pending := pendingUploads(t, db); pending["acme/file.txt"].Size != 50 {
+		t.Errorf("pending = %v, want the upload reserved", pending)
+	}
+}
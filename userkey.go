@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//The key attributes of the user table.  Tables keyed by sub alone need nothing configured, composite tables set
+//DYNAMO_PARTITION_KEY and DYNAMO_SORT_KEY, e.g. company_id and sub
+func (config *Config) userKeyAttributes() []string {
+	partition := config.PartitionKey
+	if partition == "" {
+		partition = "sub"
+	}
+	attributes := []string{partition}
+	if config.SortKey != "" {
+		attributes = append(attributes, config.SortKey)
+	}
+	return attributes
+}
+
+//Whether the attribute can be part of the user table's key, only those a request supplies can
+func userKeyAttribute(attribute string) bool {
+	return attribute == "sub" || attribute == "company_id"
+}
+
+//Whether user records are keyed by company, in which case the record itself proves membership of the company
+func (config *Config) userKeyIncludesCompany() bool {
+	for _, attribute := range config.userKeyAttributes() {
+		if attribute == "company_id" {
+			return true
+		}
+	}
+	return false
+}
+
+//The key of the user record for the request
+func (user *User) userKey() (map[string]*dynamodb.AttributeValue, error) {
+	key := map[string]*dynamodb.AttributeValue{}
+	for _, attribute := range user.config.userKeyAttributes() {
+		switch attribute {
+		case "sub":
+			key[attribute] = &dynamodb.AttributeValue{S: aws.String(user.Sub)}
+		case "company_id":
+			if user.companyOverride == "" {
+				return nil, fmt.Errorf("%w: company_id is required", ErrInvalidRequest)
+			}
+			key[attribute] = &dynamodb.AttributeValue{S: aws.String(user.companyOverride)}
+		default:
+			return nil, fmt.Errorf("unsupported user table key attribute %s", attribute)
+		}
+	}
+	return key, nil
+}
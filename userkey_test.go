@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestUserKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		partition string
+		sort      string
+		company   string
+		want      map[string]*dynamodb.AttributeValue
+		wantErr   error
+	}{
+		{"sub", "", "", "", map[string]*dynamodb.AttributeValue{"sub": {S: aws.String("sub-1")}}, nil},
+		{"company and sub", "company_id", "sub", "acme", map[string]*dynamodb.AttributeValue{
+			"company_id": {S: aws.String("acme")}, "sub": {S: aws.String("sub-1")},
+		}, nil},
+		{"company missing", "company_id", "sub", "", nil, ErrInvalidRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			user.config.PartitionKey, user.config.SortKey = test.partition, test.sort
+			user.companyOverride = test.company
+			key, err := user.userKey()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("userKey() error = %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(key, test.want) {
+				t.Errorf("userKey() = %v, want %v", key, test.want)
+			}
+		})
+	}
+}
+
+//An attribute the request can't supply is a misconfiguration rather than a bad request
+func TestUserKeyUnsupportedAttribute(t *testing.T) {
+	user := newTestUser()
+	user.config.PartitionKey = "email"
+	_, err := user.userKey()
+	if err == nil || errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("userKey() error = %v, want an internal error", err)
+	}
+}
+
+//Users of several companies have a record per company, the one for the requested company is used
+func TestHandleRequestCompositeUserKey(t *testing.T) {
+	h, clients := newTestHandler(t, 1)
+	h.config.PartitionKey, h.config.SortKey = "company_id", "sub"
+	clients.dynamo.(*fakeDynamo).put("users", User{Sub: "sub-1", CompanyID: "globex", Payed: true, ServiceTier: 1})
+	response := post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download","company_id":"globex"}`)
+	if response.StatusCode != 200 || !strings.Contains(response.Body, "bucket.s3.amazonaws.com/globex/file.txt") {
+		t.Errorf("response %d %s, want a URL for globex's file", response.StatusCode, response.Body)
+	}
+	response = post(t, h, `{"sub":"sub-1","file_request":"file.txt","operation":"download","company_id":"initech"}`)
+	if response.StatusCode != 404 {
+		t.Errorf("response %d %s, want no user record for initech", response.StatusCode, response.Body)
+	}
+}
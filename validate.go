@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//Validate check the request level invariants before touching AWS, every failed rule is reported in the error
+func (user *User) Validate() error {
+	var problems, filenameProblems []string
+	if user.Sub == "" {
+		problems = append(problems, "sub is required")
+	}
+	if user.FileRequest == "" && user.operation() != operationList && user.operation() != operationValidateUsers {
+		problems = append(problems, "file_request is required")
+	}
+	if !withinCompanyPrefix(user.FileRequest) {
+		filenameProblems = append(filenameProblems, "file_request must not start with / or contain . or .. segments")
+	}
+	if maxLength := envInt("MAX_FILENAME_LENGTH", 255); utf8.RuneCountInString(path.Base(user.FileRequest)) > maxLength {
+		filenameProblems = append(filenameProblems, fmt.Sprintf("file name must be at most %d characters", maxLength))
+	}
+	if rule := blockedFileRule(user.FileRequest); rule != "" && user.operation() == operationUpload {
+		filenameProblems = append(filenameProblems, "file_request is blocked by "+rule)
+	}
+	if user.FileSize < 0 {
+		problems = append(problems, "file_size must not be negative")
+	}
+	problems = append(problems, user.validateQueryParameters()...)
+	switch user.operation() {
+	case operationUpload:
+		problems = append(problems, user.validateUpload()...)
+	case operationDownload:
+		problems = append(problems, user.validateDownload()...)
+	case operationList:
+		if user.MaxKeys < 0 || user.MaxKeys > 1000 {
+			problems = append(problems, "max_keys must be between 0 and 1000")
+		}
+	case operationValidateUsers:
+		if len(user.Subs) == 0 {
+			problems = append(problems, "subs are required")
+		}
+	case operationTag:
+		problems = append(problems, user.validateTags()...)
+	case operationDelete, operationVerify, operationHead:
+	default:
+		problems = append(problems, "unknown operation "+user.Operation)
+	}
+	if len(filenameProblems) > 0 { //Reported with their own code so clients can ask for a different name
+		return fmt.Errorf("%w: %s", ErrInvalidFilename, strings.Join(append(filenameProblems, problems...), "; "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidRequest, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//Rules for the options only used on uploads
+func (user *User) validateUpload() []string {
+	var problems []string
+	if user.ObjectLockMode != "" || user.ObjectLockRetainUntil != nil {
+		switch user.ObjectLockMode {
+		case s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+		default:
+			problems = append(problems, "object lock mode must be GOVERNANCE or COMPLIANCE")
+		}
+		if user.ObjectLockRetainUntil == nil {
+			problems = append(problems, "object lock requires a retain until date")
+		} else if !user.ObjectLockRetainUntil.After(time.Now()) {
+			problems = append(problems, "object lock retain until date must be in the future")
+		}
+		if user.ChecksumAlgorithm == "" { //S3 rejects locked puts without Content-MD5 or an x-amz-checksum
+			problems = append(problems, "object lock requires checksum_algorithm and checksum")
+		}
+	}
+	if user.StorageClass != "" && !validStorageClass(user.StorageClass) {
+		problems = append(problems, "invalid storage class "+user.StorageClass)
+	}
+	if user.ContentType != "" && !validContentType(user.ContentType) {
+		problems = append(problems, "invalid content type "+user.ContentType)
+	}
+	if user.DownloadFilename != "" && contentDisposition(user.DownloadFilename) == "" {
+		problems = append(problems, "invalid download filename")
+	}
+	problems = append(problems, user.validateChecksum()...)
+	return problems
+}
+
+//Rules for the options only used on downloads
+func (user *User) validateDownload() []string {
+	var problems []string
+	if user.DownloadFilename != "" && contentDisposition(user.DownloadFilename) == "" {
+		problems = append(problems, "invalid download filename")
+	}
+	if user.DownloadContentType != "" && !validContentType(user.DownloadContentType) {
+		problems = append(problems, "invalid download content type "+user.DownloadContentType)
+	}
+	return problems
+}
+
+//Check a content type is a well formed type/subtype MIME type
+func validContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.Contains(mediaType, "/")
+}
+
+//Keys must stay within the company prefix, relative segments could escape it once a client normalizes the path
+func withinCompanyPrefix(file string) bool {
+	if strings.HasPrefix(file, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(file, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+//Check the storage class is one S3 accepts on a PutObject
+func validStorageClass(class string) bool {
+	for _, valid := range s3.StorageClass_Values() {
+		if class == valid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(user *User)
+		wantErr error
+		want    []string
+	}{
+		{"valid upload", func(user *User) {}, nil, nil},
+		{"valid verify", func(user *User) { user.Operation = operationVerify }, nil, nil},
+		{"missing sub", func(user *User) { user.Sub = "" }, ErrInvalidRequest, []string{"sub is required"}},
+		{"missing file", func(user *User) { user.FileRequest = "" }, ErrInvalidRequest, []string{"file_request is required"}},
+		{"negative size", func(user *User) { user.FileSize = -1 }, ErrInvalidRequest, []string{"file_size must not be negative"}},
+		{"unknown operation", func(user *User) { user.Operation = "rename" }, ErrInvalidRequest, []string{"unknown operation rename"}},
+		{"escaping the company prefix", func(user *User) { user.FileRequest = "docs/../../globex/file.txt" }, ErrInvalidFilename,
+			[]string{"file_request must not start with / or contain . or .. segments"}},
+		{"tag without tags", func(user *User) { user.Operation = operationTag }, ErrInvalidRequest, []string{"tags are required"}},
+		{"every problem reported", func(user *User) { user.Sub = ""; user.FileSize = -1 }, ErrInvalidRequest,
+			[]string{"sub is required", "file_size must not be negative"}},
+		{"filename problems reported with the rest", func(user *User) { user.FileRequest = "./file.txt"; user.Sub = "" },
+			ErrInvalidFilename, []string{"contain . or .. segments", "sub is required"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestUser()
+			test.change(user)
+			err := user.Validate()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Validate() error = %v, want %v", err, test.wantErr)
+			}
+			for _, problem := range test.want {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("Validate() error = %q, want it to report %q", err, problem)
+				}
+			}
+		})
+	}
+}
+
+func TestWithinCompanyPrefix(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"file.txt", true},
+		{"docs/2024/file.txt", true},
+		{"file..txt", true},
+		{".hidden", true},
+		{"/file.txt", false},
+		{"./file.txt", false},
+		{"docs/../file.txt", false},
+		{"..", false},
+	}
+	for _, test := range tests {
+		if got := withinCompanyPrefix(test.file); got != test.want {
+			t.Errorf("withinCompanyPrefix(%q) = %v, want %v", test.file, got, test.want)
+		}
+	}
+}
+
+func TestValidateFilenameLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   string
+		file    string
+		wantErr bool
+	}{
+		{"at the default limit", "", strings.Repeat("a", 255), false},
+		{"past the default limit", "", strings.Repeat("a", 256), true},
+		{"counted in characters", "", strings.Repeat("é", 255), false},
+		{"folders not counted", "", strings.Repeat("d", 200) + "/" + strings.Repeat("a", 200), false},
+		{"at a configured limit", "10", "docs/abcdefghij", false},
+		{"past a configured limit", "10", "docs/abcdefghijk", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_FILENAME_LENGTH", test.limit)
+			user := newTestUser()
+			user.FileRequest = test.file
+			err := user.Validate()
+			if test.wantErr != errors.Is(err, ErrInvalidFilename) {
+				t.Errorf("Validate() error = %v, want a file name error %v", err, test.wantErr)
+			}
+			if test.wantErr && !strings.Contains(err.Error(), "file name must be at most") {
+				t.Errorf("Validate() error = %q, want it to report the length limit", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+)
+
+//UploadVerification json object describing an uploaded object compared to what was declared when signing
+type UploadVerification struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	DeclaredSize int    `json:"declared_size"`
+	ETag         string `json:"etag"` //The stored object's ETag without quotes, the hex MD5 of the file for a single PUT
+	Verified     bool   `json:"verified"`
+}
+
+//Check an upload after the fact since a presigned PUT can't enforce its size.  The file_size sent to verify is only
+//the client's word, so the object is compared to the size reserved in USAGE_TABLE when its URL was signed, and
+//without a reservation the quota is always checked.  If the object is larger and takes the company over its quota
+//the object is deleted along with its reservation
+func (user *User) verifyUpload(clients *awsClients) (*UploadVerification, error) {
+	object, err := clients.storage.Head(user.bucket(), user.objectKey())
+	if err != nil {
+		return nil, fmt.Errorf("getting uploaded object %s: %w", user.objectKey(), err)
+	}
+	if object == nil {
+		return nil, fmt.Errorf("%w: nothing has been uploaded to %s", ErrInvalidRequest, user.objectKey())
+	}
+	verification := &UploadVerification{
+		Key:          user.objectKey(),
+		Size:         object.Size,
+		DeclaredSize: user.FileSize,
+		ETag:         object.ETag,
+		Verified:     true,
+	}
+	reserved, ok := user.reservedSize(clients.dynamo)
+	if ok {
+		verification.DeclaredSize = int(reserved)
+		if verification.Size <= reserved {
+			return verification, nil
+		}
+		user.log.Printf("Upload %s is %d bytes, reserved %d\n", verification.Key, verification.Size, reserved)
+	}
+	totalSize, err := user.calculateObjectSize(clients.storage) //Includes the uploaded object
+	if err != nil {
+		return nil, err
+	}
+	if tierFor(user.ServiceTier).fits(totalSize, 0) {
+		return verification, nil
+	}
+	err = clients.storage.Delete(user.bucket(), user.objectKey())
+	if err != nil {
+		return nil, fmt.Errorf("deleting over quota object %s: %w", user.objectKey(), err)
+	}
+	user.releaseDeleted(clients.dynamo)
+	user.log.Printf("Deleted over quota upload %s for company %s\n", verification.Key, user.CompanyID)
+	return nil, fmt.Errorf("%w: upload %s was deleted", ErrQuotaExceeded, verification.Key)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestVerifyUpload(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int64
+		stored      int64 //Other objects the company stores
+		declared    int   //The file_size sent to verify
+		reserved    int64 //Reserved in USAGE_TABLE when the URL was signed, none when 0
+		wantErr     error
+		wantDeleted bool
+		wantListed  bool
+	}{
+		{"as declared", 100, 9000000, 100, 0, nil, false, true},
+		{"smaller than declared", 50, 9000000, 100, 0, nil, false, true},
+		{"larger within quota", 200, 9000000, 100, 0, nil, false, true},
+		{"larger over quota", 2000000, 9000000, 100, 0, ErrQuotaExceeded, true, true},
+		{"over quota declared as its size", 2000000, 9000000, 2000000, 0, ErrQuotaExceeded, true, true},
+		{"as reserved", 100, 9000000, 100, 100, nil, false, false},
+		{"larger than reserved within quota", 200, 9000000, 200, 100, nil, false, true},
+		{"larger than reserved over quota", 2000000, 9000000, 2000000, 100, ErrQuotaExceeded, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newFakeS3()
+			svc.head = &s3.HeadObjectOutput{ContentLength: aws.Int64(test.size), ETag: aws.String(`"d41d8cd98f00b204e9800998ecf8427e"`)}
+			svc.pages = [][]*s3.Object{{s3Object("acme/file.txt", test.size), s3Object("acme/other.bin", test.stored)}}
+			db := newFakeDynamo()
+			user := newTestUser()
+			user.Operation = operationVerify
+			user.FileSize = test.declared
+			if test.reserved > 0 {
+				user.config.UsageTable = "usage"
+				now := time.Now()
+				db.put("usage", usageRecord{CompanyID: "acme", Version: 1, Pending: map[string]pendingUpload{
+					"acme/file.txt":  {Token: "upload", Size: test.reserved, SignedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+					"acme/other.txt": {Token: "other", Size: 10, SignedAt: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+				}})
+			}
+			verification, err := user.verifyUpload(withS3Storage(&awsClients{lister: svc, presigner: svc, dynamo: db}))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("verifyUpload() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && (verification.Size != test.size || !verification.Verified ||
+				verification.ETag != "d41d8cd98f00b204e9800998ecf8427e") {
+				t.Errorf("verifyUpload() = %+v, want %d bytes verified with the unquoted ETag", verification, test.size)
+			}
+			if deleted := len(svc.deleted) == 1 && svc.deleted[0] == "acme/file.txt"; deleted != test.wantDeleted {
+				t.Errorf("deleted %v, want the upload deleted %v", svc.deleted, test.wantDeleted)
+			}
+			if listed := len(svc.listed) > 0; listed != test.wantListed {
+				t.Errorf("listed %v, want the quota checked %v", svc.listed, test.wantListed)
+			}
+			if test.reserved == 0 {
+				return
+			}
+			pending := pendingUploads(t, db)
+			if _, kept := pending["acme/file.txt"]; kept == test.wantDeleted || len(pending) == 0 {
+				t.Errorf("pending = %v, want the upload's reservation released %v and the other kept", pending, test.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestVerifyUploadMissing(t *testing.T) {
+	svc := newFakeS3()
+	svc.headErr = s3Error("NotFound")
+	user := newTestUser()
+	user.Operation = operationVerify
+	if _, err := user.verifyUpload(withS3Storage(&awsClients{lister: svc, presigner: svc})); err == nil {
+		t.Error("verifyUpload() succeeded, want the missing upload reported")
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+//Find the version an upload will overwrite so it can be recorded before the URL is issued.  Returns false when
+//nothing exists at the key.  Unversioned buckets report an empty version, objects written before versioning
+//was enabled report "null"
+func (user *User) currentVersion(storage StorageBackend) (string, bool, error) {
+	object, err := storage.Head(user.bucket(), user.objectKey())
+	if err != nil || object == nil {
+		return "", false, err
+	}
+	user.log.Printf("AUDIT: %s signing overwrite of %s, previous version %q\n", user.Sub, user.objectKey(), object.VersionID)
+	return object.VersionID, true, nil
+}
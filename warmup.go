@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//When WARM_UP_CLIENTS is set, make cheap DynamoDB and S3 calls during Lambda init so DNS, the TLS handshakes and
+//credential loading happen before the first request.  The SDK's shared transport keeps the connections for the
+//handler.  Failures are only logged, the handler makes the real calls either way
+func warmUpClients(config *Config) {
+	if !envBool("WARM_UP_CLIENTS", false) {
+		return
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("WARM_UP_TIMEOUT", time.Second*2))
+	defer cancel()
+	clients, err := newAWSClients(config)
+	if err != nil {
+		log.Println("WARNING: warm up unable to create AWS clients: " + err.Error())
+		return
+	}
+	_, err = clients.dynamo.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(config.DynamoTable),
+	})
+	if err != nil {
+		log.Println("WARNING: warm up DynamoDB call failed: " + err.Error())
+	}
+	_, err = clients.lister.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(config.Bucket),
+	})
+	if err != nil {
+		log.Println("WARNING: warm up S3 call failed: " + err.Error())
+	}
+	log.Printf("Warmed up AWS clients in %s\n", time.Since(start))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//fakeWarmUpDynamo answers the warm up's DescribeTable with err
+type fakeWarmUpDynamo struct {
+	*fakeDynamo
+	described []string
+	err       error
+}
+
+func (db *fakeWarmUpDynamo) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	db.described = append(db.described, aws.StringValue(input.TableName))
+	return &dynamodb.DescribeTableOutput{}, db.err
+}
+
+//fakeWarmUpS3 answers the warm up's HeadBucket with err
+type fakeWarmUpS3 struct {
+	*fakeS3
+	headed []string
+	err    error
+}
+
+func (svc *fakeWarmUpS3) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	svc.headed = append(svc.headed, aws.StringValue(input.Bucket))
+	return &s3.HeadBucketOutput{}, svc.err
+}
+
+//Warm up failures are logged and never stop init
+func TestWarmUpClients(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	tests := []struct {
+		name       string
+		enabled    string
+		clientsErr error
+		callErr    error
+		wantCalls  int
+		wantLogged []string
+	}{
+		{"disabled", "", nil, nil, 0, nil},
+		{"warmed up", "true", nil, nil, 1, []string{"Warmed up AWS clients in"}},
+		{"clients unavailable", "true", unavailable, nil, 0, []string{"warm up unable to create AWS clients: unavailable"}},
+		{"calls fail", "true", nil, unavailable, 1, []string{"warm up DynamoDB call failed", "warm up S3 call failed", "Warmed up"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("WARM_UP_CLIENTS", test.enabled)
+			logged := captureLog(t)
+			db := &fakeWarmUpDynamo{fakeDynamo: newFakeDynamo(), err: test.callErr}
+			svc := &fakeWarmUpS3{fakeS3: &fakeS3{}, err: test.callErr}
+			previous := newAWSClients
+			newAWSClients = func(config *Config) (*awsClients, error) {
+				if test.clientsErr != nil {
+					return nil, test.clientsErr
+				}
+				return &awsClients{dynamo: db, lister: svc}, nil
+			}
+			t.Cleanup(func() { newAWSClients = previous })
+			warmUpClients(&Config{DynamoTable: "users", Bucket: "bucket"})
+			if len(db.described) != test.wantCalls || len(svc.headed) != test.wantCalls {
+				t.Errorf("described %v and headed %v, want %d calls each", db.described, svc.headed, test.wantCalls)
+			}
+			for _, line := range test.wantLogged {
+				if !strings.Contains(logged.String(), line) {
+					t.Errorf("logged %q, want %q", logged.String(), line)
+				}
+			}
+			if test.wantLogged == nil && logged.String() != "" {
+				t.Errorf("logged %q, want nothing when disabled", logged.String())
+			}
+		})
+	}
+}